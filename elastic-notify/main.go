@@ -106,7 +106,6 @@ func main() {
 func sendEvent(change Change, eventType event.Name) error {
 	bucketName := change.Source.Bucket
 	objectName := change.Source.Object
-	client := models.GetCache()
 	serverConfig := config.GetServerConfig()
 	nConfig := models.Config{}
 	db := models.GetDB()
@@ -153,11 +152,13 @@ func sendEvent(change Change, eventType event.Name) error {
 			},
 		}
 
-		value, _ := json.Marshal(newEvent)
+		value, _ := models.MarshalEvent(newEvent, resource)
 
 		switch resource.Service {
 		case models.SQS:
-			client.RPush(fmt.Sprintf("%s:%s:%s", resource.Service.String(), resource.AccountID, resource.Name), value)
+			if err := models.PushEvent(resource, value); err != nil {
+				log.Printf("Can not push event to %s. %s\n", resource.ARN(), err)
+			}
 		case models.SNS:
 			celeryBroker, celeryBackend := models.GetCelery()
 			celeryClient, _ := gocelery.NewCeleryClient(celeryBroker, celeryBackend, 0)
@@ -16,6 +16,7 @@ package main
 
 import (
 	"log"
+	"os"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -27,30 +28,48 @@ import (
 )
 
 func init() {
+	// the env overrides the config file, which overrides the .env file
+	if err := config.LoadFile(config.FilePath(os.Args[1:])); err != nil {
+		log.Fatal(err)
+	}
+
 	err := godotenv.Load()
 	if err != nil {
 		log.Fatal("Error loading .env file.")
 	}
 
+	config.CheckRequiredEnv("DATABASE_URL")
+
 	config.SetServerConfig()
 	models.SetDB()
 	models.Migrate()
 	models.SetCache()
 	models.SetCelery()
 	caches.SetRedis()
+
+	// the exports of the new users go to the nfs config pool
+	controllers.CheckNfsConfigPool()
 }
 
 func main() {
+	models.ServeMetrics()
+	controllers.ServeProbes()
+
 	r := gin.Default()
 	r.RedirectTrailingSlash = false
 
 	r.GET("/:bucket", controllers.GetBucketNotification)
 	r.PUT("/:bucket", controllers.PutBucketNotification)
+	r.DELETE("/:bucket", controllers.DeleteBucketNotification)
 	r.PATCH("/:bucket", controllers.PatchBucketPermission)
 	r.PATCH("/:bucket/", controllers.PatchBucketPermission)
 	r.POST("/objects", controllers.MoveObjects)
+	r.POST("/admin/notifications", controllers.RevalidateNotifications)
+	r.POST("/admin/events/replay", controllers.ReplayEvents)
 
-	r.NoRoute(controllers.ReverseProxy())
+	r.NoRoute(controllers.SendBucketTestEvent, controllers.ReverseProxy())
 
-	r.Run()
+	if err := controllers.RunServer(r); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"os"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -13,21 +14,37 @@ import (
 )
 
 func init() {
+	// the env overrides the config file, which overrides the .env file
+	if err := config.LoadFile(config.FilePath(os.Args[1:])); err != nil {
+		log.Fatal(err)
+	}
+
 	err := godotenv.Load()
 	if err != nil {
 		log.Fatal("Error loading .env file.")
 	}
 
+	// the searches fail with ConfigurationError until the index is set
+	config.CheckRequiredEnv("METADATA_INDEX|METADATA_INDEX_PATTERN")
+
 	config.SetServerConfig()
 	models.SetElasticsearch()
 	caches.SetRedis()
 }
 
 func main() {
+	models.ServeMetrics()
+	controllers.ServeProbes()
+
 	r := gin.Default()
 	r.RedirectTrailingSlash = false
 
+	r.GET("/", controllers.SearchAll)
 	r.GET("/:bucket/", controllers.Search)
+	r.GET("/:bucket/search/stats", controllers.SearchStats)
+	r.POST("/:bucket/search/batch", controllers.SearchBatch)
 
-	r.Run()
+	if err := controllers.RunServer(r); err != nil {
+		log.Fatal(err)
+	}
 }
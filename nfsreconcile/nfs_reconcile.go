@@ -0,0 +1,72 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/joho/godotenv"
+
+	"github.com/inwinstack/kaoliang/pkg/config"
+	"github.com/inwinstack/kaoliang/pkg/controllers"
+)
+
+func usage() {
+	fmt.Printf("Usage: %s [run|help] [--dry-run] [--config <file>]\n", os.Args[0])
+	fmt.Println("Creates the missing NFS exports of the RGW users and removes the stale ones,")
+	fmt.Println("the NFS_CONFIG_* env selects the pool, the export list and its lock.")
+	fmt.Println("--dry-run only reports the diff.")
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] != "run" {
+		usage()
+		return
+	}
+
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "report the diff without applying it")
+	configFile := flags.String("config", config.FilePath(nil), "YAML or JSON config file, defaults to CONFIG_FILE")
+	if err := flags.Parse(os.Args[2:]); err != nil || flags.NArg() != 0 {
+		usage()
+		return
+	}
+
+	if err := config.LoadFile(*configFile); err != nil {
+		log.Fatal(err)
+	}
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatal("Error loading .env file.")
+	}
+
+	diff, err := controllers.ReconcileNfsExports(*dryRun)
+	action := ""
+	if *dryRun {
+		action = "would "
+	}
+	for _, uid := range diff.Missing {
+		fmt.Printf("%screate export of %s\n", action, uid)
+	}
+	for _, uid := range diff.Stale {
+		fmt.Printf("%sremove export of %s\n", action, uid)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -18,23 +18,110 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"regexp"
+	"sync"
+	"sync/atomic"
+	"syscall"
 
-	//"strings"
 	"context"
+	"strings"
 	"time"
 
 	"github.com/ceph/go-ceph/rados"
 	"github.com/inwinstack/kaoliang/pkg/controllers"
+	"github.com/inwinstack/kaoliang/pkg/models"
+	"github.com/inwinstack/kaoliang/pkg/utils"
 	"github.com/olivere/elastic"
-	"github.com/satori/go.uuid"
 )
 
-func dumpOpsLogToElasticsearch(oid string) {
-	fmt.Println(oid)
-	return
+// opsLogStore is the subset of *rados.IOContext used to dump the ops logs.
+type opsLogStore interface {
+	Stat(object string) (rados.ObjectStat, error)
+	Read(oid string, data []byte, offset uint64) (int, error)
+	Delete(oid string) error
+	ListObjects(listFn rados.ObjectListFunc) error
+}
+
+// storeOpener opens a store of the ops log pool, the returned func closes it.
+type storeOpener func() (opsLogStore, func(), error)
+
+// bulkUploader uploads the bulk requests by id and returns the failed items.
+type bulkUploader func(requests map[string]*elastic.BulkIndexRequest) ([]*elastic.BulkResponseItem, error)
+
+// maxOpsLogLineSize bounds a line of an ops log object, the lines are much
+// shorter but a long URI does not fit the default of the scanner.
+const maxOpsLogLineSize = 1 << 20
+
+// dumpOpsLogToElasticsearch indexes the logs of the ops log object into
+// esIndex, the malformed lines are skipped. The object is deleted once every
+// log is uploaded, otherwise it is left for the next run.
+func dumpOpsLogToElasticsearch(store opsLogStore, upload bulkUploader, esIndex string, oid string) error {
+	stat, err := store.Stat(oid)
+	if err != nil {
+		return err
+	}
+	// load ops log
+	data := make([]byte, stat.Size)
+	size, err := store.Read(oid, data, 0)
+	if err != nil {
+		return err
+	}
+
+	index := makeIndexName(esIndex, parseLogName(oid)["Date"])
+	requests := make(map[string]*elastic.BulkIndexRequest)
+	skipped := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data[:size]))
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), maxOpsLogLineSize)
+	for lineNo := 0; scanner.Scan(); lineNo++ {
+		var log controllers.OperationLog
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		err := json.Unmarshal([]byte(line), &log)
+		if err == nil {
+			err = log.Validate()
+		}
+		if err != nil {
+			utils.Warn("Skip ops log line", utils.Fields{"object": oid, "line": lineNo + 1, "error": err})
+			skipped++
+			continue
+		}
+		// the id is derived from the line, so an object dumped again
+		// overwrites the logs uploaded by the previous run
+		id := fmt.Sprintf("%s-%d", oid, lineNo)
+		requests[id] = elastic.NewBulkIndexRequest().Index(index).Type("log").Id(id).Doc(log)
+	}
+
+	if err := scanner.Err(); err != nil {
+		// the lines after are not read, keep the object
+		return fmt.Errorf("Can not read %s: %s", oid, err)
+	}
+
+	if skipped > 0 {
+		utils.Warn("Skipped ops log lines", utils.Fields{"object": oid, "skipped": skipped, "lines": skipped + len(requests)})
+	}
+
+	failed, err := upload(requests)
+	if err != nil {
+		return fmt.Errorf("Bulk upload is failed: %s", err)
+	}
+	if len(failed) > 0 {
+		for _, item := range failed {
+			reason := ""
+			if item.Error != nil {
+				reason = item.Error.Reason
+			}
+			utils.Error("Can not upload ops log", utils.Fields{"id": item.Id, "status": item.Status, "reason": reason})
+		}
+		return fmt.Errorf("%d logs of %s are not uploaded, keep it for the next run", len(failed), oid)
+	}
+
+	return store.Delete(oid)
 }
 
 func parseLogName(log string) map[string]string {
@@ -50,6 +137,133 @@ func parseLogName(log string) map[string]string {
 	return params
 }
 
+// makeIndexName resolves the index of an ops log object. A time layout quoted
+// by braces in the index, e.g. opslog-{2006.01.02}, is rendered with the date
+// of the log so indices can be rotated by time. The static index is used as is.
+func makeIndexName(esIndex string, date string) string {
+	pattern := regexp.MustCompile("\\{([^}]+)\\}")
+	if !pattern.MatchString(esIndex) {
+		return esIndex
+	}
+
+	logTime, err := time.Parse("2006-01-02-15", date)
+	if err != nil {
+		// unknown date, put it into the index without date
+		return strings.Trim(pattern.ReplaceAllString(esIndex, ""), "-_.")
+	}
+
+	return pattern.ReplaceAllStringFunc(esIndex, func(layout string) string {
+		return logTime.Format(strings.Trim(layout, "{}"))
+	})
+}
+
+// dumpOpsLogs dumps the ops logs of the pool older than the current hour, the
+// log of the current hour is still written by RGW. The objects are dumped by
+// the given number of workers, each with its own store. When stopping is set
+// the remaining logs are left for the next run, the in-flight bulk requests
+// are always completed. The failed dumps are returned.
+func dumpOpsLogs(open storeOpener, upload bulkUploader, esIndex string, workers int, stopping *int32) []error {
+	store, closeStore, err := open()
+	if err != nil {
+		return []error{err}
+	}
+	now := time.Now().Format("2006-01-02-15")
+	oids := []string{}
+	store.ListObjects(func(oid string) {
+		if parseLogName(oid)["Date"] == now {
+			utils.Debug("Not time to dump ops log", utils.Fields{"object": oid})
+			return
+		}
+		oids = append(oids, oid)
+	})
+	closeStore()
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	errs := []error{}
+	jobs := make(chan string)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store, closeStore, err := open()
+			if err != nil {
+				lock.Lock()
+				errs = append(errs, err)
+				lock.Unlock()
+				for range jobs {
+				}
+				return
+			}
+			defer closeStore()
+
+			for oid := range jobs {
+				if err := dumpOpsLogToElasticsearch(store, upload, esIndex, oid); err != nil {
+					lock.Lock()
+					errs = append(errs, fmt.Errorf("%s: %s", oid, err))
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, oid := range oids {
+		if atomic.LoadInt32(stopping) != 0 {
+			break
+		}
+		jobs <- oid
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, err := range errs {
+		utils.Error("Can not dump ops log", utils.Fields{"error": err})
+	}
+	return errs
+}
+
+// bulkUploadAttempts is the number of bulk requests sent for the failed items
+// of an ops log before it is left for the next run.
+const bulkUploadAttempts = 3
+
+// bulkUpload uploads the requests by id, the failed items are sent again
+// until the attempts run out. The items still failing are returned.
+func bulkUpload(client *elastic.Client, requests map[string]*elastic.BulkIndexRequest, attempts int) ([]*elastic.BulkResponseItem, error) {
+	var failed []*elastic.BulkResponseItem
+	pending := requests
+	for i := 0; i < attempts && len(pending) > 0; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * time.Second)
+		}
+		request := client.Bulk()
+		for _, bulkReq := range pending {
+			request = request.Add(bulkReq)
+		}
+		resp, err := request.Do(context.Background())
+		if err != nil {
+			return nil, err
+		}
+
+		failed = resp.Failed()
+		retries := make(map[string]*elastic.BulkIndexRequest)
+		for _, item := range failed {
+			if bulkReq, ok := pending[item.Id]; ok {
+				retries[item.Id] = bulkReq
+			}
+		}
+		pending = retries
+	}
+
+	return failed, nil
+}
+
+func usage() {
+	fmt.Printf("Usage: %s [start|help] [--interval <duration>] [--once] [--workers <count>] [--es-username <name>] [--es-password <password>] [--es-ca-cert <path>] <ceph user> <pool name> <es address> <es index>\n", os.Args[0])
+	fmt.Println("The es index accepts a date template, e.g. opslog-{2006.01.02}")
+	fmt.Println("With --interval the ops logs are dumped every interval until SIGINT or SIGTERM,")
+	fmt.Println("--once or no interval dumps them once and exits.")
+}
+
 func main() {
 	euid := os.Geteuid()
 	if euid != 0 {
@@ -57,73 +271,91 @@ func main() {
 		return
 	}
 
-	if len(os.Args) != 6 || os.Args[1] == "help" || os.Args[1] != "start" {
-		fmt.Printf("Usage: %s [start|help] <ceph user> <pool name> <es address> <es index>\n", os.Args[0])
+	if len(os.Args) < 2 || os.Args[1] != "start" {
+		usage()
+		return
+	}
+
+	flags := flag.NewFlagSet("start", flag.ContinueOnError)
+	interval := flags.Duration("interval", 0, "dump the ops logs every interval")
+	once := flags.Bool("once", false, "dump the ops logs once and exit")
+	workers := flags.Int("workers", 4, "number of ops logs dumped at the same time")
+	auth := models.ElasticsearchAuthFromEnv()
+	flags.StringVar(&auth.Username, "es-username", auth.Username, "basic auth username of elasticsearch, defaults to ELS_USERNAME")
+	flags.StringVar(&auth.Password, "es-password", auth.Password, "basic auth password of elasticsearch, defaults to ELS_PASSWORD")
+	flags.StringVar(&auth.CACert, "es-ca-cert", auth.CACert, "CA certificate of elasticsearch, defaults to ELS_CA_CERT")
+	if err := flags.Parse(os.Args[2:]); err != nil || flags.NArg() != 4 || *workers <= 0 {
+		usage()
 		return
 	}
 
-	user := os.Args[2]
-	poolName := os.Args[3]
+	user := flags.Arg(0)
+	poolName := flags.Arg(1)
 
 	conn, _ := rados.NewConnWithUser(user)
 	conn.ReadDefaultConfigFile()
 	conn.Connect()
 	defer conn.Shutdown()
 
+	// the workers open their own IOContext, check the pool before dumping
 	ioctx, err := conn.OpenIOContext(poolName)
 	if err != nil {
-		fmt.Println("can not connect pool:", poolName)
+		utils.Error("Can not connect pool", utils.Fields{"pool": poolName, "error": err})
 		return
 	}
-	defer ioctx.Destroy()
+	ioctx.Destroy()
 
-	now := time.Now().Format("2006-01-02-15")
-	esUrl := os.Args[4]
-	esIndex := os.Args[5]
-	client, err := elastic.NewClient(
+	esUrl := flags.Arg(2)
+	esIndex := flags.Arg(3)
+	options, err := auth.Options()
+	if err != nil {
+		utils.Error("Can not load elasticsearch auth", utils.Fields{"error": err})
+		return
+	}
+	client, err := elastic.NewClient(append(options,
 		elastic.SetURL(esUrl),
-	)
+	)...)
 	if err != nil {
-		fmt.Println("Can not connect to elasticsearch: ", err)
+		utils.Error("Can not connect to elasticsearch", utils.Fields{"error": err})
 		return
 	}
 
-	ioctx.ListObjects(func(oid string) {
-		stat, err := ioctx.Stat(oid)
+	open := func() (opsLogStore, func(), error) {
+		ioctx, err := conn.OpenIOContext(poolName)
 		if err != nil {
-			return
-		}
-		params := parseLogName(oid)
-		if params["Date"] == now {
-			fmt.Println("Not time to dump ops log", oid)
-			return
+			return nil, nil, err
 		}
-		// load ops log
-		data := make([]byte, stat.Size)
-		ioctx.Read(oid, data, 0)
+		return ioctx, ioctx.Destroy, nil
+	}
+	upload := func(requests map[string]*elastic.BulkIndexRequest) ([]*elastic.BulkResponseItem, error) {
+		return bulkUpload(client, requests, bulkUploadAttempts)
+	}
 
-		request := client.Bulk()
-		scanner := bufio.NewScanner(bytes.NewReader(data))
-		for scanner.Scan() {
-			id, _ := uuid.NewV4()
-			var log controllers.OperationLog
-			line := scanner.Text()
-			err := json.Unmarshal([]byte(line), &log)
-			if err != nil {
-				fmt.Println(err)
-				continue
-			}
-			// add bulk insert request
-			bulkReq := elastic.NewBulkIndexRequest().Index(esIndex).Type("log").Id(id.String()).Doc(log)
-			request = request.Add(bulkReq)
-		}
-		ctx := context.Background()
-		_, err = request.Do(ctx)
-		if err != nil {
-			fmt.Println("Bulk upload is failed %s", err)
+	var stopping int32
+	if *once || *interval <= 0 {
+		dumpOpsLogs(open, upload, esIndex, *workers, &stopping)
+		return
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	stop := make(chan struct{})
+	go func() {
+		<-signals
+		utils.Info("Stopping, waiting for the in-flight dump", nil)
+		atomic.StoreInt32(&stopping, 1)
+		close(stop)
+	}()
+
+	for {
+		dumpOpsLogs(open, upload, esIndex, *workers, &stopping)
+		select {
+		case <-stop:
 			return
+		case <-ticker.C:
 		}
-
-		ioctx.Delete(oid)
-	})
+	}
 }
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ceph/go-ceph/rados"
+	"github.com/olivere/elastic"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeOpsLogStore keeps the ops log objects in memory, it is shared by the
+// workers of dumpOpsLogs.
+type fakeOpsLogStore struct {
+	lock    sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *fakeOpsLogStore) Stat(object string) (rados.ObjectStat, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	data, ok := s.objects[object]
+	if !ok {
+		return rados.ObjectStat{}, rados.RadosErrorNotFound
+	}
+	return rados.ObjectStat{Size: uint64(len(data))}, nil
+}
+
+func (s *fakeOpsLogStore) Read(oid string, data []byte, offset uint64) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return copy(data, s.objects[oid][offset:]), nil
+}
+
+func (s *fakeOpsLogStore) Delete(oid string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.objects, oid)
+	return nil
+}
+
+func (s *fakeOpsLogStore) ListObjects(listFn rados.ObjectListFunc) error {
+	s.lock.Lock()
+	oids := []string{}
+	for oid := range s.objects {
+		oids = append(oids, oid)
+	}
+	s.lock.Unlock()
+	for _, oid := range oids {
+		listFn(oid)
+	}
+	return nil
+}
+
+func TestDumpOpsLogs(t *testing.T) {
+	Convey("Given the ops logs of a past and the current hour", t, func() {
+		past := "ops_photos_2018-05-26-10.log"
+		current := "ops_photos_" + time.Now().Format("2006-01-02-15") + ".log"
+		line := []byte(`{"project_id":"tester","bucket":"photos","method":"PUT","status_code":"200","date":"2018-05-26T10:00:00Z"}` + "\n")
+		store := &fakeOpsLogStore{objects: map[string][]byte{past: line, current: line}}
+		opened, closed := 0, 0
+		var lock sync.Mutex
+		open := func() (opsLogStore, func(), error) {
+			lock.Lock()
+			defer lock.Unlock()
+			opened++
+			return store, func() {
+				lock.Lock()
+				defer lock.Unlock()
+				closed++
+			}, nil
+		}
+		upload := func(requests map[string]*elastic.BulkIndexRequest) ([]*elastic.BulkResponseItem, error) {
+			return nil, nil
+		}
+
+		Convey("When the logs are dumped", func() {
+			var stopping int32
+			errs := dumpOpsLogs(open, upload, "opslog", 2, &stopping)
+
+			Convey("Only the past log should be dumped and deleted", func() {
+				So(errs, ShouldBeEmpty)
+				So(store.objects, ShouldNotContainKey, past)
+				So(store.objects, ShouldContainKey, current)
+			})
+
+			Convey("Every opened store should be closed", func() {
+				So(opened, ShouldEqual, 3)
+				So(closed, ShouldEqual, opened)
+			})
+		})
+
+		Convey("When the pool can not be opened", func() {
+			var stopping int32
+			errs := dumpOpsLogs(func() (opsLogStore, func(), error) {
+				return nil, nil, errors.New("connection refused")
+			}, upload, "opslog", 2, &stopping)
+
+			Convey("The error should be returned and the logs kept", func() {
+				So(len(errs), ShouldEqual, 1)
+				So(store.objects, ShouldContainKey, past)
+			})
+		})
+	})
+}
+
+func TestDumpOpsLogToElasticsearch(t *testing.T) {
+	Convey("Given an ops log object with a malformed line", t, func() {
+		oid := "ops_photos_2018-05-26-10.log"
+		store := &fakeOpsLogStore{objects: map[string][]byte{
+			oid: []byte(`{"project_id":"tester","bucket":"photos","method":"PUT","status_code":"200","date":"2018-05-26T10:00:00Z"}` + "\n" +
+				`{"bucket":` + "\n" +
+				`{"project_id":"tester","bucket":"photos","method":"GET","status_code":"200","date":"2018-05-26T10:01:00Z"}` + "\n" +
+				`{"project_id":"tester","bucket":"photos","method":"GET"}` + "\n"),
+		}}
+		var uploaded map[string]*elastic.BulkIndexRequest
+
+		Convey("When the logs are uploaded", func() {
+			err := dumpOpsLogToElasticsearch(store, func(requests map[string]*elastic.BulkIndexRequest) ([]*elastic.BulkResponseItem, error) {
+				uploaded = requests
+				return nil, nil
+			}, "opslog-{2006.01.02}", oid)
+
+			Convey("The malformed and invalid lines should be skipped and the rest indexed", func() {
+				So(err, ShouldBeNil)
+				So(len(uploaded), ShouldEqual, 2)
+				So(uploaded, ShouldContainKey, oid+"-0")
+				So(uploaded, ShouldContainKey, oid+"-2")
+
+				source, _ := uploaded[oid+"-0"].Source()
+				So(source[0], ShouldContainSubstring, `"_index":"opslog-2018.05.26"`)
+			})
+
+			Convey("The object should be deleted", func() {
+				So(store.objects, ShouldNotContainKey, oid)
+			})
+		})
+
+		Convey("When some logs fail to upload", func() {
+			err := dumpOpsLogToElasticsearch(store, func(requests map[string]*elastic.BulkIndexRequest) ([]*elastic.BulkResponseItem, error) {
+				return []*elastic.BulkResponseItem{{Id: oid + "-2", Status: 400}}, nil
+			}, "opslog", oid)
+
+			Convey("The object should be kept for the next run", func() {
+				So(err, ShouldNotBeNil)
+				So(store.objects, ShouldContainKey, oid)
+			})
+		})
+
+		Convey("When the bulk request fails", func() {
+			err := dumpOpsLogToElasticsearch(store, func(requests map[string]*elastic.BulkIndexRequest) ([]*elastic.BulkResponseItem, error) {
+				return nil, errors.New("connection refused")
+			}, "opslog", oid)
+
+			Convey("The object should be kept for the next run", func() {
+				So(err, ShouldNotBeNil)
+				So(store.objects, ShouldContainKey, oid)
+			})
+		})
+	})
+}
+
+func TestDumpLongOpsLogLines(t *testing.T) {
+	Convey("Given an ops log object with long lines", t, func() {
+		oid := "ops_photos_2018-05-26-10.log"
+		line := func(uri string) string {
+			return `{"project_id":"tester","bucket":"photos","method":"GET","status_code":"200","date":"2018-05-26T10:00:00Z","uri":"` + uri + `"}` + "\n"
+		}
+		upload := func(requests map[string]*elastic.BulkIndexRequest) ([]*elastic.BulkResponseItem, error) {
+			return nil, nil
+		}
+
+		Convey("A line longer than the default of the scanner should be indexed", func() {
+			store := &fakeOpsLogStore{objects: map[string][]byte{
+				oid: []byte(line(strings.Repeat("a", 128*1024)) + line("/photos/b")),
+			}}
+			So(dumpOpsLogToElasticsearch(store, upload, "opslog", oid), ShouldBeNil)
+			So(store.objects, ShouldNotContainKey, oid)
+		})
+
+		Convey("A line which can not be read should keep the object", func() {
+			store := &fakeOpsLogStore{objects: map[string][]byte{
+				oid: []byte(line(strings.Repeat("a", maxOpsLogLineSize)) + line("/photos/b")),
+			}}
+			So(dumpOpsLogToElasticsearch(store, upload, "opslog", oid), ShouldNotBeNil)
+			So(store.objects, ShouldContainKey, oid)
+		})
+	})
+}
+
+func TestMakeIndexName(t *testing.T) {
+	Convey("Given the index of the ops logs", t, func() {
+		Convey("A date template should be rendered with the date of the log", func() {
+			So(makeIndexName("ops-{2006.01.02}", "2018-05-26-10"), ShouldEqual, "ops-2018.05.26")
+			So(makeIndexName("ops-{2006.01}-{02}", "2018-05-26-10"), ShouldEqual, "ops-2018.05-26")
+		})
+
+		Convey("A log name without a date should fall back to the index without the template", func() {
+			So(makeIndexName("ops-{2006.01.02}", ""), ShouldEqual, "ops")
+		})
+
+		Convey("A static index should be used as is", func() {
+			So(makeIndexName("opslog", "2018-05-26-10"), ShouldEqual, "opslog")
+		})
+	})
+}
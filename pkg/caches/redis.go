@@ -15,6 +15,8 @@ Licensed under the Apache License, Version 2.0 (the "License");
 package caches
 
 import (
+	"time"
+
 	"github.com/go-redis/redis"
 
 	"github.com/inwinstack/kaoliang/pkg/utils"
@@ -23,10 +25,14 @@ import (
 var client *redis.Client
 
 func SetRedis() {
+	timeout := utils.GetEnvDuration("REDIS_TIMEOUT", 3*time.Second)
 	client = redis.NewClient(&redis.Options{
-		Addr:     utils.GetEnv("REDIS_ADDR", "localhost:6789"),
-		Password: utils.GetEnv("REDIS_PASSWORD", ""),
-		DB:       0,
+		Addr:         utils.GetEnv("REDIS_ADDR", "localhost:6789"),
+		Password:     utils.GetEnv("REDIS_PASSWORD", ""),
+		DB:           0,
+		DialTimeout:  timeout,
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
 	})
 }
 
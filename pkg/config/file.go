@@ -0,0 +1,125 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// FilePath returns the path of the config file given by --config in args,
+// CONFIG_FILE otherwise. No config file is loaded when both are empty.
+func FilePath(args []string) string {
+	for i, arg := range args {
+		switch {
+		case arg == "--config" || arg == "-config":
+			if i+1 < len(args) {
+				return args[i+1]
+			}
+		case strings.HasPrefix(arg, "--config="):
+			return strings.TrimPrefix(arg, "--config=")
+		case strings.HasPrefix(arg, "-config="):
+			return strings.TrimPrefix(arg, "-config=")
+		}
+	}
+
+	return os.Getenv("CONFIG_FILE")
+}
+
+// LoadFile sets the environment from the YAML or JSON config file at path,
+// so the settings are read through the env lookups like the .env file. The
+// keys are the env variables, the keys of a nested mapping are joined to its
+// key by _ and a list is joined by commas, e.g.
+//
+//	target:
+//	  host: https://rgw.example.com/s3
+//	admin_users: [admin, ops]
+//
+// sets TARGET_HOST and ADMIN_USERS. The variables already set override the
+// file.
+func LoadFile(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("can not parse config file %s: %s", path, err)
+	}
+
+	values := make(map[string]string)
+	if err := flattenConfig("", doc, values); err != nil {
+		return fmt.Errorf("can not parse config file %s: %s", path, err)
+	}
+	for key, value := range values {
+		if _, ok := os.LookupEnv(key); !ok {
+			os.Setenv(key, value)
+		}
+	}
+
+	return nil
+}
+
+// flattenConfig adds the values of the config to values by their env name.
+func flattenConfig(prefix string, value interface{}, values map[string]string) error {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			if err := flattenConfig(joinConfigKey(prefix, key), item, values); err != nil {
+				return err
+			}
+		}
+	case map[interface{}]interface{}:
+		for key, item := range v {
+			if err := flattenConfig(joinConfigKey(prefix, fmt.Sprint(key)), item, values); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			switch item.(type) {
+			case map[interface{}]interface{}, []interface{}:
+				return fmt.Errorf("the list %s should only hold values", prefix)
+			}
+			items[i] = fmt.Sprint(item)
+		}
+		values[prefix] = strings.Join(items, ",")
+	case nil:
+		values[prefix] = ""
+	default:
+		values[prefix] = fmt.Sprint(v)
+	}
+
+	return nil
+}
+
+func joinConfigKey(prefix string, key string) string {
+	key = strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(key))
+	if prefix == "" {
+		return key
+	}
+
+	return prefix + "_" + key
+}
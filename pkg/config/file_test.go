@@ -0,0 +1,71 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLoadFile(t *testing.T) {
+	Convey("Given a config file", t, func() {
+		dir, _ := ioutil.TempDir("", "kaoliang")
+		defer os.RemoveAll(dir)
+		for _, key := range []string{"TARGET_HOST", "TARGET_TLS_SKIP_VERIFY", "ADMIN_USERS", "METADATA_INDEX"} {
+			defer os.Unsetenv(key)
+		}
+
+		Convey("A YAML file should set the env by the joined keys", func() {
+			path := filepath.Join(dir, "config.yaml")
+			ioutil.WriteFile(path, []byte("target:\n  host: https://rgw.example.com/s3\n  tls-skip-verify: true\n"+
+				"admin_users: [admin, ops]\nmetadata_index: objects\n"), 0600)
+			os.Setenv("METADATA_INDEX", "from-env")
+
+			So(LoadFile(path), ShouldBeNil)
+			So(os.Getenv("TARGET_HOST"), ShouldEqual, "https://rgw.example.com/s3")
+			So(os.Getenv("TARGET_TLS_SKIP_VERIFY"), ShouldEqual, "true")
+			So(os.Getenv("ADMIN_USERS"), ShouldEqual, "admin,ops")
+
+			Convey("The env should override the file", func() {
+				So(os.Getenv("METADATA_INDEX"), ShouldEqual, "from-env")
+			})
+		})
+
+		Convey("A JSON file should be loaded too", func() {
+			path := filepath.Join(dir, "config.json")
+			ioutil.WriteFile(path, []byte(`{"TARGET_HOST": "rgw:7480", "admin_users": ["admin"]}`), 0600)
+
+			So(LoadFile(path), ShouldBeNil)
+			So(os.Getenv("TARGET_HOST"), ShouldEqual, "rgw:7480")
+			So(os.Getenv("ADMIN_USERS"), ShouldEqual, "admin")
+		})
+
+		Convey("A malformed or missing file should fail", func() {
+			path := filepath.Join(dir, "config.yaml")
+			ioutil.WriteFile(path, []byte("target: [host: {"), 0600)
+			So(LoadFile(path), ShouldNotBeNil)
+			So(LoadFile(filepath.Join(dir, "missing.yaml")), ShouldNotBeNil)
+		})
+
+		Convey("No path should load nothing", func() {
+			So(LoadFile(""), ShouldBeNil)
+		})
+	})
+}
+
+func TestFilePath(t *testing.T) {
+	Convey("Given the args of a service", t, func() {
+		Convey("The --config flag should be used", func() {
+			So(FilePath([]string{"--config", "/etc/kaoliang.yaml"}), ShouldEqual, "/etc/kaoliang.yaml")
+			So(FilePath([]string{"--config=/etc/kaoliang.yaml"}), ShouldEqual, "/etc/kaoliang.yaml")
+		})
+
+		Convey("CONFIG_FILE should be the fallback", func() {
+			os.Setenv("CONFIG_FILE", "/etc/kaoliang.json")
+			defer os.Unsetenv("CONFIG_FILE")
+			So(FilePath(nil), ShouldEqual, "/etc/kaoliang.json")
+		})
+	})
+}
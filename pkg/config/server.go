@@ -15,7 +15,10 @@ Licensed under the Apache License, Version 2.0 (the "License");
 package config
 
 import (
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/minio/minio/cmd"
 
@@ -33,6 +36,15 @@ type ServerConfig struct {
 	EnableKaoliangCopy   string
 	EnableKaoliangDelete string
 	EnableElasticCreate  string
+	TrimmedEventTargets  []string
+	EventFormats         map[string]string
+	AdminUsers           []string
+	EventQueueLimits     map[string]QueueLimit
+	ProxyRequestHeaders  HeaderFilter
+	ProxyResponseHeaders HeaderFilter
+	KafkaBrokers         []string
+	KafkaTopics          map[string]string
+	TrustedProxies       []*net.IPNet
 }
 
 func SetServerConfig() {
@@ -45,9 +57,199 @@ func SetServerConfig() {
 		EnableKaoliangCopy:   utils.GetEnv("ENABLE_KAOLIANG_COPY", "True"),
 		EnableKaoliangDelete: utils.GetEnv("ENABLE_KAOLIANG_DELETE", "True"),
 		EnableElasticCreate:  utils.GetEnv("ENABLE_ELASTIC_CREATE", "True"),
+		TrimmedEventTargets:  splitList(utils.GetEnv("TRIMMED_EVENT_TARGETS", "")),
+		EventFormats:         parseEventFormats(utils.GetEnv("EVENT_TARGET_FORMATS", "")),
+		AdminUsers:           splitList(utils.GetEnv("ADMIN_USERS", "")),
+		EventQueueLimits:     parseQueueLimits(utils.GetEnv("EVENT_QUEUE_LIMITS", "")),
+		ProxyRequestHeaders: HeaderFilter{
+			Allow: splitList(utils.GetEnv("PROXY_REQUEST_HEADERS_ALLOW", "")),
+			Deny:  splitList(utils.GetEnv("PROXY_REQUEST_HEADERS_DENY", "")),
+		},
+		ProxyResponseHeaders: HeaderFilter{
+			Allow: splitList(utils.GetEnv("PROXY_RESPONSE_HEADERS_ALLOW", "")),
+			Deny:  splitList(utils.GetEnv("PROXY_RESPONSE_HEADERS_DENY", "")),
+		},
+		KafkaBrokers:   splitList(utils.GetEnv("KAFKA_BROKERS", "")),
+		KafkaTopics:    parseKafkaTopics(utils.GetEnv("KAFKA_TOPICS", "")),
+		TrustedProxies: parseTrustedProxies(utils.GetEnv("TRUSTED_PROXIES", "")),
 	}
 }
 
+// splitList splits a comma separated env value, blank items are dropped.
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// HeaderFilter strips headers passing through the proxy, e.g. the internal
+// routing or backend auth headers of RGW which should not reach the clients,
+// or the client headers which should not reach RGW. When Allow is not empty
+// only the listed headers are kept, the Deny headers are always removed.
+// Both empty passes every header. Note that stripping a signed request
+// header breaks the signature verification of RGW.
+type HeaderFilter struct {
+	Allow []string
+	Deny  []string
+}
+
+// Apply removes the filtered headers from header in place.
+func (f HeaderFilter) Apply(header http.Header) {
+	if len(f.Allow) > 0 {
+		allowed := make(map[string]bool)
+		for _, name := range f.Allow {
+			allowed[http.CanonicalHeaderKey(name)] = true
+		}
+		for name := range header {
+			if !allowed[http.CanonicalHeaderKey(name)] {
+				delete(header, name)
+			}
+		}
+	}
+
+	for _, name := range f.Deny {
+		header.Del(name)
+	}
+}
+
+// Payload formats of the events delivered to a target.
+const (
+	EventFormatS3          = "s3"
+	EventFormatTrimmed     = "trimmed"
+	EventFormatCloudEvents = "cloudevents"
+)
+
+// parseEventFormats parses a comma separated list of
+// <target ARN>=<format>, items with an unknown format are dropped. Targets
+// not listed get the s3 format.
+func parseEventFormats(value string) map[string]string {
+	formats := make(map[string]string)
+	for _, item := range splitList(value) {
+		index := strings.LastIndex(item, "=")
+		if index == -1 {
+			continue
+		}
+		switch format := item[index+1:]; format {
+		case EventFormatS3, EventFormatTrimmed, EventFormatCloudEvents:
+			formats[item[:index]] = format
+		}
+	}
+
+	return formats
+}
+
+// parseKafkaTopics parses a comma separated list of
+// <target ARN>=<Kafka topic>, the events of the listed targets are produced
+// to the topic on KAFKA_BROKERS.
+func parseKafkaTopics(value string) map[string]string {
+	topics := make(map[string]string)
+	for _, item := range splitList(value) {
+		index := strings.LastIndex(item, "=")
+		if index == -1 || index == len(item)-1 {
+			continue
+		}
+		topics[item[:index]] = item[index+1:]
+	}
+
+	return topics
+}
+
+// parseTrustedProxies parses a comma separated list of the IPs or CIDRs of
+// the proxies in front of kaoliang, whose X-Forwarded-* headers are trusted.
+// Invalid items are dropped.
+func parseTrustedProxies(value string) []*net.IPNet {
+	proxies := []*net.IPNet{}
+	for _, item := range splitList(value) {
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		if _, proxy, err := net.ParseCIDR(item); err == nil {
+			proxies = append(proxies, proxy)
+		}
+	}
+
+	return proxies
+}
+
+// Overflow policies of a full event queue.
+const (
+	OverflowDropOldest = "drop-oldest"
+	OverflowReject     = "reject"
+	OverflowDeadLetter = "dead-letter"
+)
+
+// QueueLimit is the maximum length of the event list of a target and the
+// policy applied when the list is full.
+type QueueLimit struct {
+	MaxLength int64
+	Overflow  string
+}
+
+// parseQueueLimits parses a comma separated list of
+// <target ARN>=<max length>[:<overflow policy>], the policy defaults to
+// drop-oldest. Targets not listed are unbounded.
+func parseQueueLimits(value string) map[string]QueueLimit {
+	limits := make(map[string]QueueLimit)
+	for _, item := range splitList(value) {
+		index := strings.LastIndex(item, "=")
+		if index == -1 {
+			continue
+		}
+		arn := item[:index]
+		tokens := strings.SplitN(item[index+1:], ":", 2)
+		maxLength, err := strconv.ParseInt(tokens[0], 10, 64)
+		if err != nil || maxLength <= 0 {
+			continue
+		}
+
+		limit := QueueLimit{MaxLength: maxLength, Overflow: OverflowDropOldest}
+		if len(tokens) == 2 {
+			switch tokens[1] {
+			case OverflowDropOldest, OverflowReject, OverflowDeadLetter:
+				limit.Overflow = tokens[1]
+			default:
+				continue
+			}
+		}
+		limits[arn] = limit
+	}
+
+	return limits
+}
+
+// CheckRequiredEnv logs whether each of the required env variables is set,
+// the values are not logged. A name like A|B is set when any of A and B is
+// set. The missing ones are returned.
+func CheckRequiredEnv(required ...string) []string {
+	missing := []string{}
+	for _, name := range required {
+		set := false
+		for _, key := range strings.Split(name, "|") {
+			if utils.GetEnv(key, "") != "" {
+				set = true
+				break
+			}
+		}
+		if set {
+			utils.Info("Required env is set", utils.Fields{"key": name})
+			continue
+		}
+		utils.Error("Required env is not set", utils.Fields{"key": name})
+		missing = append(missing, name)
+	}
+
+	return missing
+}
+
 func GetServerConfig() *ServerConfig {
 	return serverConfig
 }
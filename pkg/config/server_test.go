@@ -0,0 +1,27 @@
+package config
+
+import (
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCheckRequiredEnv(t *testing.T) {
+	Convey("Given the required env of a service", t, func() {
+		os.Setenv("METADATA_INDEX_PATTERN", "objects-{bucket}")
+		defer os.Unsetenv("METADATA_INDEX_PATTERN")
+		os.Unsetenv("METADATA_INDEX")
+		os.Unsetenv("DATABASE_URL")
+
+		Convey("Only the missing env should be returned", func() {
+			So(CheckRequiredEnv("METADATA_INDEX|METADATA_INDEX_PATTERN", "DATABASE_URL"), ShouldResemble, []string{"DATABASE_URL"})
+		})
+
+		Convey("Nothing should be missing when all are set", func() {
+			os.Setenv("DATABASE_URL", "mysql://kaoliang")
+			defer os.Unsetenv("DATABASE_URL")
+			So(CheckRequiredEnv("METADATA_INDEX|METADATA_INDEX_PATTERN", "DATABASE_URL"), ShouldBeEmpty)
+		})
+	})
+}
@@ -26,3 +26,15 @@ func authenticate(r *http.Request) (string, cmd.APIErrorCode) {
 	config := config.GetServerConfig()
 	return config.AuthBackend.GetUser(r)
 }
+
+// isAdmin returns true if the user is one of the ADMIN_USERS.
+func isAdmin(userID string) bool {
+	config := config.GetServerConfig()
+	for _, admin := range config.AdminUsers {
+		if admin == userID {
+			return true
+		}
+	}
+
+	return false
+}
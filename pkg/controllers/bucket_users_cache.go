@@ -0,0 +1,68 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/inwinstack/kaoliang/pkg/models"
+	"github.com/inwinstack/kaoliang/pkg/utils"
+)
+
+// usersCache is an LRU of the users granted by the policy of the buckets,
+// which saves a radosgw-admin call on every authorized request. The entries
+// expire after the TTL, so a changed policy is picked up late by up to the
+// TTL. Only the found buckets are cached, a missing bucket may be created any
+// time.
+type usersCache struct {
+	*lruCache
+}
+
+func newUsersCache(size int, ttl time.Duration) *usersCache {
+	return &usersCache{newLRUCache(size, ttl, models.BucketUsersCacheRequests)}
+}
+
+func (c *usersCache) get(bucket string) (users []string, found bool) {
+	value, found := c.lruCache.get(bucket)
+	if !found {
+		return nil, false
+	}
+
+	return value.([]string), true
+}
+
+func (c *usersCache) add(bucket string, users []string) {
+	c.lruCache.add(bucket, users)
+}
+
+var (
+	bucketUsers       *usersCache
+	bucketUsersLoaded sync.Once
+)
+
+// getBucketUsersCache returns the cache of BUCKET_USERS_CACHE_SIZE buckets
+// expiring after BUCKET_USERS_CACHE_TTL, a TTL of 0 disables the cache.
+func getBucketUsersCache() *usersCache {
+	bucketUsersLoaded.Do(func() {
+		size := utils.GetEnvPositiveInt("BUCKET_USERS_CACHE_SIZE", 4096)
+		ttl := utils.GetEnvDuration("BUCKET_USERS_CACHE_TTL", 30*time.Second)
+		if ttl > 0 {
+			bucketUsers = newUsersCache(size, ttl)
+		}
+	})
+
+	return bucketUsers
+}
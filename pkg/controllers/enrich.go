@@ -0,0 +1,191 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/inwinstack/kaoliang/pkg/caches"
+	"github.com/inwinstack/kaoliang/pkg/utils"
+)
+
+type GrantEntry struct {
+	Grantee    string `json:"Grantee"`
+	Permission string `json:"Permission"`
+}
+
+type TagEntry struct {
+	Key   string `json:"Key"`
+	Value string `json:"Value"`
+}
+
+// enrichFields lists the live values which enrich= can join into the search
+// results.
+var enrichFields = map[string]bool{"acl": true, "tags": true}
+
+// parseEnrich returns the set of fields of enrich=acl,tags, false is
+// returned for an unknown field.
+func parseEnrich(value string) (map[string]bool, bool) {
+	fields := make(map[string]bool)
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if !enrichFields[field] {
+			return nil, false
+		}
+		fields[field] = true
+	}
+
+	return fields, true
+}
+
+// enrichObjects fetches the live ACL and tags of the objects from RGW with
+// the credentials of the user and merges them into the objects. The values
+// are cached per user for SEARCH_ENRICH_CACHE_TTL, an object which can not
+// be fetched is left as is.
+func enrichObjects(objs []Object, fields map[string]bool, userID, accessKey, secretKey string) {
+	client, err := newRGWClient(accessKey, secretKey)
+	if err != nil {
+		utils.Warn("Can not create RGW client", utils.Fields{"error": err})
+		return
+	}
+
+	ttl := utils.GetEnvDuration("SEARCH_ENRICH_CACHE_TTL", 30*time.Second)
+
+	var wg sync.WaitGroup
+	for i := range objs {
+		wg.Add(1)
+		go func(obj *Object) {
+			defer wg.Done()
+			if fields["acl"] {
+				obj.ACL = getCachedACL(client, obj, userID, ttl)
+			}
+			if fields["tags"] {
+				obj.Tags = getCachedTags(client, obj, userID, ttl)
+			}
+		}(&objs[i])
+	}
+	wg.Wait()
+}
+
+// newRGWClient returns a S3 client of RGW signing with the credentials of a
+// user. It reaches RGW like the proxy does, by the base path and the TLS
+// options of TARGET_HOST.
+func newRGWClient(accessKey, secretKey string) (*s3.S3, error) {
+	rgw, err := loadUpstream()
+	if err != nil {
+		return nil, err
+	}
+
+	awsConfig := &aws.Config{
+		Region:           aws.String(utils.GetEnv("RGW_REGION", "us-east-1")),
+		Endpoint:         aws.String(rgw.target.String()),
+		Credentials:      credentials.NewStaticCredentials(accessKey, secretKey, ""),
+		S3ForcePathStyle: aws.Bool(true),
+	}
+	if rgw.transport != nil {
+		awsConfig.HTTPClient = &http.Client{Transport: rgw.transport}
+	}
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return s3.New(sess), nil
+}
+
+func enrichCacheKey(field, userID string, obj *Object) string {
+	return fmt.Sprintf("enrich:%s:%s:%s/%s:%s", field, userID, obj.Bucket, obj.Key, obj.Instance)
+}
+
+func versionID(obj *Object) *string {
+	if obj.Instance == "" {
+		return nil
+	}
+
+	return aws.String(obj.Instance)
+}
+
+func getCachedACL(client *s3.S3, obj *Object, userID string, ttl time.Duration) []GrantEntry {
+	var grants []GrantEntry
+	key := enrichCacheKey("acl", userID, obj)
+	if data, err := caches.GetRedis().Get(key).Bytes(); err == nil && json.Unmarshal(data, &grants) == nil {
+		return grants
+	}
+
+	output, err := client.GetObjectAcl(&s3.GetObjectAclInput{
+		Bucket:    aws.String(obj.Bucket),
+		Key:       aws.String(obj.Key),
+		VersionId: versionID(obj),
+	})
+	if err != nil {
+		return nil
+	}
+
+	grants = []GrantEntry{}
+	for _, grant := range output.Grants {
+		if grant.Grantee == nil {
+			continue
+		}
+		grantee := aws.StringValue(grant.Grantee.ID)
+		if grantee == "" {
+			grantee = aws.StringValue(grant.Grantee.URI)
+		}
+		grants = append(grants, GrantEntry{Grantee: grantee, Permission: aws.StringValue(grant.Permission)})
+	}
+
+	if data, err := json.Marshal(grants); err == nil {
+		caches.GetRedis().Set(key, data, ttl)
+	}
+
+	return grants
+}
+
+func getCachedTags(client *s3.S3, obj *Object, userID string, ttl time.Duration) []TagEntry {
+	var tags []TagEntry
+	key := enrichCacheKey("tags", userID, obj)
+	if data, err := caches.GetRedis().Get(key).Bytes(); err == nil && json.Unmarshal(data, &tags) == nil {
+		return tags
+	}
+
+	output, err := client.GetObjectTagging(&s3.GetObjectTaggingInput{
+		Bucket:    aws.String(obj.Bucket),
+		Key:       aws.String(obj.Key),
+		VersionId: versionID(obj),
+	})
+	if err != nil {
+		return nil
+	}
+
+	tags = []TagEntry{}
+	for _, tag := range output.TagSet {
+		tags = append(tags, TagEntry{Key: aws.StringValue(tag.Key), Value: aws.StringValue(tag.Value)})
+	}
+
+	if data, err := json.Marshal(tags); err == nil {
+		caches.GetRedis().Set(key, data, ttl)
+	}
+
+	return tags
+}
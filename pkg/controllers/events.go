@@ -0,0 +1,147 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/minio/minio/pkg/event"
+
+	"github.com/inwinstack/kaoliang/pkg/utils"
+)
+
+// eventJob is an event waiting to be published, the response is a copy whose
+// body must not be read.
+type eventJob struct {
+	resp      *http.Response
+	eventType event.Name
+	etag      string
+	size      int64
+	eventTime time.Time
+}
+
+var (
+	eventJobs          chan eventJob
+	eventWorkersLoaded sync.Once
+	eventWorkers       sync.WaitGroup
+	// eventJobsLock guards eventJobsClosed, the queue is closed by DrainEvents
+	eventJobsLock   sync.RWMutex
+	eventJobsClosed bool
+)
+
+// startEventWorkers starts EVENT_WORKERS goroutines publishing the events of
+// a queue of EVENT_QUEUE_SIZE jobs.
+func startEventWorkers() {
+	size := utils.GetEnvInt("EVENT_QUEUE_SIZE", 1000)
+	if size < 0 {
+		size = 1000
+	}
+	workers := utils.GetEnvPositiveInt("EVENT_WORKERS", 4)
+
+	eventJobs = make(chan eventJob, size)
+	for i := 0; i < workers; i++ {
+		eventWorkers.Add(1)
+		go func(jobs chan eventJob) {
+			defer eventWorkers.Done()
+			for job := range jobs {
+				publishEvent(job)
+			}
+		}(eventJobs)
+	}
+}
+
+// enqueueEvent queues the job for the workers, so the proxied response does
+// not wait for the config read and the delivery. A full queue drops the job
+// instead of stalling the proxy.
+func enqueueEvent(job eventJob) {
+	eventWorkersLoaded.Do(startEventWorkers)
+
+	resp := *job.resp
+	resp.Header = cloneHeader(job.resp.Header)
+	req := *job.resp.Request
+	req.Header = cloneHeader(job.resp.Request.Header)
+	resp.Request = &req
+	resp.Body = nil
+	job.resp = &resp
+
+	eventJobsLock.RLock()
+	defer eventJobsLock.RUnlock()
+	if eventJobsClosed {
+		utils.Warn("Event queue is closed, dropping event", utils.Fields{"type": job.eventType, "path": req.URL.Path, "request_id": job.resp.Header.Get("X-Amz-Request-Id")})
+		return
+	}
+
+	select {
+	case eventJobs <- job:
+	default:
+		utils.Warn("Event queue is full, dropping event", utils.Fields{"type": job.eventType, "path": req.URL.Path, "request_id": job.resp.Header.Get("X-Amz-Request-Id")})
+	}
+}
+
+// DrainEvents closes the event queue and waits for the workers to publish the
+// queued events, the events enqueued afterwards are dropped. The context
+// error is returned when the queue is not drained in time.
+func DrainEvents(ctx context.Context) error {
+	// the workers are not started after the queue is closed
+	eventWorkersLoaded.Do(func() {})
+
+	eventJobsLock.Lock()
+	if !eventJobsClosed && eventJobs != nil {
+		close(eventJobs)
+	}
+	eventJobsClosed = true
+	eventJobsLock.Unlock()
+
+	return waitGroup(ctx, &eventWorkers)
+}
+
+// backgroundTasks tracks the webhook deliveries, ops logs and NFS export
+// writes running after their request or event, so they are not lost on
+// shutdown.
+var backgroundTasks sync.WaitGroup
+
+// goBackground runs the task in a goroutine tracked by backgroundTasks.
+func goBackground(task func()) {
+	backgroundTasks.Add(1)
+	go func() {
+		defer backgroundTasks.Done()
+		task()
+	}()
+}
+
+// WaitBackgroundTasks waits for the background tasks, it is called once the
+// requests and the events are drained so no task is started afterwards. The
+// context error is returned when the tasks are not done in time.
+func WaitBackgroundTasks(ctx context.Context) error {
+	return waitGroup(ctx, &backgroundTasks)
+}
+
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"math/rand"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -34,6 +35,7 @@ import (
 
 type RgwUser struct {
 	UserId      string   `json:"user_id"`
+	Tenant      string   `json:"tenant"`
 	DisplayName string   `json:"display_name"`
 	MaxBuckets  int      `json:"max_buckets"`
 	Keys        []RgwKey `json:"keys"`
@@ -45,21 +47,99 @@ type RgwKey struct {
 	SecretKey string `json:"secret_key"`
 }
 
+// exportStore is the subset of *rados.IOContext used to manage NFS exports.
+type exportStore interface {
+	Stat(object string) (rados.ObjectStat, error)
+	Read(oid string, data []byte, offset uint64) (int, error)
+	WriteFull(oid string, data []byte) error
+	Append(oid string, data []byte) error
+	Delete(oid string) error
+	GetXattr(object string, name string, data []byte) (int, error)
+	SetXattr(object string, name string, data []byte) error
+	LockExclusive(oid, name, cookie, desc string, duration time.Duration, flags *byte) (int, error)
+	Unlock(oid, name, cookie string) (int, error)
+	ListObjects(listFn rados.ObjectListFunc) error
+}
+
+// exportKey returns the S3 key the export mounts RGW with. A user may have
+// several keys, including the keys of its subusers, so the first key of the
+// user itself is preferred over the first key.
+func exportKey(data *RgwUser) (RgwKey, bool) {
+	if len(data.Keys) == 0 {
+		return RgwKey{}, false
+	}
+	for _, key := range data.Keys {
+		if key.User == data.UserId {
+			return key, true
+		}
+	}
+
+	return data.Keys[0], true
+}
+
 func random(min int, max int) int {
 	rand.Seed(time.Now().UnixNano())
 	return rand.Intn(max-min) + min
 }
 
-func connect() (*rados.Conn, *rados.IOContext) {
-	nfsCfgUser := utils.GetEnv("NFS_CONFIG_User", "admin")
-	nfsCfgPool := utils.GetEnv("NFS_CONFIG_POOL", "nfs-ganesha")
+// nfsExportConfig names the rados objects of the NFS exports, they differ
+// across the clusters.
+type nfsExportConfig struct {
+	User       string
+	Pool       string
+	ExportList string
+	Lock       string
+	Template   string
+}
+
+// loadNfsExportConfig reads the names from NFS_CONFIG_User, NFS_CONFIG_POOL,
+// NFS_CONFIG_NAME, NFS_CONFIG_LOCK and NFS_EXPORT_TMPL.
+func loadNfsExportConfig() nfsExportConfig {
+	return nfsExportConfig{
+		User:       utils.GetEnv("NFS_CONFIG_User", "admin"),
+		Pool:       utils.GetEnv("NFS_CONFIG_POOL", "nfs-ganesha"),
+		ExportList: utils.GetEnv("NFS_CONFIG_NAME", "export"),
+		Lock:       utils.GetEnv("NFS_CONFIG_LOCK", "export_add_lock"),
+		Template:   utils.GetEnv("NFS_EXPORT_TMPL", "export.tmpl"),
+	}
+}
+
+// CheckNfsConfigPool tells whether the NFS config pool can be opened, so a
+// wrong pool is reported at startup rather than by the first user created.
+func CheckNfsConfigPool() error {
+	nfsConfig := loadNfsExportConfig()
+	_, closeStore, err := openExportStore(nfsConfig)
+	if err != nil {
+		utils.Error("Can not connect nfs config pool", utils.Fields{"pool": nfsConfig.Pool, "error": err})
+		return err
+	}
+	closeStore()
+
+	return nil
+}
 
+// openExportStore opens the NFS config pool as the NFS config user, the
+// returned func closes the store. The tests replace it by an in-memory store.
+var openExportStore = func(nfsConfig nfsExportConfig) (exportStore, func(), error) {
 	// connect rados
-	conn, _ := rados.NewConnWithUser(nfsCfgUser)
+	conn, err := rados.NewConnWithUser(nfsConfig.User)
+	if err != nil {
+		return nil, nil, err
+	}
 	conn.ReadDefaultConfigFile()
-	conn.Connect()
-	ioctx, _ := conn.OpenIOContext(nfsCfgPool)
-	return conn, ioctx
+	if err := conn.Connect(); err != nil {
+		return nil, nil, err
+	}
+	ioctx, err := conn.OpenIOContext(nfsConfig.Pool)
+	if err != nil {
+		conn.Shutdown()
+		return nil, nil, err
+	}
+
+	return ioctx, func() {
+		ioctx.Destroy()
+		conn.Shutdown()
+	}, nil
 }
 
 func addNfsExport(body []byte) {
@@ -73,56 +153,116 @@ func addNfsExport(body []byte) {
 	if userData.MaxBuckets == -1 {
 		return
 	}
-	nfsCfgPool := utils.GetEnv("NFS_CONFIG_POOL", "nfs-ganesha")
-	nfsCfgName := utils.GetEnv("NFS_CONFIG_NAME", "export")
+	if _, ok := exportKey(&userData); !ok {
+		utils.Warn("Not found any user keys", utils.Fields{"uid": userData.UserId})
+		return
+	}
+	nfsConfig := loadNfsExportConfig()
+
+	attempts := utils.GetEnvPositiveInt("NFS_EXPORT_RETRIES", 3)
+	delay := utils.GetEnvDuration("NFS_EXPORT_RETRY_DELAY", 200*time.Millisecond)
+
+	store, closeStore, err := openExportStore(nfsConfig)
+	if err != nil {
+		utils.Error("Can not connect nfs config pool", utils.Fields{"pool": nfsConfig.Pool, "error": err})
+		return
+	}
+	defer closeStore()
 
-	conn, ioctx := connect()
-	defer ioctx.Destroy()
-	defer conn.Shutdown()
+	err = retry(attempts, delay, func() error {
+		return exportNfsUser(store, nfsConfig, &userData)
+	})
+	if err != nil {
+		utils.Error("Can not create nfs export", utils.Fields{"uid": userData.UserId, "error": err})
+	}
+}
 
+// exportNfsUser creates the export object of the user and adds it to the
+// export list. Both steps are idempotent, so a half-done export is completed
+// by running it again and always ends with one object and one list entry.
+func exportNfsUser(store exportStore, nfsConfig nfsExportConfig, data *RgwUser) error {
 	// create export obj
-	exportObjName := createNfsExportObj(ioctx, &userData)
+	exportObjName, err := createNfsExportObj(store, nfsConfig, data)
+	if err != nil {
+		return err
+	}
 	// add export obj path to export list
-	addExportPathToList(ioctx, nfsCfgName, nfsCfgPool, exportObjName)
+	return addExportPathToList(store, nfsConfig, exportObjName)
+}
+
+// retry calls fn until it succeeds or the attempts run out, the delay is
+// doubled after each failure.
+func retry(attempts int, delay time.Duration, fn func() error) (err error) {
+	for i := 0; i < attempts; i++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+
+	return err
 }
 
 func updateNfsExport(uid string) {
 	output, err := sh.Command("radosgw-admin", "user", "info", "--uid", uid).Output()
 	if err != nil {
-		fmt.Println("Can not get user info for uid", uid)
+		utils.Error("Can not get user info", utils.Fields{"uid": uid, "error": err})
 		return
 	}
 	var userData RgwUser
 	err = json.Unmarshal(output, &userData)
 	if err != nil {
-		fmt.Println("Can not parse user info output for uid", uid)
+		utils.Error("Can not parse user info output", utils.Fields{"uid": uid, "error": err})
 		return
 	}
-	if len(userData.Keys) <= 0 {
-		fmt.Println("Not found any user keys for uid", uid)
+	if _, ok := exportKey(&userData); !ok {
+		utils.Warn("Not found any user keys", utils.Fields{"uid": uid})
 		return
 	}
 
-	conn, ioctx := connect()
-	defer ioctx.Destroy()
-	defer conn.Shutdown()
+	nfsConfig := loadNfsExportConfig()
+	store, closeStore, err := openExportStore(nfsConfig)
+	if err != nil {
+		utils.Error("Can not connect nfs config pool", utils.Fields{"uid": uid, "error": err})
+		return
+	}
+	defer closeStore()
 
-	updateNfsExportObj(ioctx, &userData)
+	updateNfsExportObj(store, nfsConfig, &userData)
 }
 
 func removeNfsExport(userId string) {
-	nfsCfgPool := utils.GetEnv("NFS_CONFIG_POOL", "nfs-ganesha")
-	nfsCfgName := utils.GetEnv("NFS_CONFIG_NAME", "export")
+	nfsConfig := loadNfsExportConfig()
+
+	attempts := utils.GetEnvPositiveInt("NFS_EXPORT_RETRIES", 3)
+	delay := utils.GetEnvDuration("NFS_EXPORT_RETRY_DELAY", 200*time.Millisecond)
+
+	store, closeStore, err := openExportStore(nfsConfig)
+	if err != nil {
+		utils.Error("Can not connect nfs config pool", utils.Fields{"pool": nfsConfig.Pool, "error": err})
+		return
+	}
+	defer closeStore()
 
-	conn, ioctx := connect()
-	defer ioctx.Destroy()
-	defer conn.Shutdown()
+	err = retry(attempts, delay, func() error {
+		return unexportNfsUser(store, nfsConfig, userId)
+	})
+	if err != nil {
+		utils.Error("Can not remove nfs export", utils.Fields{"uid": userId, "error": err})
+	}
+}
 
+// unexportNfsUser removes the export of the user from the export list, then
+// deletes its export object. Both steps are idempotent like exportNfsUser.
+func unexportNfsUser(store exportStore, nfsConfig nfsExportConfig, userId string) error {
 	exportObjName := makeExportObjName(userId)
 	// remove export obj path to export list
-	removeExportPathToList(ioctx, nfsCfgName, nfsCfgPool, exportObjName)
+	if err := removeExportPathToList(store, nfsConfig, exportObjName); err != nil {
+		return err
+	}
 	// remove export obj
-	removeNfsExportObj(ioctx, exportObjName)
+	return removeNfsExportObj(store, exportObjName)
 }
 
 func makeExportObjName(userId string) string {
@@ -133,44 +273,199 @@ func makeExport(poolName, exportObjName string) string {
 	return fmt.Sprintf("%%url \"rados://%s/%s\"\n", poolName, exportObjName)
 }
 
-func addExportPathToList(ioctx *rados.IOContext, exportName string, poolName string, exportObjName string) {
-	lock := "export_add_lock"
+// addExportPathToList adds the export to the export list. The lock of the
+// list is taken by both the adding and the removing of exports, so neither
+// overwrites the other.
+func addExportPathToList(store exportStore, nfsConfig nfsExportConfig, exportObjName string) error {
+	exportName, lock := nfsConfig.ExportList, nfsConfig.Lock
 	cookie := "export_add_cookie"
-	newExport := makeExport(poolName, exportObjName)
-	ioctx.LockExclusive(exportName, lock, cookie, "add export", 0, nil)
-	ioctx.Append(exportName, []byte(newExport))
-	ioctx.Unlock(exportName, lock, cookie)
+	newExport := makeExport(nfsConfig.Pool, exportObjName)
+	ret, err := store.LockExclusive(exportName, lock, cookie, "add export", 0, nil)
+	if err != nil {
+		return err
+	}
+	if ret != 0 {
+		return fmt.Errorf("export list %s is locked", exportName)
+	}
+	defer store.Unlock(exportName, lock, cookie)
+
+	// the export is listed already, e.g. by a previous attempt
+	exports, err := readObject(store, exportName)
+	if err != nil && err != rados.RadosErrorNotFound {
+		return err
+	}
+	if strings.Contains(string(exports), newExport) {
+		return nil
+	}
+
+	return store.Append(exportName, []byte(newExport))
+}
+
+func readObject(store exportStore, oid string) ([]byte, error) {
+	stat, err := store.Stat(oid)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, stat.Size)
+	size, err := store.Read(oid, data, 0)
+	if err != nil {
+		return nil, err
+	}
+	return data[:size], nil
+}
+
+// exportSettings are the export options of the built-in export template.
+// Pseudo and Path may hold the variables of exportVariables.
+type exportSettings struct {
+	AccessType string
+	Protocols  string
+	Transports string
+	Path       string
+	Pseudo     string
+}
+
+// loadExportSettings reads the export options from NFS_EXPORT_ACCESS_TYPE,
+// NFS_EXPORT_PROTOCOLS, NFS_EXPORT_TRANSPORTS, NFS_EXPORT_PATH and
+// NFS_EXPORT_PSEUDO.
+func loadExportSettings() exportSettings {
+	return exportSettings{
+		AccessType: utils.GetEnv("NFS_EXPORT_ACCESS_TYPE", "RW"),
+		Protocols:  utils.GetEnv("NFS_EXPORT_PROTOCOLS", "4"),
+		Transports: utils.GetEnv("NFS_EXPORT_TRANSPORTS", "TCP"),
+		Path:       utils.GetEnv("NFS_EXPORT_PATH", "/"),
+		Pseudo:     utils.GetEnv("NFS_EXPORT_PSEUDO", "/{displayName}"),
+	}
+}
+
+// exportVariables returns the replacer of the variables of the export paths
+// resolved from the user info, escape escapes the values, e.g. for a format
+// string. {userId} is the user id without its tenant, {tenant} the tenant of
+// the user and {displayName} its display name. RGW has no bucket in the user
+// info, so there is no {bucket}.
+func exportVariables(data *RgwUser, escape func(string) string) *strings.Replacer {
+	userId, tenant := data.UserId, data.Tenant
+	if i := strings.Index(userId, "$"); i != -1 {
+		tenant, userId = userId[:i], userId[i+1:]
+	}
+
+	return strings.NewReplacer(
+		"{userId}", escape(userId),
+		"{tenant}", escape(tenant),
+		"{displayName}", escape(data.DisplayName),
+	)
+}
+
+// makeExportPseudo renders the pseudo path template of the user, the path
+// should be absolute and can not contain quotes or unknown variables.
+func makeExportPseudo(settings exportSettings, data *RgwUser) (string, error) {
+	pseudo := exportVariables(data, func(s string) string { return s }).Replace(settings.Pseudo)
+	if !strings.HasPrefix(pseudo, "/") || strings.ContainsAny(pseudo, "\"{}\n") || strings.Contains(pseudo, "//") {
+		return "", fmt.Errorf("invalid pseudo path %q for %s", pseudo, data.UserId)
+	}
+
+	return pseudo, nil
 }
 
-func loadExportTemplate(ioctx *rados.IOContext, exportTmplName string) string {
-	stat, _ := ioctx.Stat(exportTmplName)
-	size := stat.Size
-	data := make([]byte, size)
-	ioctx.Read(exportTmplName, data, 0)
-	return string(data)
+// findPseudoOwner returns the export obj whose pseudo xattr is pseudo, the
+// pseudo xattr is stored without the leading slash.
+func findPseudoOwner(store exportStore, pseudo string) string {
+	pseudo = strings.TrimPrefix(pseudo, "/")
+	owner := ""
+	store.ListObjects(func(oid string) {
+		if owner != "" || !strings.HasPrefix(oid, "export_") {
+			return
+		}
+		value := make([]byte, 1024)
+		size, err := store.GetXattr(oid, "pseudo", value)
+		if err == nil && string(value[:size]) == pseudo {
+			owner = oid
+		}
+	})
+
+	return owner
+}
+
+// unknownExportVariable matches a variable left in a rendered template, the
+// blocks of the ganesha config are opened by a brace after a space.
+var unknownExportVariable = regexp.MustCompile(`\{\w+\}`)
+
+// renderExportTemplate resolves the export variables of the user in the
+// template, the values are escaped since the template is a format string. A
+// template with unknown variables, e.g. a Path of {bucket}, is rejected.
+func renderExportTemplate(exportTmpl string, data *RgwUser) (string, error) {
+	export := exportVariables(data, strings.NewReplacer("%", "%%").Replace).Replace(exportTmpl)
+	if variable := unknownExportVariable.FindString(export); variable != "" {
+		return "", fmt.Errorf("unknown variable %s in export template of %s", variable, data.UserId)
+	}
+
+	return export, nil
+}
+
+// template renders the export template, the export id, pseudo, user id,
+// access key and secret key are left as verbs like in the template object.
+func (settings exportSettings) template() string {
+	escape := strings.NewReplacer("%", "%%").Replace
+
+	return "EXPORT {\n" +
+		"    Export_ID = %d;\n" +
+		"    Path = \"" + escape(settings.Path) + "\";\n" +
+		"    Pseudo = \"/%s\";\n" +
+		"    Access_Type = " + escape(settings.AccessType) + ";\n" +
+		"    Protocols = " + escape(settings.Protocols) + ";\n" +
+		"    Transports = " + escape(settings.Transports) + ";\n" +
+		"    FSAL {\n" +
+		"        Name = RGW;\n" +
+		"        User_Id = \"%s\";\n" +
+		"        Access_Key_Id = \"%s\";\n" +
+		"        Secret_Access_Key = \"%s\";\n" +
+		"    }\n" +
+		"}\n"
+}
+
+// loadExportTemplate reads the template object, the built-in template from
+// the export settings is used when the pool has none.
+func loadExportTemplate(store exportStore, exportTmplName string) (string, error) {
+	data, err := readObject(store, exportTmplName)
+	if err == rados.RadosErrorNotFound {
+		return loadExportSettings().template(), nil
+	}
+	return string(data), err
 }
 
-func removeExportPathToList(ioctx *rados.IOContext, exportName string, poolName string, exportObjName string) {
-	lock := "export_remove_lock"
+func removeExportPathToList(store exportStore, nfsConfig nfsExportConfig, exportObjName string) error {
+	exportName, lock := nfsConfig.ExportList, nfsConfig.Lock
 	cookie := "export_remove_cookie"
 
-	targetExport := makeExport(poolName, exportObjName)
-	ioctx.LockExclusive(exportName, lock, cookie, "export_append", 0, nil)
+	targetExport := makeExport(nfsConfig.Pool, exportObjName)
+	ret, err := store.LockExclusive(exportName, lock, cookie, "remove export", 0, nil)
+	if err != nil {
+		return err
+	}
+	if ret != 0 {
+		return fmt.Errorf("export list %s is locked", exportName)
+	}
+	defer store.Unlock(exportName, lock, cookie)
+
 	// read all export list
-	stat, _ := ioctx.Stat(exportName)
-	size := stat.Size
-	data := make([]byte, size)
-	ioctx.Read(exportName, data, 0)
+	exports, err := readObject(store, exportName)
+	if err == rados.RadosErrorNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(string(exports), targetExport) {
+		return nil
+	}
 	// remove target export and write back
-	s := strings.Replace(string(data), targetExport, "", 1)
+	s := strings.Replace(string(exports), targetExport, "", -1)
 	if len(s) == 0 {
 		s = "\n"
 	}
-	ioctx.WriteFull(exportName, []byte(s))
-	ioctx.Unlock(exportName, lock, cookie)
+	return store.WriteFull(exportName, []byte(s))
 }
 
-func generateExportId(ioctx *rados.IOContext, prefix string) int {
+func generateExportId(ioctx exportStore, prefix string) int {
 	availExportIds := make(map[string]bool)
 	for i := 1; i <= 65535; i++ {
 		exportId := fmt.Sprint(i)
@@ -198,7 +493,7 @@ func generateExportId(ioctx *rados.IOContext, prefix string) int {
 	return -1
 }
 
-func loadExportId(ioctx *rados.IOContext, exportObjName string) int {
+func loadExportId(ioctx exportStore, exportObjName string) int {
 	data := make([]byte, 10)
 	size, err := ioctx.GetXattr(exportObjName, "export_id", data)
 	i, err := strconv.Atoi(string(data[:size]))
@@ -208,52 +503,100 @@ func loadExportId(ioctx *rados.IOContext, exportObjName string) int {
 	return i
 }
 
-func createNfsExportObj(ioctx *rados.IOContext, data *RgwUser) string {
+func createNfsExportObj(store exportStore, nfsConfig nfsExportConfig, data *RgwUser) (string, error) {
 	userId := data.UserId
-	accessKey := data.Keys[0].AccessKey
-	secretKey := data.Keys[0].SecretKey
-	displayName := data.DisplayName
+	key, _ := exportKey(data)
+	accessKey := key.AccessKey
+	secretKey := key.SecretKey
+	exportObjName := makeExportObjName(userId)
 
-	exportId := generateExportId(ioctx, "export_")
+	// the export obj is created already, the export_id xattr is set last so
+	// only a complete export obj is skipped
+	if _, err := store.Stat(exportObjName); err == nil && loadExportId(store, exportObjName) != -1 {
+		return exportObjName, nil
+	}
+	// the pseudo paths of the exports should be unique
+	pseudo, err := makeExportPseudo(loadExportSettings(), data)
+	if err != nil {
+		return "", err
+	}
+	if owner := findPseudoOwner(store, pseudo); owner != "" && owner != exportObjName {
+		return "", fmt.Errorf("pseudo path %s of %s is exported by %s", pseudo, exportObjName, owner)
+	}
+	exportId := generateExportId(store, "export_")
+	if exportId == -1 {
+		return "", fmt.Errorf("no export id is available for %s", exportObjName)
+	}
 
-	exportTmplName := utils.GetEnv("NFS_EXPORT_TMPL", "export.tmpl")
-	exportTmpl := loadExportTemplate(ioctx, exportTmplName)
-	exportObjName := makeExportObjName(userId)
-	export := fmt.Sprintf(exportTmpl, exportId, displayName, userId, accessKey, secretKey)
-	ioctx.WriteFull(exportObjName, []byte(export))
+	exportTmpl, err := loadExportTemplate(store, nfsConfig.Template)
+	if err != nil {
+		return "", err
+	}
+	exportTmpl, err = renderExportTemplate(exportTmpl, data)
+	if err != nil {
+		return "", err
+	}
+	pseudo = strings.TrimPrefix(pseudo, "/")
+	export := fmt.Sprintf(exportTmpl, exportId, pseudo, userId, accessKey, secretKey)
+	if err := store.WriteFull(exportObjName, []byte(export)); err != nil {
+		return "", err
+	}
 
 	// put pseudo (export path) and export_id to xattr
-	ioctx.SetXattr(exportObjName, "pseudo", []byte(displayName))
-	ioctx.SetXattr(exportObjName, "export_id", []byte(fmt.Sprint(exportId)))
-	return exportObjName
+	if err := store.SetXattr(exportObjName, "pseudo", []byte(pseudo)); err != nil {
+		return "", err
+	}
+	if err := store.SetXattr(exportObjName, "export_id", []byte(fmt.Sprint(exportId))); err != nil {
+		return "", err
+	}
+	return exportObjName, nil
 }
 
-func updateNfsExportObj(ioctx *rados.IOContext, data *RgwUser) {
+func updateNfsExportObj(ioctx exportStore, nfsConfig nfsExportConfig, data *RgwUser) {
 	uid := data.UserId
-	user := data.Keys[0].User
-	accessKey := data.Keys[0].AccessKey
-	secretKey := data.Keys[0].SecretKey
-	displayName := data.DisplayName
+	key, _ := exportKey(data)
+	user := key.User
+	accessKey := key.AccessKey
+	secretKey := key.SecretKey
 
 	// loading export obj template
-	exportTmplName := utils.GetEnv("NFS_EXPORT_TMPL", "export.tmpl")
-	exportTmpl := loadExportTemplate(ioctx, exportTmplName)
+	exportTmpl, _ := loadExportTemplate(ioctx, nfsConfig.Template)
 
 	// laoding export id
 	exportObjName := makeExportObjName(uid)
 	exportId := loadExportId(ioctx, exportObjName)
 
+	// the export is not updated when its new pseudo path is taken by another one
+	pseudo, err := makeExportPseudo(loadExportSettings(), data)
+	if err != nil {
+		utils.Error("Can not update nfs export", utils.Fields{"uid": uid, "error": err})
+		return
+	}
+	if owner := findPseudoOwner(ioctx, pseudo); owner != "" && owner != exportObjName {
+		utils.Error("Can not update nfs export", utils.Fields{"uid": uid, "pseudo": pseudo, "owner": owner})
+		return
+	}
+	exportTmpl, err = renderExportTemplate(exportTmpl, data)
+	if err != nil {
+		utils.Error("Can not update nfs export", utils.Fields{"uid": uid, "error": err})
+		return
+	}
+	pseudo = strings.TrimPrefix(pseudo, "/")
+
 	// generate export obj content and write
-	content := fmt.Sprintf(exportTmpl, exportId, displayName, user, accessKey, secretKey)
+	content := fmt.Sprintf(exportTmpl, exportId, pseudo, user, accessKey, secretKey)
 	ioctx.WriteFull(exportObjName, []byte(content))
 
 	// put pseudo (export path) and export to xattr
-	ioctx.SetXattr(exportObjName, "pseudo", []byte(displayName))
+	ioctx.SetXattr(exportObjName, "pseudo", []byte(pseudo))
 	ioctx.SetXattr(exportObjName, "export_id", []byte(fmt.Sprint(exportId)))
 }
 
-func removeNfsExportObj(ioctx *rados.IOContext, exportObjName string) {
-	ioctx.Delete(exportObjName)
+func removeNfsExportObj(store exportStore, exportObjName string) error {
+	if err := store.Delete(exportObjName); err != nil && err != rados.RadosErrorNotFound {
+		return err
+	}
+	return nil
 }
 
 func HandleNfsExport(req *http.Request, body []byte, statusCode int) {
@@ -273,8 +616,9 @@ func HandleNfsExport(req *http.Request, body []byte, statusCode int) {
 	}
 	// handle delete user even if user is not exists
 	if req.Method == "DELETE" && (statusCode == 200 || statusCode == 404) {
-		uid, _ := req.URL.Query()["uid"]
-		removeNfsExport(uid[0])
+		if uid := req.URL.Query().Get("uid"); uid != "" {
+			removeNfsExport(uid)
+		}
 		return
 	}
 }
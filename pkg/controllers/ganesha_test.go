@@ -0,0 +1,381 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ceph/go-ceph/rados"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeExportStore keeps the objects in memory, failures makes the named
+// method fail as many times as given before it succeeds.
+type fakeExportStore struct {
+	objects  map[string][]byte
+	xattrs   map[string]map[string][]byte
+	failures map[string]int
+	locks    []string
+}
+
+// testNfsConfig is the default nfs export config.
+var testNfsConfig = nfsExportConfig{Pool: "nfs-ganesha", ExportList: "export", Lock: "export_add_lock", Template: "export.tmpl"}
+
+func newFakeExportStore() *fakeExportStore {
+	return &fakeExportStore{
+		objects: map[string][]byte{
+			"export.tmpl": []byte("EXPORT { Export_ID = %d; Pseudo = \"/%s\"; User_Id = \"%s\"; Access_Key_Id = \"%s\"; Secret_Access_Key = \"%s\"; }\n"),
+		},
+		xattrs:   map[string]map[string][]byte{},
+		failures: map[string]int{},
+	}
+}
+
+func (s *fakeExportStore) fail(method string) error {
+	if s.failures[method] > 0 {
+		s.failures[method]--
+		return errors.New(method + " failed")
+	}
+	return nil
+}
+
+func (s *fakeExportStore) Stat(object string) (rados.ObjectStat, error) {
+	data, ok := s.objects[object]
+	if !ok {
+		return rados.ObjectStat{}, rados.RadosErrorNotFound
+	}
+	return rados.ObjectStat{Size: uint64(len(data))}, nil
+}
+
+func (s *fakeExportStore) Read(oid string, data []byte, offset uint64) (int, error) {
+	return copy(data, s.objects[oid][offset:]), nil
+}
+
+func (s *fakeExportStore) WriteFull(oid string, data []byte) error {
+	if err := s.fail("WriteFull"); err != nil {
+		return err
+	}
+	s.objects[oid] = append([]byte{}, data...)
+	return nil
+}
+
+func (s *fakeExportStore) Append(oid string, data []byte) error {
+	if err := s.fail("Append"); err != nil {
+		return err
+	}
+	s.objects[oid] = append(s.objects[oid], data...)
+	return nil
+}
+
+func (s *fakeExportStore) Delete(oid string) error {
+	delete(s.objects, oid)
+	delete(s.xattrs, oid)
+	return nil
+}
+
+func (s *fakeExportStore) GetXattr(object string, name string, data []byte) (int, error) {
+	value, ok := s.xattrs[object][name]
+	if !ok {
+		return 0, rados.RadosErrorNotFound
+	}
+	return copy(data, value), nil
+}
+
+func (s *fakeExportStore) SetXattr(object string, name string, data []byte) error {
+	if s.xattrs[object] == nil {
+		s.xattrs[object] = map[string][]byte{}
+	}
+	s.xattrs[object][name] = append([]byte{}, data...)
+	return nil
+}
+
+func (s *fakeExportStore) LockExclusive(oid, name, cookie, desc string, duration time.Duration, flags *byte) (int, error) {
+	s.locks = append(s.locks, oid+"/"+name)
+	return 0, nil
+}
+
+func (s *fakeExportStore) Unlock(oid, name, cookie string) (int, error) {
+	return 0, nil
+}
+
+func (s *fakeExportStore) ListObjects(listFn rados.ObjectListFunc) error {
+	for oid := range s.objects {
+		listFn(oid)
+	}
+	return nil
+}
+
+func TestExportNfsUser(t *testing.T) {
+	Convey("Given a new rgw user", t, func() {
+		store := newFakeExportStore()
+		user := RgwUser{
+			UserId:      "tester",
+			DisplayName: "tester",
+			Keys:        []RgwKey{{User: "tester", AccessKey: "access", SecretKey: "secret"}},
+		}
+		export := makeExport("nfs-ganesha", "export_tester")
+
+		Convey("When adding it to the export list fails once", func() {
+			store.failures["Append"] = 1
+			err := retry(3, time.Millisecond, func() error {
+				return exportNfsUser(store, testNfsConfig, &user)
+			})
+
+			Convey("The export should be created and listed exactly once", func() {
+				So(err, ShouldBeNil)
+				So(string(store.objects["export_tester"]), ShouldContainSubstring, "User_Id = \"tester\"")
+				So(strings.Count(string(store.objects["export"]), export), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When the export obj is half-written", func() {
+			store.objects["export_tester"] = []byte("partial")
+			So(exportNfsUser(store, testNfsConfig, &user), ShouldBeNil)
+
+			Convey("The export obj should be written again", func() {
+				So(string(store.objects["export_tester"]), ShouldContainSubstring, "User_Id = \"tester\"")
+				So(loadExportId(store, "export_tester"), ShouldNotEqual, -1)
+			})
+		})
+
+		Convey("When the export is created twice", func() {
+			So(exportNfsUser(store, testNfsConfig, &user), ShouldBeNil)
+			exportId := loadExportId(store, "export_tester")
+			So(exportNfsUser(store, testNfsConfig, &user), ShouldBeNil)
+
+			Convey("The export id and the export list should be kept", func() {
+				So(loadExportId(store, "export_tester"), ShouldEqual, exportId)
+				So(strings.Count(string(store.objects["export"]), export), ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+func TestNfsExportConfig(t *testing.T) {
+	Convey("Given the default nfs export config", t, func() {
+		So(loadNfsExportConfig(), ShouldResemble, nfsExportConfig{
+			User:       "admin",
+			Pool:       "nfs-ganesha",
+			ExportList: "export",
+			Lock:       "export_add_lock",
+			Template:   "export.tmpl",
+		})
+	})
+
+	Convey("Given a cluster with other nfs object names", t, func() {
+		store := newFakeExportStore()
+		nfsConfig := nfsExportConfig{Pool: "ganesha", ExportList: "exports", Lock: "exports_lock", Template: "export.tmpl"}
+		user := RgwUser{
+			UserId:      "tester",
+			DisplayName: "tester",
+			Keys:        []RgwKey{{User: "tester", AccessKey: "access", SecretKey: "secret"}},
+		}
+
+		Convey("The export should be listed in the configured list under its lock", func() {
+			So(exportNfsUser(store, nfsConfig, &user), ShouldBeNil)
+			So(string(store.objects["exports"]), ShouldEqual, makeExport("ganesha", "export_tester"))
+			So(store.objects, ShouldNotContainKey, "export")
+			So(store.locks, ShouldResemble, []string{"exports/exports_lock"})
+
+			So(unexportNfsUser(store, nfsConfig, "tester"), ShouldBeNil)
+			So(string(store.objects["exports"]), ShouldEqual, "\n")
+			So(store.locks, ShouldResemble, []string{"exports/exports_lock", "exports/exports_lock"})
+		})
+	})
+}
+
+func TestUnexportNfsUser(t *testing.T) {
+	Convey("Given an exported rgw user", t, func() {
+		store := newFakeExportStore()
+		user := RgwUser{
+			UserId:      "tester",
+			DisplayName: "tester",
+			Keys:        []RgwKey{{User: "tester", AccessKey: "access", SecretKey: "secret"}},
+		}
+		So(exportNfsUser(store, testNfsConfig, &user), ShouldBeNil)
+		export := makeExport("nfs-ganesha", "export_tester")
+
+		Convey("When the user is removed", func() {
+			err := unexportNfsUser(store, testNfsConfig, "tester")
+
+			Convey("The export object and its list entry should be removed", func() {
+				So(err, ShouldBeNil)
+				_, ok := store.objects["export_tester"]
+				So(ok, ShouldBeFalse)
+				So(string(store.objects["export"]), ShouldNotContainSubstring, export)
+			})
+
+			Convey("Removing it again should succeed", func() {
+				So(unexportNfsUser(store, testNfsConfig, "tester"), ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestExportTemplate(t *testing.T) {
+	Convey("Given a pool without an export template", t, func() {
+		store := newFakeExportStore()
+		delete(store.objects, "export.tmpl")
+
+		Convey("The built-in template should keep the default options", func() {
+			tmpl, err := loadExportTemplate(store, "export.tmpl")
+			So(err, ShouldBeNil)
+			So(tmpl, ShouldContainSubstring, "Access_Type = RW;")
+			So(tmpl, ShouldContainSubstring, "Protocols = 4;")
+			So(tmpl, ShouldContainSubstring, "Path = \"/\";")
+		})
+
+		Convey("The export options should be rendered per user", func() {
+			settings := exportSettings{AccessType: "RO", Protocols: "3, 4", Transports: "UDP, TCP", Path: "/100%"}
+			export := fmt.Sprintf(settings.template(), 7, "tester", "tester", "access", "secret")
+			So(export, ShouldContainSubstring, "Export_ID = 7;")
+			So(export, ShouldContainSubstring, "Access_Type = RO;")
+			So(export, ShouldContainSubstring, "Protocols = 3, 4;")
+			So(export, ShouldContainSubstring, "Path = \"/100%\";")
+			So(export, ShouldContainSubstring, "Secret_Access_Key = \"secret\";")
+		})
+	})
+}
+
+func TestExportPseudo(t *testing.T) {
+	Convey("Given the templated export paths", t, func() {
+		store := newFakeExportStore()
+		delete(store.objects, "export.tmpl")
+		os.Setenv("NFS_EXPORT_PSEUDO", "/tenants/{tenant}/{userId}")
+		os.Setenv("NFS_EXPORT_PATH", "/{userId}")
+		defer os.Unsetenv("NFS_EXPORT_PSEUDO")
+		defer os.Unsetenv("NFS_EXPORT_PATH")
+		user := RgwUser{
+			UserId:      "acme$alice",
+			DisplayName: "Alice",
+			Keys:        []RgwKey{{User: "acme$alice", AccessKey: "access", SecretKey: "secret"}},
+		}
+
+		Convey("The variables should be resolved from the user info", func() {
+			_, err := createNfsExportObj(store, testNfsConfig, &user)
+			So(err, ShouldBeNil)
+			export := string(store.objects["export_acme$alice"])
+			So(export, ShouldContainSubstring, "Pseudo = \"/tenants/acme/alice\";")
+			So(export, ShouldContainSubstring, "Path = \"/alice\";")
+			So(string(store.xattrs["export_acme$alice"]["pseudo"]), ShouldEqual, "tenants/acme/alice")
+		})
+
+		Convey("The tenant field should be used when the user id has no tenant", func() {
+			pseudo, err := makeExportPseudo(loadExportSettings(), &RgwUser{UserId: "bob", Tenant: "acme"})
+			So(err, ShouldBeNil)
+			So(pseudo, ShouldEqual, "/tenants/acme/bob")
+		})
+
+		Convey("A pseudo path exported by another user should be rejected", func() {
+			_, err := createNfsExportObj(store, testNfsConfig, &user)
+			So(err, ShouldBeNil)
+			other := RgwUser{UserId: "alice", Tenant: "acme", Keys: user.Keys}
+			_, err = createNfsExportObj(store, testNfsConfig, &other)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "is exported by export_acme$alice")
+			So(store.objects, ShouldNotContainKey, "export_alice")
+		})
+
+		Convey("A path of an unknown variable should be rejected", func() {
+			os.Setenv("NFS_EXPORT_PATH", "/{bucket}")
+			_, err := createNfsExportObj(store, testNfsConfig, &user)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "{bucket}")
+			So(store.objects, ShouldNotContainKey, "export_acme$alice")
+		})
+
+		Convey("An invalid pseudo path should be rejected", func() {
+			for _, pseudo := range []string{"tenants/{userId}", "/tenants/{tenant}/{userId}", "/{user}", "/{bucket}"} {
+				_, err := makeExportPseudo(exportSettings{Pseudo: pseudo}, &RgwUser{UserId: "bob"})
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
+
+func TestExportKey(t *testing.T) {
+	Convey("Given the keys of a user", t, func() {
+		Convey("The key of the user should be preferred over the subuser keys", func() {
+			key, ok := exportKey(&RgwUser{UserId: "tester", Keys: []RgwKey{
+				{User: "tester:nfs", AccessKey: "subuser"},
+				{User: "tester", AccessKey: "first"},
+				{User: "tester", AccessKey: "second"},
+			}})
+			So(ok, ShouldBeTrue)
+			So(key.AccessKey, ShouldEqual, "first")
+		})
+
+		Convey("The first key should be used without a key of the user", func() {
+			key, ok := exportKey(&RgwUser{UserId: "tester", Keys: []RgwKey{{User: "tester:nfs", AccessKey: "subuser"}}})
+			So(ok, ShouldBeTrue)
+			So(key.AccessKey, ShouldEqual, "subuser")
+		})
+
+		Convey("A user without keys should not be exported", func() {
+			_, ok := exportKey(&RgwUser{UserId: "tester"})
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func TestAddNfsExport(t *testing.T) {
+	Convey("Given an in-memory nfs config pool", t, func() {
+		store := newFakeExportStore()
+		closed := 0
+		defer func(open func(nfsExportConfig) (exportStore, func(), error)) { openExportStore = open }(openExportStore)
+		openExportStore = func(nfsExportConfig) (exportStore, func(), error) {
+			return store, func() { closed++ }, nil
+		}
+
+		Convey("When a user is created and removed", func() {
+			addNfsExport([]byte(`{"user_id":"tester","display_name":"tester","max_buckets":1000,"keys":[{"user":"tester","access_key":"access","secret_key":"secret"}]}`))
+			_, exported := store.objects["export_tester"]
+			removeNfsExport("tester")
+			_, removed := store.objects["export_tester"]
+
+			Convey("The export should be written then removed and the store closed", func() {
+				So(exported, ShouldBeTrue)
+				So(removed, ShouldBeFalse)
+				So(closed, ShouldEqual, 2)
+			})
+		})
+
+		Convey("When a user is created with several keys", func() {
+			body := []byte(`{"user_id":"tester","display_name":"tester","max_buckets":1000,"keys":[` +
+				`{"user":"tester:nfs","access_key":"subuser","secret_key":"subuser"},` +
+				`{"user":"tester","access_key":"access","secret_key":"secret"}]}`)
+			req := httptest.NewRequest("PUT", "/admin/user?uid=tester", nil)
+			HandleNfsExport(req, body, 200)
+
+			Convey("The export should use the key of the user", func() {
+				So(string(store.objects["export_tester"]), ShouldContainSubstring, "Access_Key_Id = \"access\"")
+			})
+		})
+
+		Convey("When a key is added to a user", func() {
+			body := []byte(`{"user_id":"tester","max_buckets":1000,"keys":[{"user":"tester","access_key":"access","secret_key":"secret"}]}`)
+			req := httptest.NewRequest("PUT", "/admin/user?key&uid=tester", nil)
+			HandleNfsExport(req, body, 200)
+
+			Convey("The user should not be exported", func() {
+				So(store.objects, ShouldNotContainKey, "export_tester")
+			})
+		})
+
+		Convey("When the pool can not be opened", func() {
+			openExportStore = func(nfsExportConfig) (exportStore, func(), error) {
+				return nil, nil, errors.New("connection refused")
+			}
+
+			Convey("The user should not be exported", func() {
+				addNfsExport([]byte(`{"user_id":"tester","max_buckets":1000,"keys":[{"user":"tester","access_key":"access","secret_key":"secret"}]}`))
+				_, ok := store.objects["export_tester"]
+				So(ok, ShouldBeFalse)
+			})
+		})
+	})
+}
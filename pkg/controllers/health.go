@@ -0,0 +1,96 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis"
+
+	"github.com/inwinstack/kaoliang/pkg/caches"
+	"github.com/inwinstack/kaoliang/pkg/models"
+	"github.com/inwinstack/kaoliang/pkg/utils"
+)
+
+// HealthResponse is the body of the probes, Failed names the dependencies
+// which can not be reached.
+type HealthResponse struct {
+	Status string   `json:"status"`
+	Failed []string `json:"failed,omitempty"`
+}
+
+// healthTimeout bounds each dependency check of the readiness probe.
+const healthTimeout = 2 * time.Second
+
+// Healthz is the liveness probe, it succeeds as long as the process serves.
+func Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, HealthResponse{Status: "ok"})
+}
+
+// Readyz is the readiness probe, it pings the Redis and Elasticsearch clients
+// set up by the service and fails with 503 naming the unreachable ones.
+func Readyz(c *gin.Context) {
+	failed := []string{}
+	clients := []redis.UniversalClient{}
+	if client := models.GetCache(); client != nil {
+		clients = append(clients, client)
+	}
+	if client := caches.GetRedis(); client != nil {
+		clients = append(clients, client)
+	}
+	for _, client := range clients {
+		if client.Ping().Err() != nil {
+			failed = append(failed, models.DependencyRedis)
+			break
+		}
+	}
+
+	if client := models.GetElasticsearch(); client != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+		defer cancel()
+		if _, err := client.ClusterHealth().Do(ctx); err != nil {
+			failed = append(failed, models.DependencyElasticsearch)
+		}
+	}
+
+	if len(failed) > 0 {
+		c.JSON(http.StatusServiceUnavailable, HealthResponse{Status: "unavailable", Failed: failed})
+		return
+	}
+
+	c.JSON(http.StatusOK, HealthResponse{Status: "ok"})
+}
+
+// ServeProbes serves /healthz and /readyz on PROBE_ADDR in the background,
+// apart from the S3 routes where they would be taken as bucket names. The
+// probes are not served when it is not set.
+func ServeProbes() {
+	addr := utils.GetEnv("PROBE_ADDR", "")
+	if addr == "" {
+		return
+	}
+
+	r := gin.New()
+	r.GET("/healthz", Healthz)
+	r.GET("/readyz", Readyz)
+	go func() {
+		if err := r.Run(addr); err != nil {
+			utils.Error("Can not serve probes", utils.Fields{"addr": addr, "error": err})
+		}
+	}()
+}
@@ -0,0 +1,31 @@
+package controllers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/inwinstack/kaoliang/pkg/controllers"
+)
+
+func TestProbes(t *testing.T) {
+	Convey("Given a service without dependencies set up", t, func() {
+		r := gin.New()
+		r.GET("/healthz", controllers.Healthz)
+		r.GET("/readyz", controllers.Readyz)
+
+		for _, path := range []string{"/healthz", "/readyz"} {
+			Convey("The probe "+path+" should succeed", func() {
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", path, nil)
+				r.ServeHTTP(w, req)
+
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(w.Body.String(), ShouldContainSubstring, `"status":"ok"`)
+			})
+		}
+	})
+}
@@ -0,0 +1,102 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/inwinstack/kaoliang/pkg/models"
+)
+
+// lruCache keeps up to size values by key, the least recently used one is
+// evicted when it is full. The entries expire after the TTL, and the lookups
+// are counted by result in requests.
+type lruCache struct {
+	lock     sync.Mutex
+	size     int
+	ttl      time.Duration
+	order    *list.List
+	entries  map[string]*list.Element
+	requests *prometheus.CounterVec
+}
+
+type lruCacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func newLRUCache(size int, ttl time.Duration, requests *prometheus.CounterVec) *lruCache {
+	return &lruCache{
+		size:     size,
+		ttl:      ttl,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+		requests: requests,
+	}
+}
+
+func (c *lruCache) get(key string) (value interface{}, found bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, found := c.entries[key]
+	if found && time.Now().After(element.Value.(*lruCacheEntry).expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		found = false
+	}
+	if !found {
+		c.requests.WithLabelValues(models.CacheMiss).Inc()
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	c.requests.WithLabelValues(models.CacheHit).Inc()
+
+	return element.Value.(*lruCacheEntry).value, true
+}
+
+func (c *lruCache) add(key string, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry := &lruCacheEntry{key: key, value: value, expires: time.Now().Add(c.ttl)}
+	if element, found := c.entries[key]; found {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruCacheEntry).key)
+	}
+}
+
+func (c *lruCache) remove(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, found := c.entries[key]; found {
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+}
@@ -1,20 +1,32 @@
 package controllers
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
+	sh "github.com/codeskyblue/go-sh"
 	"github.com/gin-gonic/gin"
 	"github.com/minio/minio/cmd"
 	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
 	uuid "github.com/satori/go.uuid"
 
+	"github.com/inwinstack/kaoliang/pkg/caches"
+	"github.com/inwinstack/kaoliang/pkg/config"
 	"github.com/inwinstack/kaoliang/pkg/models"
 	"github.com/inwinstack/kaoliang/pkg/utils"
 )
@@ -26,13 +38,16 @@ type Object struct {
 	VersionedEpoch int64     `json:"VersionedEpoch"`
 	LastModified   time.Time `json:"LastModified"`
 	Size           int64     `json:"Size"`
-	Etag           string    `json:"ETag"`
+	Etag           string    `json:"ETag" xml:"ETag"`
 	ContentType    string    `json:"ContentType"`
+	StorageClass   string    `json:"StorageClass"`
 	Owner          struct {
 		ID          string `json:"ID"`
 		DisplayName string `json:"DisplayName"`
 	} `json:"Owner"`
 	CustomMetadata []CustomMetadataEntry `json:"CustomMetadata"`
+	ACL            []GrantEntry          `json:"ACL,omitempty" xml:"ACL,omitempty"`
+	Tags           []TagEntry            `json:"Tags,omitempty" xml:"Tags,omitempty"`
 }
 
 type CustomMetadataEntry struct {
@@ -40,10 +55,81 @@ type CustomMetadataEntry struct {
 	Value string `json:"Value"`
 }
 
+// SearchResponse is a page of the matched objects. The pages are fetched by
+// the marker parameter: Marker is the marker of the next page and is empty on
+// the last one, PrevMarker is the marker of the previous page and is omitted
+// on the first one. A page exactly filled by the last results is the last
+// page. The cursor mode pages by NextCursor instead.
 type SearchResponse struct {
-	Marker      string
-	IsTruncated string
-	Objects     []Object
+	Marker         string
+	PrevMarker     string `json:",omitempty" xml:",omitempty"`
+	IsTruncated    string
+	EncodingType   string `json:",omitempty" xml:",omitempty"`
+	NextCursor     string `json:",omitempty" xml:",omitempty"`
+	TotalHits      int64
+	Objects        []Object
+	CommonPrefixes []string                `json:",omitempty" xml:",omitempty"`
+	Facets         map[string][]FacetEntry `json:",omitempty" xml:"-"`
+}
+
+// pageMarkers returns the markers of the pages around the page of size
+// starting at from, a marker is the offset of its page. The next marker is
+// empty when the page reaches total, the previous one on the first page.
+func pageMarkers(from int, size int, total int64) (next string, prev string) {
+	if size > 0 && int64(from+size) < total {
+		next = strconv.Itoa(from + size)
+	}
+	if from > 0 {
+		prevFrom := from - size
+		if prevFrom < 0 {
+			prevFrom = 0
+		}
+		prev = strconv.Itoa(prevFrom)
+	}
+
+	return next, prev
+}
+
+type FacetEntry struct {
+	Value string
+	Count int64
+}
+
+// facetFields maps the fields of the facets parameter to the indexed fields.
+var facetFields = map[string]string{
+	"contenttype":  "meta.content_type",
+	"storageclass": "meta.x-amz-storage-class",
+}
+
+// KeysResponse is a page of the keys of the matched objects, the markers are
+// the ones of SearchResponse.
+type KeysResponse struct {
+	Marker       string
+	PrevMarker   string `json:",omitempty" xml:",omitempty"`
+	IsTruncated  string
+	EncodingType string `json:",omitempty" xml:",omitempty"`
+	Keys         []string
+}
+
+type SizeSumResponse struct {
+	TotalBytes int64
+	Count      int64
+}
+
+// SearchDebugResponse explains how a search is run instead of running it,
+// Query is the Elasticsearch query sent to Indices and Clauses breaks the
+// query parameter down into the query of each clause.
+type SearchDebugResponse struct {
+	Indices  []string
+	Query    interface{}
+	Operator string         `json:",omitempty"`
+	Clauses  []SearchClause `json:",omitempty"`
+}
+
+type SearchClause struct {
+	Clause  string
+	Negated bool
+	Query   interface{}
 }
 
 type ObjectType struct {
@@ -55,18 +141,20 @@ type ObjectType struct {
 		ID          string `json:"id"`
 	} `json:"owner"`
 	Meta struct {
-		ContentType           string         `json:"content_type"`
-		Etag                  string         `json:"etag"`
-		Mtime                 time.Time      `json:"mtime"`
-		Size                  int64          `json:"size"`
-		TailTag               string         `json:"tail_tag"`
-		XAmzAcl               string         `json:"x-amz-acl"`
-		XAmzContentSha256     string         `json:"x-amz-content-sha256"`
-		XAmzCopySource        string         `json:"x-amz-copy-source"`
-		XAmzDate              string         `json:"x-amz-date"`
-		XAmzMetadataDirective string         `json:"x-amz-metadata-directive"`
-		XAmzStorageClass      string         `json:"x-amz-storage-class"`
-		CustomString          []CustomString `json:"custom-string"`
+		ContentType           string            `json:"content_type"`
+		Etag                  string            `json:"etag"`
+		Extension             string            `json:"extension"`
+		Mtime                 time.Time         `json:"mtime"`
+		Size                  int64             `json:"size"`
+		TailTag               string            `json:"tail_tag"`
+		XAmzAcl               string            `json:"x-amz-acl"`
+		XAmzContentSha256     string            `json:"x-amz-content-sha256"`
+		XAmzCopySource        string            `json:"x-amz-copy-source"`
+		XAmzDate              string            `json:"x-amz-date"`
+		XAmzMetadataDirective string            `json:"x-amz-metadata-directive"`
+		XAmzStorageClass      string            `json:"x-amz-storage-class"`
+		CustomString          []CustomString    `json:"custom-string"`
+		Tags                  map[string]string `json:"tags"`
 	} `json:"meta"`
 	Permissions    []string `json:"permissions"`
 	VersionedEpoch int64    `json:"versioned_epoch"`
@@ -77,6 +165,123 @@ type CustomString struct {
 	Value string `json:"value"`
 }
 
+// urlEncodeKey percent-encodes the object key like S3 does for
+// encoding-type=url, the "/" delimiters are kept.
+func urlEncodeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = strings.Replace(url.QueryEscape(segment), "+", "%20", -1)
+	}
+
+	return strings.Join(segments, "/")
+}
+
+func makeObject(d ObjectType) Object {
+	obj := Object{
+		Bucket:         d.Bucket,
+		Key:            d.Name,
+		Instance:       d.Instance,
+		VersionedEpoch: d.VersionedEpoch,
+		LastModified:   d.Meta.Mtime,
+		Size:           d.Meta.Size,
+		Etag:           fmt.Sprintf("\"%s\"", d.Meta.Etag),
+		ContentType:    d.Meta.ContentType,
+		StorageClass:   d.Meta.XAmzStorageClass,
+		Owner: struct {
+			ID          string `json:"ID"`
+			DisplayName string `json:"DisplayName"`
+		}{
+			d.Owner.ID,
+			d.Owner.DisplayName,
+		},
+		CustomMetadata: []CustomMetadataEntry{},
+	}
+	for _, cs := range d.Meta.CustomString {
+		cme := CustomMetadataEntry{Name: cs.Name, Value: cs.Value}
+		obj.CustomMetadata = append(obj.CustomMetadata, cme)
+	}
+
+	tagKeys := make([]string, 0, len(d.Meta.Tags))
+	for key := range d.Meta.Tags {
+		tagKeys = append(tagKeys, key)
+	}
+	sort.Strings(tagKeys)
+	for _, key := range tagKeys {
+		obj.Tags = append(obj.Tags, TagEntry{Key: key, Value: d.Meta.Tags[key]})
+	}
+
+	return obj
+}
+
+var searchFields = []string{"name", "ext", "lastmodified", "contenttype", "size", "etag", "sha256", "storageclass", "owner", "owner.display_name"}
+
+var extensionFormat = regexp.MustCompile("^[a-z0-9]{1,16}$")
+
+// objectExtension returns the normalized extension of the object name,
+// lowercased and without the dot, which is how meta.extension is
+// extracted at ingest. Names without an extension return "".
+func objectExtension(name string) string {
+	base := name[strings.LastIndex(name, "/")+1:]
+	dot := strings.LastIndex(base, ".")
+	if dot <= 0 {
+		return ""
+	}
+
+	return strings.ToLower(base[dot+1:])
+}
+
+// supportedSearchFields lists the fields of the query clauses, including the
+// tag and user metadata prefixes.
+func supportedSearchFields() string {
+	return strings.Join(append(searchFields, "tag.<key>", "x-amz-meta-<name>"), ", ")
+}
+
+// suggestSearchField returns the known search field closest to given field,
+// only fields within the edit distance of two are suggested.
+func suggestSearchField(field string) (string, bool) {
+	suggestion := ""
+	minDistance := 3
+	for _, known := range searchFields {
+		if d := editDistance(strings.ToLower(field), known); d < minDistance {
+			suggestion = known
+			minDistance = d
+		}
+	}
+
+	return suggestion, suggestion != ""
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, minInt(curr[j-1]+1, prev[j-1]+cost))
+		}
+		prev, curr = curr, prev
+	}
+
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
 func makeInvalidSyntaxResponse(requestID string) ErrorResponse {
 
 	return ErrorResponse{
@@ -84,130 +289,594 @@ func makeInvalidSyntaxResponse(requestID string) ErrorResponse {
 		Code: "InvalidSyntax",
 		Message: "Syntax should be one of following: name==(filename), contenttype==(type), " +
 			"lastmodified(< or <= or > or >=)(duration or YYYY-MM-DDThh:mm), " +
-			"size(<= or < or >= or >)(bytes), etag==(MD5 hash value)",
+			"size(<= or < or >= or >)(bytes), etag==(MD5 hash value), sha256==(SHA-256 hash value), storageclass==(class)",
 		RequestID: requestID,
 	}
 
 }
 
-func Search(c *gin.Context) {
-	userID, errCode := authenticate(c.Request)
-	if errCode != cmd.ErrNone {
-		writeErrorResponse(c, errCode)
-		return
+// makeConfigurationErrorResponse tells the operator the metadata index is
+// not set, searching an empty index would search every index.
+func makeConfigurationErrorResponse(requestID string) ErrorResponse {
+	return ErrorResponse{
+		Type:      "Receiver",
+		Code:      "ConfigurationError",
+		Message:   "The metadata index is not configured, METADATA_INDEX or METADATA_INDEX_PATTERN must be set",
+		RequestID: requestID,
 	}
+}
 
-	tokens := strings.Split(userID, ":")
-	if len(tokens) > 1 {
-		userID = tokens[0]
+// makeUnavailableErrorResponse tells the client the metadata search backend
+// can not be reached, it is answered with 504.
+func makeUnavailableErrorResponse(requestID string) ErrorResponse {
+	return ErrorResponse{
+		Type:      "Receiver",
+		Code:      "GatewayTimeout",
+		Message:   "The metadata search backend is not available. Please try again.",
+		RequestID: requestID,
 	}
+}
 
-	bucket := strings.TrimSpace(c.Param("bucket"))
-	users, ok := getBucketUsers(bucket)
-	if !ok {
-		writeErrorResponse(c, cmd.ErrNoSuchBucket)
-		return
+// makeSmartQuery wraps the query in a function_score query which decays the
+// relevance score by meta.mtime, so recently modified matches rank higher.
+func makeSmartQuery(query elastic.Query) elastic.Query {
+	decay, err := strconv.ParseFloat(utils.GetEnv("SEARCH_SMART_DECAY", "0.5"), 64)
+	if err != nil || decay <= 0 || decay >= 1 {
+		decay = 0.5
 	}
 
-	if !contains(users, userID) {
-		writeErrorResponse(c, cmd.ErrAccessDenied)
-		return
+	decayFunc := elastic.NewGaussDecayFunction().
+		FieldName("meta.mtime").
+		Origin("now").
+		Scale(utils.GetEnv("SEARCH_SMART_DECAY_SCALE", "7d")).
+		Offset(utils.GetEnv("SEARCH_SMART_DECAY_OFFSET", "1d")).
+		Decay(decay)
+
+	return elastic.NewFunctionScoreQuery().
+		Query(query).
+		AddScoreFunc(decayFunc).
+		BoostMode("multiply")
+}
+
+// makeTextQuery builds a free-text query of the terms over name,
+// meta.content_type and the values of the user metadata
+// (meta.custom-string.value), results are ordered by relevance. It assumes
+// these fields are analyzed by the standard analyzer, a field mapped as
+// keyword only matches when the terms equal the whole value.
+func makeTextQuery(text string) elastic.Query {
+	metadata := elastic.NewNestedQuery("meta.custom-string",
+		elastic.NewMatchQuery("meta.custom-string.value", text))
+
+	return elastic.NewBoolQuery().
+		Should(elastic.NewMultiMatchQuery(text, "name", "meta.content_type"), metadata).
+		MinimumNumberShouldMatch(1)
+}
+
+// makePermissionQuery matches the objects the user can read, the users with
+// the read permission of an object are indexed in its permissions.
+func makePermissionQuery(userID string) elastic.Query {
+	return elastic.NewTermsQuery("permissions", userID)
+}
+
+// makeDirMarkerQuery matches the zero-byte "folder/" objects some tools
+// create to emulate directories.
+func makeDirMarkerQuery() elastic.Query {
+	return elastic.NewBoolQuery().
+		Must(elastic.NewWildcardQuery("name", "*/")).
+		Must(elastic.NewTermQuery("meta.size", 0))
+}
+
+// sortFields maps the fields of the sort parameter to the indexed fields,
+// the name is indexed as keyword so it is sorted as is.
+var sortFields = map[string]string{
+	"size":         "meta.size",
+	"lastmodified": "meta.mtime",
+	"name":         "name",
+}
+
+// parseSort parses the sort parameter of (field):asc or (field):desc.
+func parseSort(value string) (elastic.Sorter, bool) {
+	tokens := strings.SplitN(value, ":", 2)
+	field, ok := sortFields[tokens[0]]
+	if !ok || len(tokens) != 2 {
+		return nil, false
 	}
 
-	requestID, _ := uuid.NewV4()
-	query := c.Query("query")
+	switch tokens[1] {
+	case "asc":
+		return elastic.NewFieldSort(field).Asc(), true
+	case "desc":
+		return elastic.NewFieldSort(field).Desc(), true
+	default:
+		return nil, false
+	}
+}
 
-	if query == "" {
-		body := makeInvalidSyntaxResponse(requestID.String())
-		c.JSON(http.StatusBadRequest, body)
-		return
+// versionSorters orders the versions of a key together, newest first. The
+// mtime breaks the ties of the unversioned objects with the epoch of zero.
+func versionSorters() []elastic.Sorter {
+	return []elastic.Sorter{
+		elastic.NewFieldSort("name").Asc(),
+		elastic.NewFieldSort("versioned_epoch").Desc(),
+		elastic.NewFieldSort("meta.mtime").Desc(),
 	}
+}
 
-	index := utils.GetEnv("METADATA_INDEX", "")
-	from, err := strconv.Atoi(c.Query("marker"))
+// encodeCursor encodes the sort values of the last hit as the cursor of the
+// next page.
+func encodeCursor(sortValues []interface{}) (string, error) {
+	data, err := json.Marshal(sortValues)
 	if err != nil {
-		from = 0
+		return "", err
 	}
-	size, err := strconv.Atoi(c.Query("max-keys"))
+
+	return base64.URLEncoding.EncodeToString(data), nil
+}
+
+// nextCursor returns the cursor of the page after the hits. In the cursor
+// mode a full page is reported as truncated with the cursor of its last hit,
+// the next page may turn out to be empty. A page of max-keys=0 has no hit to
+// continue from.
+func nextCursor(hits []*elastic.SearchHit, size int) (string, bool) {
+	if size <= 0 || len(hits) == 0 || len(hits) != size {
+		return "", false
+	}
+
+	cursor, err := encodeCursor(hits[len(hits)-1].Sort)
+	return cursor, err == nil
+}
+
+// decodeCursor decodes the sort values of a cursor, the numbers are kept as
+// json.Number so the long values are passed back to search_after exactly.
+func decodeCursor(cursor string) ([]interface{}, error) {
+	data, err := base64.URLEncoding.DecodeString(cursor)
 	if err != nil {
-		size = 100
+		return nil, err
 	}
 
-	ctx := context.Background()
-	client := models.GetElasticsearch()
-	if client == nil {
-		c.Status(http.StatusGatewayTimeout)
-		return
+	var sortValues []interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&sortValues); err != nil {
+		return nil, err
+	}
+	if len(sortValues) == 0 {
+		return nil, errors.New("empty cursor")
+	}
+
+	return sortValues, nil
+}
+
+var sizeUnits = map[string]int64{
+	"":   1,
+	"KB": 1 << 10,
+	"MB": 1 << 20,
+	"GB": 1 << 30,
+	"TB": 1 << 40,
+}
+
+var sizeFormat = regexp.MustCompile("^([0-9]+)([A-Za-z]*)$")
+
+// parseSize parses the bytes of a size clause, an optional unit of KB, MB,
+// GB or TB in any case multiplies it by the power of 1024.
+func parseSize(value string) (int64, bool) {
+	group := sizeFormat.FindStringSubmatch(value)
+	if len(group) != 3 {
+		return 0, false
+	}
+
+	unit, ok := sizeUnits[strings.ToUpper(group[2])]
+	if !ok {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(group[1], 10, 64)
+	if err != nil || size > math.MaxInt64/unit {
+		return 0, false
+	}
+
+	return size * unit, true
+}
+
+var logicalOperator = regexp.MustCompile("\\s+(AND|OR)\\s+")
+
+// escapeWildcard escapes the special characters of a wildcard pattern.
+func escapeWildcard(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "*", "\\*", "?", "\\?").Replace(value)
+}
+
+// makeCommonPrefixesAggregation buckets the keys under the prefix by the
+// key truncated after the first delimiter, which are the common prefixes of
+// S3 ListObjects.
+func makeCommonPrefixesAggregation(prefix, delimiter string, size int) elastic.Aggregation {
+	script := elastic.NewScript("def key = doc['name'].value; "+
+		"int index = key.indexOf(params.delimiter, params.prefix.length()); "+
+		"return index < 0 ? null : key.substring(0, index + params.delimiter.length());").
+		Lang("painless").
+		Param("prefix", prefix).
+		Param("delimiter", delimiter)
+
+	return elastic.NewTermsAggregation().
+		Script(script).
+		Size(size).
+		Order("_term", true)
+}
+
+// makeRollupQuery matches the keys under the prefix that contain the
+// delimiter, which are rolled up into the common prefixes like S3 does.
+func makeRollupQuery(prefix, delimiter string) elastic.Query {
+	return elastic.NewWildcardQuery("name",
+		escapeWildcard(prefix)+"*"+escapeWildcard(delimiter)+"*")
+}
+
+// withCommonPrefixes drops the rolled-up keys from the hits by a post
+// filter, the aggregation of the common prefixes still sees them.
+func withCommonPrefixes(searchService *elastic.SearchService, prefix, delimiter string, size int) *elastic.SearchService {
+	return searchService.
+		PostFilter(elastic.NewBoolQuery().MustNot(makeRollupQuery(prefix, delimiter))).
+		Aggregation("common_prefixes", makeCommonPrefixesAggregation(prefix, delimiter, size))
+}
+
+// commonPrefixes reads the common prefixes aggregated by withCommonPrefixes.
+func commonPrefixes(searchResult *elastic.SearchResult) []string {
+	var prefixes []string
+	if terms, found := searchResult.Aggregations.Terms("common_prefixes"); found {
+		for _, bucket := range terms.Buckets {
+			if commonPrefix, ok := bucket.Key.(string); ok {
+				prefixes = append(prefixes, commonPrefix)
+			}
+		}
+	}
+	return prefixes
+}
+
+// parseQuery parses the clauses of the search query joined by AND or OR, a
+// single clause is parsed as is. AND and OR can not be mixed since there are
+// no parentheses to express the precedence.
+func parseQuery(query string, requestID string, fuzziness string) (elastic.Query, *ErrorResponse) {
+	operators := logicalOperator.FindAllStringSubmatch(query, -1)
+	if len(operators) == 0 {
+		clauseQuery, negated, errResp := parseNegatableClause(query, requestID, fuzziness)
+		if errResp != nil || !negated {
+			return clauseQuery, errResp
+		}
+		return elastic.NewBoolQuery().MustNot(clauseQuery), nil
+	}
+
+	operator := operators[0][1]
+	for _, op := range operators[1:] {
+		if op[1] != operator {
+			body := ErrorResponse{
+				Type: "Sender",
+				Code: "InvalidSyntax",
+				Message: "AND and OR can not be mixed in one query since parentheses are not supported, " +
+					"join all clauses with AND (all must match) or with OR (any may match) e.g. size>1000 AND contenttype==*jpg",
+				RequestID: requestID,
+			}
+			return nil, &body
+		}
 	}
 
 	boolQuery := elastic.NewBoolQuery()
-	boolQuery = boolQuery.Filter(elastic.NewTermQuery("bucket", bucket))
+	for _, clause := range logicalOperator.Split(query, -1) {
+		clauseQuery, negated, errResp := parseNegatableClause(clause, requestID, fuzziness)
+		if errResp != nil {
+			return nil, errResp
+		}
+
+		switch {
+		case operator == "AND" && negated:
+			boolQuery = boolQuery.MustNot(clauseQuery)
+		case operator == "AND":
+			boolQuery = boolQuery.Must(clauseQuery)
+		case negated:
+			boolQuery = boolQuery.Should(elastic.NewBoolQuery().MustNot(clauseQuery))
+		default:
+			boolQuery = boolQuery.Should(clauseQuery)
+		}
+	}
+
+	if operator == "OR" {
+		boolQuery = boolQuery.MinimumNumberShouldMatch(1)
+	}
+
+	return boolQuery, nil
+}
+
+// explainQuery parses each clause of the search query alone, so the debug
+// mode shows what every clause is turned into.
+func explainQuery(query string, requestID string, fuzziness string) (operator string, clauses []SearchClause, errResp *ErrorResponse) {
+	if operators := logicalOperator.FindAllStringSubmatch(query, -1); len(operators) > 0 {
+		operator = operators[0][1]
+	}
+
+	for _, clause := range logicalOperator.Split(query, -1) {
+		clauseQuery, negated, errResp := parseNegatableClause(clause, requestID, fuzziness)
+		if errResp != nil {
+			return "", nil, errResp
+		}
+		source, err := clauseQuery.Source()
+		if err != nil {
+			return "", nil, &ErrorResponse{Type: "Sender", Code: "InvalidSyntax", Message: err.Error(), RequestID: requestID}
+		}
+		clauses = append(clauses, SearchClause{Clause: strings.TrimSpace(clause), Negated: negated, Query: source})
+	}
+
+	return operator, clauses, nil
+}
+
+// parseNegatableClause parses a clause which may be prefixed by NOT to
+// exclude the matched objects, negated tells whether it is.
+func parseNegatableClause(clause string, requestID string, fuzziness string) (query elastic.Query, negated bool, errResp *ErrorResponse) {
+	clause = strings.TrimSpace(clause)
+	if clause != "NOT" && !strings.HasPrefix(clause, "NOT ") {
+		query, errResp = parseFuzzyOrClause(clause, requestID, fuzziness)
+		return query, false, errResp
+	}
+
+	clause = strings.TrimSpace(strings.TrimPrefix(clause, "NOT"))
+	if clause == "" {
+		body := ErrorResponse{
+			Type:      "Sender",
+			Code:      "InvalidSyntax",
+			Message:   "Syntax should be NOT (clause), NOT should be followed by a clause e.g. NOT name==*tmp",
+			RequestID: requestID,
+		}
+		return nil, true, &body
+	}
+
+	query, errResp = parseFuzzyOrClause(clause, requestID, fuzziness)
+	return query, true, errResp
+}
+
+var fuzzyClause = regexp.MustCompile("^name\\s*~=\\s*(.+)$")
+
+var fuzzinessFormat = regexp.MustCompile("^(AUTO(:[0-9]+,[0-9]+)?|[0-2])$")
+
+// parseFuzzyOrClause parses name~=(term) into a fuzzy query of the given
+// fuzziness, AUTO by default, and the other clauses by parseClause. The fuzzy
+// query matches the analyzed tokens of the name rather than the whole
+// filename, e.g. reprot matches report.pdf only when name is tokenized.
+func parseFuzzyOrClause(clause string, requestID string, fuzziness string) (elastic.Query, *ErrorResponse) {
+	group := fuzzyClause.FindStringSubmatch(strings.TrimSpace(clause))
+	if len(group) != 2 {
+		return parseClause(clause, requestID)
+	}
+
+	if errResp := validateClause(clause, requestID); errResp != nil {
+		return nil, errResp
+	}
+
+	if fuzziness == "" {
+		fuzziness = "AUTO"
+	}
+
+	return elastic.NewFuzzyQuery("name", group[1]).Fuzziness(fuzziness), nil
+}
+
+// parseBetweenClause parses the time window of
+// lastmodified between (start),(end) into one range query.
+func parseBetweenClause(clause string, requestID string) (elastic.Query, *ErrorResponse) {
+	body := ErrorResponse{
+		Type: "Sender",
+		Code: "InvalidSyntax",
+		Message: "Syntax should be lastmodified between (YYYY-MM-DDThh:mm),(YYYY-MM-DDThh:mm) " +
+			"and the start should not be after the end e.g. lastmodified between 2018-05-01T00:00,2018-05-31T23:59",
+		RequestID: requestID,
+	}
+
+	re := regexp.MustCompile("^lastmodified\\s+between\\s+([^\\s,]+)\\s*,\\s*([^\\s,]+)$")
+	group := re.FindStringSubmatch(strings.TrimSpace(clause))
+	if len(group) != 3 {
+		return nil, &body
+	}
+
+	startTime, err := time.Parse("2006-01-02T15:04", group[1])
+	if err != nil {
+		return nil, &body
+	}
+	endTime, err := time.Parse("2006-01-02T15:04", group[2])
+	if err != nil || startTime.After(endTime) {
+		return nil, &body
+	}
+
+	return elastic.NewRangeQuery("meta.mtime").
+		Gte(startTime.Format("2006-01-02T15:04")).
+		Lte(endTime.Format("2006-01-02T15:04")), nil
+}
 
-	re := regexp.MustCompile("^(name|lastmodified|contenttype|size|etag|x-amz-meta-[^\\s]+)\\s*(<=|<|==|>=|>)\\s*(.+)$")
-	group := re.FindStringSubmatch(strings.TrimSpace(query))
+// parseNameRegexp parses the pattern of name=~(pattern) into a regexp
+// query. The patterns longer than SEARCH_REGEXP_MAX_LENGTH are rejected and
+// SEARCH_REGEXP_MAX_STATES bounds the automaton built by Elasticsearch, so a
+// catastrophic pattern can not exhaust the cluster.
+func parseNameRegexp(pattern string, requestID string) (elastic.Query, *ErrorResponse) {
+	body := ErrorResponse{
+		Type:      "Sender",
+		Code:      "InvalidSyntax",
+		RequestID: requestID,
+	}
+
+	maxLength := utils.GetEnvPositiveInt("SEARCH_REGEXP_MAX_LENGTH", 256)
+	if len(pattern) > maxLength {
+		body.Message = fmt.Sprintf("The pattern of name=~(pattern) should not be longer than %d characters", maxLength)
+		return nil, &body
+	}
+
+	if _, err := regexp.Compile(pattern); err != nil {
+		body.Message = fmt.Sprintf("Syntax should be name=~(pattern), the pattern is invalid: %s", err)
+		return nil, &body
+	}
+
+	maxStates := utils.GetEnvPositiveInt("SEARCH_REGEXP_MAX_STATES", 10000)
+
+	return elastic.NewRegexpQuery("name", pattern).MaxDeterminizedStates(maxStates), nil
+}
+
+// validateClause rejects the clauses longer than SEARCH_CLAUSE_MAX_LENGTH
+// and the ones with control characters, e.g. newlines or nulls, before their
+// values reach Elasticsearch.
+func validateClause(clause string, requestID string) *ErrorResponse {
+	body := ErrorResponse{
+		Type:      "Sender",
+		Code:      "InvalidSyntax",
+		RequestID: requestID,
+	}
+
+	maxLength := utils.GetEnvPositiveInt("SEARCH_CLAUSE_MAX_LENGTH", 1024)
+	if len(clause) > maxLength {
+		body.Message = fmt.Sprintf("The clause should not be longer than %d characters", maxLength)
+		return &body
+	}
+
+	for _, r := range clause {
+		if unicode.IsControl(r) {
+			body.Message = fmt.Sprintf("The clause should not contain control characters, found %q", r)
+			return &body
+		}
+	}
+
+	return nil
+}
+
+// hasWildcard tells whether the value is a wildcard pattern with a * or ?.
+func hasWildcard(value string) bool {
+	return strings.ContainsAny(value, "*?")
+}
+
+// validateWildcards limits the wildcard characters of a wildcard value to
+// SEARCH_WILDCARD_MAX_TOKENS, each of them widens the terms to be scanned.
+func validateWildcards(value string, requestID string) *ErrorResponse {
+	if !hasWildcard(value) {
+		return nil
+	}
+
+	maxTokens := utils.GetEnvPositiveInt("SEARCH_WILDCARD_MAX_TOKENS", 8)
+	if tokens := strings.Count(value, "*") + strings.Count(value, "?"); tokens > maxTokens {
+		body := ErrorResponse{
+			Type:      "Sender",
+			Code:      "InvalidSyntax",
+			Message:   fmt.Sprintf("The value should not contain more than %d wildcard characters, found %d", maxTokens, tokens),
+			RequestID: requestID,
+		}
+		return &body
+	}
+
+	return nil
+}
+
+// parseClause parses a `field op value` clause of the search query.
+func parseClause(clause string, requestID string) (elastic.Query, *ErrorResponse) {
+	var query elastic.Query
+
+	if errResp := validateClause(clause, requestID); errResp != nil {
+		return nil, errResp
+	}
+
+	if strings.HasPrefix(strings.TrimSpace(clause), "lastmodified between") {
+		return parseBetweenClause(clause, requestID)
+	}
+
+	re := regexp.MustCompile("^(name|ext|lastmodified|contenttype|size|etag|sha256|storageclass|owner\\.display_name|owner|tag\\.[^\\s<=>]+|x-amz-meta-[^\\s]+)\\s*(<=|<|==|=~|>=|>)\\s*(.+)$")
+	group := re.FindStringSubmatch(strings.TrimSpace(clause))
 	if len(group) != 4 {
-		body := makeInvalidSyntaxResponse(requestID.String())
-		c.JSON(http.StatusBadRequest, body)
-		return
+		body := makeInvalidSyntaxResponse(requestID)
+		shape := regexp.MustCompile("^([^\\s<=>]+)\\s*(<=|<|==|=~|>=|>)\\s*(.+)$")
+		if g := shape.FindStringSubmatch(strings.TrimSpace(clause)); len(g) == 4 {
+			// the clause is well formed, only the field is unknown
+			body.Message = fmt.Sprintf("Unknown field '%s'; supported: %s", g[1], supportedSearchFields())
+			if field, ok := suggestSearchField(g[1]); ok {
+				body.Message = fmt.Sprintf("Unknown field '%s', did you mean '%s'? Supported: %s", g[1], field, supportedSearchFields())
+			}
+		}
+		return nil, &body
+	}
+
+	if group[2] != "=~" {
+		if errResp := validateWildcards(group[3], requestID); errResp != nil {
+			return nil, errResp
+		}
 	}
 
 	switch {
+	case group[1] == "name" && group[2] == "=~":
+		return parseNameRegexp(group[3], requestID)
 	case group[1] == "name":
 		if group[2] != "==" {
 			body := ErrorResponse{
 				Type:      "Sender",
 				Code:      "InvalidSyntax",
-				Message:   "Syntax should be name==(filename), the filename is a string and support wildcard character e.g. user_*",
-				RequestID: requestID.String(),
+				Message:   "Syntax should be name==(filename), the filename is a string and support wildcard character e.g. user_*, add /i to ignore case e.g. *txt/i",
+				RequestID: requestID,
 			}
-			c.JSON(http.StatusBadRequest, body)
-			return
+			return nil, &body
+		}
+		// The /i flag matches the lowercased pattern against name.lower,
+		// which needs the index mapping to add the name.lower keyword
+		// subfield with a lowercase normalizer. A key really ending in /i
+		// can not be matched exactly then.
+		field, filename := "name", group[3]
+		if strings.HasSuffix(filename, "/i") {
+			field, filename = "name.lower", strings.ToLower(strings.TrimSuffix(filename, "/i"))
 		}
-		if strings.Contains(group[3], "*") {
-			boolQuery = boolQuery.Must(elastic.NewWildcardQuery("name", group[3]))
+		if hasWildcard(filename) {
+			query = elastic.NewWildcardQuery(field, filename)
 		} else {
-			boolQuery = boolQuery.Must(elastic.NewTermQuery("name", group[3]))
+			query = elastic.NewTermQuery(field, filename)
+		}
+	case group[1] == "ext":
+		ext := strings.ToLower(strings.TrimPrefix(group[3], "."))
+		if group[2] != "==" || !extensionFormat.MatchString(ext) {
+			body := ErrorResponse{
+				Type:      "Sender",
+				Code:      "InvalidSyntax",
+				Message:   "Syntax should be ext==(extension), the extension is up to 16 letters or digits without wildcard character e.g. pdf",
+				RequestID: requestID,
+			}
+			return nil, &body
 		}
+		query = elastic.NewTermQuery("meta.extension", ext)
 	case group[1] == "contenttype":
 		if group[2] != "==" {
 			body := ErrorResponse{
 				Type:      "Sender",
 				Code:      "InvalidSyntax",
-				Message:   "Syntax should be contenttype==(type), the type is a string and support wildcard character e.g. image/*",
-				RequestID: requestID.String(),
+				Message:   "Syntax should be contenttype==(type), the type is a string and support wildcard character e.g. image/*, a type without wildcard is matched exactly",
+				RequestID: requestID,
 			}
-			c.JSON(http.StatusBadRequest, body)
-			return
+			return nil, &body
 		}
-		if strings.Contains(group[3], "*") {
-			boolQuery = boolQuery.Must(elastic.NewWildcardQuery("meta.content_type", group[3]))
+		// a full type is a term lookup, only a pattern scans the types
+		if hasWildcard(group[3]) {
+			query = elastic.NewWildcardQuery("meta.content_type", group[3])
 		} else {
-			boolQuery = boolQuery.Must(elastic.NewTermQuery("meta.content_type", group[3]))
+			query = elastic.NewTermQuery("meta.content_type", group[3])
 		}
 	case group[1] == "lastmodified":
-		duration := regexp.MustCompile("^[1-9][0-9]*[s|m|h|d|w|M|y]$")
+		duration := regexp.MustCompile("^[1-9][0-9]*[smhdwMy]$")
 		matchedDuration := duration.MatchString(group[3])
 		if matchedDuration {
+			// a duration compares the age of the object, e.g. lastmodified>1d
+			// matches the objects modified more than a day ago and
+			// lastmodified<=1d the ones modified within the last day
 			switch group[2] {
 			case "<=":
-				boolQuery = boolQuery.Filter(elastic.NewRangeQuery("meta.mtime").Gte(fmt.Sprintf("now-%s", group[3])).Lte("now"))
+				query = elastic.NewRangeQuery("meta.mtime").Gte(fmt.Sprintf("now-%s", group[3]))
 			case "<":
-				boolQuery = boolQuery.Filter(elastic.NewRangeQuery("meta.mtime").Gt(fmt.Sprintf("now-%s", group[3])).Lt("now"))
+				query = elastic.NewRangeQuery("meta.mtime").Gt(fmt.Sprintf("now-%s", group[3]))
 			case ">=":
-				boolQuery = boolQuery.Filter(elastic.NewRangeQuery("meta.mtime").Lte(fmt.Sprintf("now-%s", group[3])))
+				query = elastic.NewRangeQuery("meta.mtime").Lte(fmt.Sprintf("now-%s", group[3]))
 			case ">":
-				boolQuery = boolQuery.Filter(elastic.NewRangeQuery("meta.mtime").Lt(fmt.Sprintf("now-%s", group[3])))
+				query = elastic.NewRangeQuery("meta.mtime").Lt(fmt.Sprintf("now-%s", group[3]))
 			default:
 				body := ErrorResponse{
 					Type: "Sender",
 					Code: "InvalidSyntax",
 					Message: "Syntax should be lastmodified<=(duration), lastmodified<(duration), " +
-						"lastmodified>=(duration) or lastmodified>(duration). " +
+						"lastmodified>=(duration) or lastmodified>(duration), the duration is the age of the object " +
+						"e.g. lastmodified>1d matches the objects modified more than a day ago. " +
 						"Duration can accept seconds, minutes, hours, days, weeks, months and years. e.g. 30s, 5m, 6h, 1d, 7w, 3M, 2y.",
-					RequestID: requestID.String(),
+					RequestID: requestID,
 				}
-				c.JSON(http.StatusBadRequest, body)
-				return
+				return nil, &body
 			}
 		}
 		startTime, err := time.Parse("2006-01-02T15:04", group[3])
@@ -215,23 +884,22 @@ func Search(c *gin.Context) {
 			startTimeISO := startTime.Format("2006-01-02T15:04")
 			switch group[2] {
 			case "<=":
-				boolQuery = boolQuery.Filter(elastic.NewRangeQuery("meta.mtime").Lte(fmt.Sprintf("%s", startTimeISO)))
+				query = elastic.NewRangeQuery("meta.mtime").Lte(fmt.Sprintf("%s", startTimeISO))
 			case "<":
-				boolQuery = boolQuery.Filter(elastic.NewRangeQuery("meta.mtime").Lt(fmt.Sprintf("%s", startTimeISO)))
+				query = elastic.NewRangeQuery("meta.mtime").Lt(fmt.Sprintf("%s", startTimeISO))
 			case ">=":
-				boolQuery = boolQuery.Filter(elastic.NewRangeQuery("meta.mtime").Gte(fmt.Sprintf("%s", startTimeISO)))
+				query = elastic.NewRangeQuery("meta.mtime").Gte(fmt.Sprintf("%s", startTimeISO))
 			case ">":
-				boolQuery = boolQuery.Filter(elastic.NewRangeQuery("meta.mtime").Gt(fmt.Sprintf("%s", startTimeISO)))
+				query = elastic.NewRangeQuery("meta.mtime").Gt(fmt.Sprintf("%s", startTimeISO))
 			default:
 				body := ErrorResponse{
 					Type: "Sender",
 					Code: "InvalidSyntax",
 					Message: "Syntax should be lastmodified<=(YYYY-MM-DDThh:mm), lastmodified<(YYYY-MM-DDThh:mm), " +
-						"lastmodified>=(YYYY-MM-DDThh:mm) or lastmodified<=(YYYY-MM-DDThh:mm) e.g. 2018-05-26T03:48",
-					RequestID: requestID.String(),
+						"lastmodified>=(YYYY-MM-DDThh:mm) or lastmodified>(YYYY-MM-DDThh:mm) e.g. 2018-05-26T03:48",
+					RequestID: requestID,
 				}
-				c.JSON(http.StatusBadRequest, body)
-				return
+				return nil, &body
 			}
 		}
 
@@ -239,63 +907,131 @@ func Search(c *gin.Context) {
 			body := ErrorResponse{
 				Type: "Sender",
 				Code: "InvalidSyntax",
-				Message: "Syntanx should be lastmodified<=(duration or YYYY-MM-DDThh:mm), lastmodified<=(duration or YYYY-MM-DDThh:mm), " +
-					"lastmodified<=(duration or YYYY-MM-DDThh:mm) or lastmodified<=(duration or YYYY-MM-DDThh:mm). " +
-					"Durations can accept seconds, minutes, hours, days, weeks, months and years. e.g. 30s, 5m, 6h, 1d, 7w, 3m, 2y.",
-				RequestID: requestID.String(),
+				Message: "Syntax should be lastmodified<=(duration or YYYY-MM-DDThh:mm), lastmodified<(duration or YYYY-MM-DDThh:mm), " +
+					"lastmodified>=(duration or YYYY-MM-DDThh:mm) or lastmodified>(duration or YYYY-MM-DDThh:mm). " +
+					"Durations can accept seconds, minutes, hours, days, weeks, months and years. e.g. 30s, 5m, 6h, 1d, 7w, 3M, 2y.",
+				RequestID: requestID,
 			}
-			c.JSON(http.StatusBadRequest, body)
-			return
+			return nil, &body
 		}
 	case group[1] == "size":
-		size, err := strconv.Atoi(group[3])
-		if err == nil && size >= 0 {
+		size, ok := parseSize(group[3])
+		if ok {
 			switch group[2] {
 			case "<=":
-				boolQuery = boolQuery.Filter(elastic.NewRangeQuery("meta.size").Lte(fmt.Sprintf("%d", size)))
+				query = elastic.NewRangeQuery("meta.size").Lte(fmt.Sprintf("%d", size))
 			case "<":
-				boolQuery = boolQuery.Filter(elastic.NewRangeQuery("meta.size").Lt(fmt.Sprintf("%d", size)))
+				query = elastic.NewRangeQuery("meta.size").Lt(fmt.Sprintf("%d", size))
 			case ">=":
-				boolQuery = boolQuery.Filter(elastic.NewRangeQuery("meta.size").Gte(fmt.Sprintf("%d", size)))
+				query = elastic.NewRangeQuery("meta.size").Gte(fmt.Sprintf("%d", size))
 			case ">":
-				boolQuery = boolQuery.Filter(elastic.NewRangeQuery("meta.size").Gt(fmt.Sprintf("%d", size)))
+				query = elastic.NewRangeQuery("meta.size").Gt(fmt.Sprintf("%d", size))
 			default:
 				body := ErrorResponse{
 					Type: "Sender",
 					Code: "InvalidSyntax",
 					Message: "Syntax should be size<=(bytes), size<(bytes), size>=(bytes) or size>(bytes) " +
-						"and the bytes must be integer and greater than or equal to 0.",
-					RequestID: requestID.String(),
+						"and the bytes must be integer and greater than or equal to 0, " +
+						"optionally followed by a unit of KB, MB, GB or TB e.g. size>1GB.",
+					RequestID: requestID,
 				}
-				c.JSON(http.StatusBadRequest, body)
-				return
+				return nil, &body
 			}
 		} else {
 			body := ErrorResponse{
 				Type: "Sender",
 				Code: "InvalidSyntax",
 				Message: "Syntax should be size<=(bytes), size<(bytes), size>=(bytes) or size>(bytes) " +
-					"and the bytes must be integer and greater than or equal to 0.",
-				RequestID: requestID.String(),
+					"and the bytes must be integer and greater than or equal to 0, " +
+					"optionally followed by a unit of KB, MB, GB or TB e.g. size>1GB.",
+				RequestID: requestID,
 			}
-			c.JSON(http.StatusBadRequest, body)
-			return
+			return nil, &body
 		}
 	case group[1] == "etag":
-		etag := regexp.MustCompile("^[a-f0-9]{32}$")
-		if group[2] == "==" && etag.MatchString(group[3]) {
-			boolQuery = boolQuery.Must(elastic.NewTermQuery("meta.etag", group[3]))
+		// the quoted and uppercase ETags copied from S3 responses are
+		// normalized, multipart ETags end with -(part count)
+		etag := regexp.MustCompile("^[a-f0-9]{32}(-[1-9][0-9]*)?$")
+		value := strings.ToLower(strings.Trim(group[3], "\""))
+		if group[2] == "==" && etag.MatchString(value) {
+			query = elastic.NewTermQuery("meta.etag", value)
 		} else {
 			body := ErrorResponse{
 				Type:      "Sender",
 				Code:      "InvalidSyntax",
-				Message:   "Syntax should be etag==(MD5 hash value)",
-				RequestID: requestID.String(),
+				Message:   "Syntax should be etag==(MD5 hash value) or etag==(MD5 hash value)-(part count)",
+				RequestID: requestID,
 			}
-			c.JSON(http.StatusBadRequest, body)
-			return
+			return nil, &body
 		}
-	case strings.Contains(group[1], "x-amz-meta-"):
+	case group[1] == "sha256":
+		// the x-amz-content-sha256 of the upload, the unsigned and the
+		// streaming payloads have no hash to match
+		sha256 := regexp.MustCompile("^[a-f0-9]{64}$")
+		value := strings.ToLower(group[3])
+		if group[2] == "==" && sha256.MatchString(value) {
+			query = elastic.NewTermQuery("meta.x-amz-content-sha256", value)
+		} else {
+			body := ErrorResponse{
+				Type:      "Sender",
+				Code:      "InvalidSyntax",
+				Message:   "Syntax should be sha256==(SHA-256 hash value), the value is 64 hex characters",
+				RequestID: requestID,
+			}
+			return nil, &body
+		}
+	case group[1] == "storageclass":
+		if group[2] != "==" {
+			body := makeInvalidSyntaxResponse(requestID)
+			return nil, &body
+		}
+		query = elastic.NewTermQuery("meta.x-amz-storage-class", strings.ToUpper(group[3]))
+	case group[1] == "owner":
+		if group[2] != "==" {
+			body := ErrorResponse{
+				Type:      "Sender",
+				Code:      "InvalidSyntax",
+				Message:   "Syntax should be owner==(user id) e.g. owner==tester",
+				RequestID: requestID,
+			}
+			return nil, &body
+		}
+		query = elastic.NewTermQuery("owner.id", group[3])
+	case group[1] == "owner.display_name":
+		if group[2] != "==" {
+			body := ErrorResponse{
+				Type: "Sender",
+				Code: "InvalidSyntax",
+				Message: "Syntax should be owner.display_name==(name), " +
+					"the name is a string and support wildcard character e.g. owner.display_name==dev*",
+				RequestID: requestID,
+			}
+			return nil, &body
+		}
+		if hasWildcard(group[3]) {
+			query = elastic.NewWildcardQuery("owner.display_name", group[3])
+		} else {
+			query = elastic.NewTermQuery("owner.display_name", group[3])
+		}
+	case strings.HasPrefix(group[1], "tag."):
+		if group[2] != "==" {
+			body := ErrorResponse{
+				Type: "Sender",
+				Code: "InvalidSyntax",
+				Message: "Syntax should be tag.(key)==(value), " +
+					"the value is a string which support wildcard character e.g. tag.project==alpha",
+				RequestID: requestID,
+			}
+			return nil, &body
+		}
+
+		field := "meta.tags." + strings.TrimPrefix(group[1], "tag.")
+		if hasWildcard(group[3]) {
+			query = elastic.NewWildcardQuery(field, group[3])
+		} else {
+			query = elastic.NewTermQuery(field, group[3])
+		}
+	case strings.Contains(group[1], "x-amz-meta-"):
 		if group[2] != "==" {
 			body := ErrorResponse{
 				Type: "Sender",
@@ -303,10 +1039,9 @@ func Search(c *gin.Context) {
 				Message: "Syntax should be x-amx-meta-(name)==(value), " +
 					"the name should be a string and the value is a string which support wildcard character " +
 					"e.g. x-amz-meta-serialnumber==a9507*",
-				RequestID: requestID.String(),
+				RequestID: requestID,
 			}
-			c.JSON(http.StatusBadRequest, body)
-			return
+			return nil, &body
 		}
 
 		// take custom metadata name from query parameter
@@ -315,29 +1050,767 @@ func Search(c *gin.Context) {
 		// add nested query for metadata
 		bq := elastic.NewBoolQuery()
 		bq = bq.Must(elastic.NewTermQuery("meta.custom-string.name", customMetaName))
-		if strings.Contains(group[3], "*") {
+		if hasWildcard(group[3]) {
 			bq = bq.Must(elastic.NewWildcardQuery("meta.custom-string.value", group[3]))
 		} else {
 			bq = bq.Must(elastic.NewTermQuery("meta.custom-string.value", group[3]))
 		}
-		q := elastic.NewNestedQuery("meta.custom-string", bq)
-		boolQuery = boolQuery.Must(q)
+		query = elastic.NewNestedQuery("meta.custom-string", bq)
 	default:
+		body := makeInvalidSyntaxResponse(requestID)
+		return nil, &body
+	}
+
+	return query, nil
+}
+
+func Search(c *gin.Context) {
+	userID, errCode := authenticate(c.Request)
+	if errCode != cmd.ErrNone {
+		writeErrorResponse(c, errCode)
+		return
+	}
+
+	tokens := strings.Split(userID, ":")
+	if len(tokens) > 1 {
+		userID = tokens[0]
+	}
+
+	bucket := strings.TrimSpace(c.Param("bucket"))
+	users, ok := getBucketUsers(bucket)
+	if !ok {
+		writeErrorResponse(c, cmd.ErrNoSuchBucket)
+		return
+	}
+
+	if !canSearchBucket(users, userID) {
+		writeErrorResponse(c, cmd.ErrAccessDenied)
+		return
+	}
+
+	search(c, userID, []string{bucket}, false)
+}
+
+// SearchStats counts the objects of the bucket matched by the search and sums
+// their size without fetching them, the query is the query of Search.
+func SearchStats(c *gin.Context) {
+	userID, errCode := authenticate(c.Request)
+	if errCode != cmd.ErrNone {
+		writeErrorResponse(c, errCode)
+		return
+	}
+
+	tokens := strings.Split(userID, ":")
+	if len(tokens) > 1 {
+		userID = tokens[0]
+	}
+
+	bucket := strings.TrimSpace(c.Param("bucket"))
+	users, ok := getBucketUsers(bucket)
+	if !ok {
+		writeErrorResponse(c, cmd.ErrNoSuchBucket)
+		return
+	}
+
+	if !canSearchBucket(users, userID) {
+		writeErrorResponse(c, cmd.ErrAccessDenied)
+		return
+	}
+
+	search(c, userID, []string{bucket}, true)
+}
+
+// SearchBatch runs a JSON array of search queries over the objects of the
+// bucket by one multi search, the responses are returned in the order of the
+// queries. Every query returns its first max-keys objects, for the other
+// options the queries should be searched one by one. The batch is bounded by
+// SEARCH_BATCH_MAX.
+func SearchBatch(c *gin.Context) {
+	userID, errCode := authenticate(c.Request)
+	if errCode != cmd.ErrNone {
+		writeErrorResponse(c, errCode)
+		return
+	}
+
+	tokens := strings.Split(userID, ":")
+	if len(tokens) > 1 {
+		userID = tokens[0]
+	}
+
+	bucket := strings.TrimSpace(c.Param("bucket"))
+	users, ok := getBucketUsers(bucket)
+	if !ok {
+		writeErrorResponse(c, cmd.ErrNoSuchBucket)
+		return
+	}
+
+	if !canSearchBucket(users, userID) {
+		writeErrorResponse(c, cmd.ErrAccessDenied)
+		return
+	}
+
+	requestID, _ := uuid.NewV4()
+	filterPermissions, errResp := filterSearchPermissions(c, isAdmin(userID), requestID.String())
+	if errResp != nil {
+		writeSearchResponse(c, http.StatusForbidden, errResp)
+		return
+	}
+	if isAdmin(userID) {
+		auditAdminSearch(c, userID, []string{bucket}, requestID.String())
+	}
+	maxQueries := utils.GetEnvPositiveInt("SEARCH_BATCH_MAX", 10)
+	var queries []string
+	if err := c.ShouldBindJSON(&queries); err != nil || len(queries) == 0 || len(queries) > maxQueries {
+		body := ErrorResponse{
+			Type:      "Sender",
+			Code:      "InvalidArgument",
+			Message:   fmt.Sprintf("The body should be a JSON array of 1 to %d search queries", maxQueries),
+			RequestID: requestID.String(),
+		}
+		writeSearchResponse(c, http.StatusBadRequest, body)
+		return
+	}
+
+	_, size, errResp := parsePaging("", c.Query("max-keys"), requestID.String())
+	if errResp != nil {
+		writeSearchResponse(c, http.StatusBadRequest, errResp)
+		return
+	}
+
+	index := indexForBucket(bucket)
+	if index == "" {
+		writeSearchResponse(c, http.StatusInternalServerError, makeConfigurationErrorResponse(requestID.String()))
+		return
+	}
+
+	client := models.GetElasticsearch()
+	if client == nil {
+		writeSearchResponse(c, http.StatusGatewayTimeout, makeUnavailableErrorResponse(requestID.String()))
+		return
+	}
+	multiSearch := client.MultiSearch()
+	for i, query := range queries {
+		boolQuery := elastic.NewBoolQuery().Filter(elastic.NewTermQuery("bucket", bucket))
+		if filterPermissions {
+			boolQuery = boolQuery.Filter(makePermissionQuery(userID))
+		}
+		var clauseQuery elastic.Query
+		var errResp *ErrorResponse
+		if strings.TrimSpace(query) == "" {
+			body := makeInvalidSyntaxResponse(requestID.String())
+			errResp = &body
+		} else {
+			clauseQuery, errResp = parseQuery(query, requestID.String(), "")
+		}
+		if errResp != nil {
+			errResp.Message = fmt.Sprintf("Query %d: %s", i+1, errResp.Message)
+			writeSearchResponse(c, http.StatusBadRequest, errResp)
+			return
+		}
+
+		multiSearch = multiSearch.Add(elastic.NewSearchRequest().
+			Index(index).
+			SearchSource(elastic.NewSearchSource().Query(boolQuery.Must(clauseQuery)).Size(size)))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), utils.GetEnvDuration("SEARCH_TIMEOUT", 5*time.Second))
+	defer cancel()
+	results, err := multiSearch.Do(ctx)
+	if err != nil {
+		writeSearchError(c, err, requestID.String())
+		return
+	}
+
+	responses := []SearchResponse{}
+	for _, result := range results.Responses {
+		if result.Error != nil {
+			writeSearchError(c, &elastic.Error{Status: http.StatusBadRequest, Details: result.Error}, requestID.String())
+			return
+		}
+		responses = append(responses, makeSearchResponse(result, size))
+	}
+
+	writeSearchResponse(c, http.StatusOK, responses)
+}
+
+// canSearchBucket tells whether the user can search the bucket granting the
+// users. The admin users of ADMIN_USERS search any bucket, e.g. for the
+// internal tooling, and their searches are logged by auditAdminSearch.
+func canSearchBucket(users []string, userID string) bool {
+	return contains(users, userID) || isAdmin(userID)
+}
+
+// filterSearchPermissions tells whether the objects are filtered by the read
+// permissions indexed per object, which is the case unless
+// SEARCH_PERMISSION_FILTER is off. The admins turn the filter off for their
+// search by permissions=all, the other users are denied it.
+func filterSearchPermissions(c *gin.Context, admin bool, requestID string) (bool, *ErrorResponse) {
+	filter := utils.GetEnvBool("SEARCH_PERMISSION_FILTER", true)
+	if c.Query("permissions") != "all" {
+		return filter, nil
+	}
+	if !admin {
+		return filter, &ErrorResponse{
+			Type:      "Sender",
+			Code:      "AccessDenied",
+			Message:   "Only the admin users can search with permissions=all",
+			RequestID: requestID,
+		}
+	}
+
+	return false, nil
+}
+
+// auditAdminSearch logs the search of an admin user, which bypasses the
+// bucket policies and with permissions=all the per-object permission filter.
+func auditAdminSearch(c *gin.Context, userID string, buckets []string, requestID string) {
+	utils.Info("Admin search", utils.Fields{
+		"user":       userID,
+		"buckets":    strings.Join(buckets, ","),
+		"query":      c.Request.URL.RawQuery,
+		"client":     clientIP(c.Request, config.GetServerConfig().TrustedProxies),
+		"request_id": requestID,
+	})
+}
+
+// parsePaging parses the marker and max-keys of the search, which default to
+// 0 and 100. The page size is clamped to SEARCH_MAX_KEYS.
+func parsePaging(marker string, maxKeys string, requestID string) (from int, size int, errResp *ErrorResponse) {
+	limit := utils.GetEnvPositiveInt("SEARCH_MAX_KEYS", 1000)
+	from, size = 0, 100
+	var err error
+	if marker != "" {
+		if from, err = strconv.Atoi(marker); err != nil || from < 0 {
+			body := ErrorResponse{
+				Type:      "Sender",
+				Code:      "InvalidSyntax",
+				Message:   "The marker should be a non-negative integer",
+				RequestID: requestID,
+			}
+			return 0, 0, &body
+		}
+	}
+	if maxKeys != "" {
+		if size, err = strconv.Atoi(maxKeys); err != nil || size < 0 {
+			body := ErrorResponse{
+				Type:      "Sender",
+				Code:      "InvalidSyntax",
+				Message:   fmt.Sprintf("The max-keys should be an integer from 0 to %d", limit),
+				RequestID: requestID,
+			}
+			return 0, 0, &body
+		}
+	}
+	if size > limit {
+		size = limit
+	}
+
+	return from, size, nil
+}
+
+// makeSearchResponse makes the response of the first page of the result.
+func makeSearchResponse(result *elastic.SearchResult, size int) SearchResponse {
+	searchResp := SearchResponse{
+		IsTruncated: "false",
+		TotalHits:   result.TotalHits(),
+		Objects:     []Object{},
+	}
+	for _, document := range result.Each(reflect.TypeOf(ObjectType{})) {
+		if d, ok := document.(ObjectType); ok {
+			searchResp.Objects = append(searchResp.Objects, makeObject(d))
+		}
+	}
+	searchResp.Marker, _ = pageMarkers(0, size, searchResp.TotalHits)
+	if searchResp.Marker != "" {
+		searchResp.IsTruncated = "true"
+	}
+
+	return searchResp
+}
+
+// makeKeysResponse makes the response of the page of size starting at from
+// of a keys-only result.
+func makeKeysResponse(result *elastic.SearchResult, from int, size int, encodingType string) KeysResponse {
+	keysResp := KeysResponse{
+		IsTruncated:  "false",
+		EncodingType: encodingType,
+		Keys:         []string{},
+	}
+	for _, hit := range result.Hits.Hits {
+		var d ObjectType
+		if err := json.Unmarshal(*hit.Source, &d); err != nil {
+			continue
+		}
+		if encodingType == "url" {
+			d.Name = urlEncodeKey(d.Name)
+		}
+		keysResp.Keys = append(keysResp.Keys, d.Name)
+	}
+	keysResp.Marker, keysResp.PrevMarker = pageMarkers(from, size, result.TotalHits())
+	if keysResp.Marker != "" {
+		keysResp.IsTruncated = "true"
+	}
+
+	return keysResp
+}
+
+// writeSearchResponse responds the body as XML when output=xml is given or
+// the client accepts application/xml, as JSON otherwise.
+func writeSearchResponse(c *gin.Context, code int, body interface{}) {
+	if c.Query("output") == "xml" || strings.Contains(c.GetHeader("Accept"), "application/xml") {
+		c.XML(code, body)
+		return
+	}
+
+	c.JSON(code, body)
+}
+
+// writeSearchError responds the failed Elasticsearch request. The query
+// errors are the fault of the request and answered by 400 with the reason of
+// Elasticsearch, the unreachable or timed out cluster by 504 and the others
+// by 500.
+func writeSearchError(c *gin.Context, err error, requestID string) {
+	utils.Error("Can not search metadata", utils.Fields{"request_id": requestID, "error": err})
+
+	body := ErrorResponse{
+		Type:      "Receiver",
+		Code:      "InternalError",
+		Message:   "We encountered an internal error. Please try again.",
+		RequestID: requestID,
+	}
+
+	if elsErr, ok := err.(*elastic.Error); ok && elsErr.Status == http.StatusBadRequest {
+		body.Type = "Sender"
+		body.Code = "InvalidQuery"
+		if details := elsErr.Details; details != nil {
+			body.Message = details.Reason
+			if len(details.RootCause) > 0 && details.RootCause[0].Reason != "" {
+				body.Message = details.RootCause[0].Reason
+			}
+		}
+		writeSearchResponse(c, http.StatusBadRequest, body)
+		return
+	}
+
+	models.DependencyErrors.WithLabelValues(models.DependencyElasticsearch).Inc()
+	if netErr, ok := errors.Cause(err).(net.Error); elastic.IsConnErr(err) || elastic.IsContextErr(errors.Cause(err)) ||
+		elastic.IsTimeout(err) || errors.Cause(err) == elastic.ErrRetry || (ok && netErr.Timeout()) {
+		writeSearchResponse(c, http.StatusGatewayTimeout, makeUnavailableErrorResponse(requestID))
+		return
+	}
+
+	writeSearchResponse(c, http.StatusInternalServerError, body)
+}
+
+// indexForBucket resolves the metadata index of the bucket, so the metadata
+// can be sharded per tenant. The index set in Redis by
+// metadata-index:(bucket) wins, then METADATA_INDEX_PATTERN whose {bucket}
+// and {tenant} are replaced by the bucket and the tenant of a tenant:bucket
+// name, and METADATA_INDEX is the fallback.
+func indexForBucket(bucket string) string {
+	if client := caches.GetRedis(); client != nil {
+		if index, err := client.Get("metadata-index:" + bucket).Result(); err == nil && index != "" {
+			return index
+		}
+	}
+
+	pattern := utils.GetEnv("METADATA_INDEX_PATTERN", "")
+	tenant := ""
+	if i := strings.Index(bucket, ":"); i != -1 {
+		tenant = bucket[:i]
+	}
+	if pattern == "" || (strings.Contains(pattern, "{tenant}") && tenant == "") {
+		return utils.GetEnv("METADATA_INDEX", "")
+	}
+
+	return strings.NewReplacer("{bucket}", bucket, "{tenant}", tenant).Replace(pattern)
+}
+
+// SearchAll searches the objects of every bucket the user can access by one
+// query, the bucket of every object is given in the response.
+func SearchAll(c *gin.Context) {
+	userID, errCode := authenticate(c.Request)
+	if errCode != cmd.ErrNone {
+		writeErrorResponse(c, errCode)
+		return
+	}
+
+	tokens := strings.Split(userID, ":")
+	if len(tokens) > 1 {
+		userID = tokens[0]
+	}
+
+	buckets, ok := getUserBuckets(userID)
+	if !ok {
+		writeErrorResponse(c, cmd.ErrInternalError)
+		return
+	}
+
+	search(c, userID, buckets, false)
+}
+
+// getUserBuckets returns the buckets whose policy grants the user, every
+// bucket for the admin users.
+func getUserBuckets(userID string) (buckets []string, ok bool) {
+	output, err := sh.Command("radosgw-admin", "bucket", "list").Output()
+	if err != nil {
+		return
+	}
+
+	var allBuckets []string
+	if err := json.Unmarshal(output, &allBuckets); err != nil {
+		return
+	}
+
+	if isAdmin(userID) {
+		return allBuckets, true
+	}
+
+	buckets = []string{}
+	for _, bucket := range allBuckets {
+		if users, ok := getBucketUsers(bucket); ok && contains(users, userID) {
+			buckets = append(buckets, bucket)
+		}
+	}
+
+	return buckets, true
+}
+
+// search runs the search query of the request over the objects of the
+// buckets, stats only counts and sums the size of the matched objects like
+// sum=size.
+func search(c *gin.Context, userID string, buckets []string, stats bool) {
+	defer func(start time.Time) {
+		models.SearchDuration.WithLabelValues(strconv.Itoa(c.Writer.Status())).Observe(time.Since(start).Seconds())
+	}(time.Now())
+
+	requestID, _ := uuid.NewV4()
+	query := c.Query("query")
+	text := c.Query("text")
+	prefix := c.Query("prefix")
+	delimiter := c.Query("delimiter")
+
+	if query == "" && text == "" && prefix == "" && delimiter == "" {
 		body := makeInvalidSyntaxResponse(requestID.String())
-		c.JSON(http.StatusBadRequest, body)
+		writeSearchResponse(c, http.StatusBadRequest, body)
 		return
 	}
 
-	searchResult, err := client.Search().
-		Index(index).
-		Query(boolQuery).
-		From(from).
-		Size(size).
-		Pretty(true).
-		Do(ctx)
+	encodingType := c.Query("encoding-type")
+	if encodingType != "" && encodingType != "url" {
+		body := ErrorResponse{
+			Type:      "Sender",
+			Code:      "InvalidArgument",
+			Message:   "Invalid Encoding Method specified in Request, only url is supported",
+			RequestID: requestID.String(),
+		}
+		writeSearchResponse(c, http.StatusBadRequest, body)
+		return
+	}
 
+	var sorter elastic.Sorter
+	if sortParam := c.Query("sort"); sortParam != "" && sortParam != "smart" {
+		var ok bool
+		if sorter, ok = parseSort(sortParam); !ok {
+			body := ErrorResponse{
+				Type: "Sender",
+				Code: "InvalidSyntax",
+				Message: "Syntax should be sort=(field):asc or sort=(field):desc, " +
+					"the field should be one of size, lastmodified and name, or sort=smart",
+				RequestID: requestID.String(),
+			}
+			writeSearchResponse(c, http.StatusBadRequest, body)
+			return
+		}
+	}
+
+	admin := isAdmin(userID)
+	filterPermissions, errResp := filterSearchPermissions(c, admin, requestID.String())
+	if errResp != nil {
+		writeSearchResponse(c, http.StatusForbidden, errResp)
+		return
+	}
+	if admin {
+		auditAdminSearch(c, userID, buckets, requestID.String())
+	}
+
+	// debug=true returns the generated query instead of the results, it
+	// reveals the permission filter so only the admins can use it
+	debug := c.Query("debug") == "true"
+	if debug && !admin {
+		body := ErrorResponse{
+			Type:      "Sender",
+			Code:      "AccessDenied",
+			Message:   "Only the admin users can search with debug=true",
+			RequestID: requestID.String(),
+		}
+		writeSearchResponse(c, http.StatusForbidden, body)
+		return
+	}
+
+	// includeVersions=true lists every version of the matched keys, so the
+	// versions are sorted by key and can not be collapsed by dedup
+	includeVersions := c.Query("includeVersions") == "true"
+	if includeVersions && (c.Query("sort") != "" || c.Query("dedup") != "") {
+		body := ErrorResponse{
+			Type:      "Sender",
+			Code:      "InvalidArgument",
+			Message:   "The includeVersions can not be combined with sort or dedup",
+			RequestID: requestID.String(),
+		}
+		writeSearchResponse(c, http.StatusBadRequest, body)
+		return
+	}
+
+	// cursor switches the paging from marker to search_after, an empty
+	// cursor starts from the first page
+	cursor, cursorMode := c.GetQuery("cursor")
+	var searchAfter []interface{}
+	if cursor != "" {
+		var err error
+		if searchAfter, err = decodeCursor(cursor); err != nil {
+			body := ErrorResponse{
+				Type:      "Sender",
+				Code:      "InvalidArgument",
+				Message:   "The cursor should be the NextCursor of the previous response",
+				RequestID: requestID.String(),
+			}
+			writeSearchResponse(c, http.StatusBadRequest, body)
+			return
+		}
+	}
+
+	var facets []string
+	if c.Query("facets") != "" {
+		for _, facet := range strings.Split(c.Query("facets"), ",") {
+			facet = strings.TrimSpace(facet)
+			if _, ok := facetFields[facet]; !ok {
+				body := ErrorResponse{
+					Type:      "Sender",
+					Code:      "InvalidArgument",
+					Message:   "Syntax should be facets=contenttype, facets=storageclass or facets=contenttype,storageclass",
+					RequestID: requestID.String(),
+				}
+				writeSearchResponse(c, http.StatusBadRequest, body)
+				return
+			}
+			facets = append(facets, facet)
+		}
+	}
+
+	fuzziness := c.Query("fuzziness")
+	if fuzziness != "" && !fuzzinessFormat.MatchString(fuzziness) {
+		body := ErrorResponse{
+			Type:      "Sender",
+			Code:      "InvalidArgument",
+			Message:   "The fuzziness should be 0, 1, 2, AUTO or AUTO:(low),(high)",
+			RequestID: requestID.String(),
+		}
+		writeSearchResponse(c, http.StatusBadRequest, body)
+		return
+	}
+
+	var enrich map[string]bool
+	if c.Query("enrich") != "" {
+		var ok bool
+		if enrich, ok = parseEnrich(c.Query("enrich")); !ok {
+			body := ErrorResponse{
+				Type:      "Sender",
+				Code:      "InvalidArgument",
+				Message:   "Syntax should be enrich=acl, enrich=tags or enrich=acl,tags",
+				RequestID: requestID.String(),
+			}
+			writeSearchResponse(c, http.StatusBadRequest, body)
+			return
+		}
+	}
+
+	indices := []string{}
+	for _, bucket := range buckets {
+		index := indexForBucket(bucket)
+		if index == "" {
+			writeSearchResponse(c, http.StatusInternalServerError, makeConfigurationErrorResponse(requestID.String()))
+			return
+		}
+		if !contains(indices, index) {
+			indices = append(indices, index)
+		}
+	}
+	from, size, errResp := parsePaging(c.Query("marker"), c.Query("max-keys"), requestID.String())
+	if errResp != nil {
+		writeSearchResponse(c, http.StatusBadRequest, errResp)
+		return
+	}
+
+	boolQuery := elastic.NewBoolQuery()
+	bucketValues := make([]interface{}, len(buckets))
+	for i, bucket := range buckets {
+		bucketValues[i] = bucket
+	}
+	boolQuery = boolQuery.Filter(elastic.NewTermsQuery("bucket", bucketValues...))
+	if filterPermissions {
+		boolQuery = boolQuery.Filter(makePermissionQuery(userID))
+	}
+
+	if query != "" {
+		clauseQuery, errResp := parseQuery(query, requestID.String(), fuzziness)
+		if errResp != nil {
+			writeSearchResponse(c, http.StatusBadRequest, errResp)
+			return
+		}
+		boolQuery = boolQuery.Must(clauseQuery)
+	}
+	if text != "" {
+		boolQuery = boolQuery.Must(makeTextQuery(text))
+	}
+	if c.Query("hide-dirs") == "true" {
+		boolQuery = boolQuery.MustNot(makeDirMarkerQuery())
+	}
+	if prefix != "" {
+		boolQuery = boolQuery.Filter(elastic.NewPrefixQuery("name", prefix))
+	}
+	// sum=size and dedup=instance only read the aggregations, so the
+	// rolled-up keys are excluded by the query there
+	sumMode := stats || c.Query("sum") == "size"
+	dedup := c.Query("dedup") == "instance"
+	if delimiter != "" && (sumMode || dedup) {
+		boolQuery = boolQuery.MustNot(makeRollupQuery(prefix, delimiter))
+	}
+
+	var searchQuery elastic.Query = boolQuery
+	if c.Query("sort") == "smart" {
+		searchQuery = makeSmartQuery(boolQuery)
+	}
+
+	if debug {
+		source, err := searchQuery.Source()
+		if err != nil {
+			writeSearchError(c, err, requestID.String())
+			return
+		}
+		debugResp := SearchDebugResponse{Indices: indices, Query: source}
+		if query != "" {
+			// the query is already parsed, so the clauses parse too
+			debugResp.Operator, debugResp.Clauses, _ = explainQuery(query, requestID.String(), fuzziness)
+		}
+		c.JSON(http.StatusOK, debugResp)
+		return
+	}
+
+	// a hung node fails the search with 504 instead of holding the worker
+	ctx, cancel := context.WithTimeout(context.Background(), utils.GetEnvDuration("SEARCH_TIMEOUT", 5*time.Second))
+	defer cancel()
+	client := models.GetElasticsearch()
+	if client == nil {
+		writeSearchResponse(c, http.StatusGatewayTimeout, makeUnavailableErrorResponse(requestID.String()))
+		return
+	}
+
+	searchService := client.Search().
+		Index(indices...).
+		Query(searchQuery).
+		Pretty(true)
+	if sorter != nil {
+		searchService = searchService.SortBy(sorter)
+	}
+	if includeVersions {
+		searchService = searchService.SortBy(versionSorters()...)
+	}
+
+	// sum=size reports the number and the total bytes of the matched
+	// objects by the aggregations of meta.size, no documents are fetched.
+	if sumMode {
+		searchResult, err := searchService.
+			Size(0).
+			Aggregation("total_bytes", elastic.NewSumAggregation().Field("meta.size")).
+			Aggregation("object_count", elastic.NewValueCountAggregation().Field("meta.size")).
+			Do(ctx)
+		if err != nil {
+			writeSearchError(c, err, requestID.String())
+			return
+		}
+
+		sumResp := SizeSumResponse{
+			Count: searchResult.TotalHits(),
+		}
+		if count, found := searchResult.Aggregations.ValueCount("object_count"); found && count.Value != nil {
+			sumResp.Count = int64(*count.Value)
+		}
+		if sum, found := searchResult.Aggregations.Sum("total_bytes"); found && sum.Value != nil {
+			sumResp.TotalBytes = int64(*sum.Value)
+		}
+
+		writeSearchResponse(c, http.StatusOK, sumResp)
+		return
+	}
+
+	// keys-only=true fetches only the name of the documents by source
+	// filtering and returns the flat list of keys.
+	if c.Query("keys-only") == "true" {
+		if delimiter != "" {
+			searchService = searchService.PostFilter(elastic.NewBoolQuery().
+				MustNot(makeRollupQuery(prefix, delimiter)))
+		}
+		searchResult, err := searchService.
+			From(from).
+			Size(size).
+			FetchSourceContext(elastic.NewFetchSourceContext(true).Include("name")).
+			Do(ctx)
+		if err != nil {
+			writeSearchError(c, err, requestID.String())
+			return
+		}
+
+		keysResp := makeKeysResponse(searchResult, from, size, encodingType)
+		writeSearchResponse(c, http.StatusOK, keysResp)
+		return
+	}
+
+	// Objects with the same key may be indexed once per instance. With
+	// dedup=instance the documents are bucketed by name with a terms
+	// aggregation and the top_hits sub-aggregation keeps the newest one of
+	// every key, so one representative object is returned per key.
+	if dedup {
+		latest := elastic.NewTopHitsAggregation().
+			Size(1).
+			Sort("meta.mtime", false).
+			Sort("versioned_epoch", false)
+		keys := elastic.NewTermsAggregation().
+			Field("name").
+			Size(from+size).
+			Order("_term", true).
+			SubAggregation("latest", latest)
+		searchService = searchService.Size(0).
+			Aggregation("keys", keys).
+			Aggregation("total_keys", elastic.NewCardinalityAggregation().Field("name"))
+	} else if cursorMode {
+		// search_after needs a total order, the uid breaks the ties
+		if sorter == nil && !includeVersions {
+			searchService = searchService.SortBy(elastic.NewScoreSort())
+		}
+		searchService = searchService.SortBy(elastic.NewFieldSort("_uid").Asc()).Size(size)
+		if searchAfter != nil {
+			searchService = searchService.SearchAfter(searchAfter...)
+		}
+	} else {
+		searchService = searchService.From(from).Size(size)
+	}
+	// facets count the matches by the top SEARCH_FACETS_SIZE values
+	if len(facets) > 0 {
+		facetsSize := utils.GetEnvPositiveInt("SEARCH_FACETS_SIZE", 10)
+		for _, facet := range facets {
+			searchService = searchService.Aggregation("facet_"+facet,
+				elastic.NewTermsAggregation().Field(facetFields[facet]).Size(facetsSize))
+		}
+	}
+	if delimiter != "" && !dedup {
+		searchService = withCommonPrefixes(searchService, prefix, delimiter, size)
+	}
+
+	searchResult, err := searchService.Do(ctx)
 	if err != nil {
-		panic(err)
+		writeSearchError(c, err, requestID.String())
+		return
 	}
 
 	searchResp := SearchResponse{
@@ -345,34 +1818,91 @@ func Search(c *gin.Context) {
 	}
 
 	var objs []Object
-	for _, document := range searchResult.Each(reflect.TypeOf(ObjectType{})) {
-		if d, ok := document.(ObjectType); ok {
-			obj := Object{
-				Bucket:         d.Bucket,
-				Key:            d.Name,
-				Instance:       d.Instance,
-				VersionedEpoch: d.VersionedEpoch,
-				LastModified:   d.Meta.Mtime,
-				Size:           d.Meta.Size,
-				Etag:           fmt.Sprintf("\\\"%s\"\\", d.Meta.Etag),
-				ContentType:    d.Meta.ContentType,
-				Owner: struct {
-					ID          string `json:"ID"`
-					DisplayName string `json:"DisplayName"`
-				}{
-					d.Owner.ID,
-					d.Owner.DisplayName,
-				},
-				CustomMetadata: []CustomMetadataEntry{},
+	if dedup {
+		// the number of keys is approximated by the cardinality aggregation
+		if totalKeys, found := searchResult.Aggregations.Cardinality("total_keys"); found && totalKeys.Value != nil {
+			searchResp.TotalHits = int64(*totalKeys.Value)
+		}
+		if keys, found := searchResult.Aggregations.Terms("keys"); found {
+			for i, bucket := range keys.Buckets {
+				if i < from {
+					continue
+				}
+				latest, found := bucket.TopHits("latest")
+				if !found || latest.Hits == nil || len(latest.Hits.Hits) == 0 {
+					continue
+				}
+				var d ObjectType
+				if err := json.Unmarshal(*latest.Hits.Hits[0].Source, &d); err != nil {
+					continue
+				}
+				objs = append(objs, makeObject(d))
+			}
+		}
+	} else {
+		searchResp.TotalHits = searchResult.TotalHits()
+		for _, document := range searchResult.Each(reflect.TypeOf(ObjectType{})) {
+			if d, ok := document.(ObjectType); ok {
+				objs = append(objs, makeObject(d))
+			}
+		}
+	}
+
+	for _, facet := range facets {
+		if searchResp.Facets == nil {
+			searchResp.Facets = make(map[string][]FacetEntry)
+		}
+		entries := []FacetEntry{}
+		if terms, found := searchResult.Aggregations.Terms("facet_" + facet); found {
+			for _, bucket := range terms.Buckets {
+				entries = append(entries, FacetEntry{Value: fmt.Sprint(bucket.Key), Count: bucket.DocCount})
 			}
-			for _, cs := range d.Meta.CustomString {
-				cme := CustomMetadataEntry{Name: cs.Name, Value: cs.Value}
-				obj.CustomMetadata = append(obj.CustomMetadata, cme)
+		}
+		searchResp.Facets[facet] = entries
+	}
+
+	searchResp.CommonPrefixes = commonPrefixes(searchResult)
+
+	if !cursorMode {
+		searchResp.Marker, searchResp.PrevMarker = pageMarkers(from, size, searchResp.TotalHits)
+		if searchResp.Marker != "" {
+			searchResp.IsTruncated = "true"
+		}
+	}
+
+	if cursorMode && !dedup {
+		if cursor, ok := nextCursor(searchResult.Hits.Hits, size); ok {
+			searchResp.IsTruncated = "true"
+			searchResp.NextCursor = cursor
+		}
+	}
+
+	// enrich joins the live values of RGW, it is bounded by
+	// SEARCH_ENRICH_MAX_KEYS since every object costs a request per field
+	if enrich != nil {
+		maxKeys := utils.GetEnvInt("SEARCH_ENRICH_MAX_KEYS", 100)
+		accessKey := ExtractAccessKey(c.Request)
+		_, creds, errCode := cmd.GetCredentials(accessKey)
+		if errCode == cmd.ErrNone {
+			page := objs
+			if len(page) > maxKeys {
+				page = page[:maxKeys]
 			}
-			objs = append(objs, obj)
+			enrichObjects(page, enrich, userID, creds.AccessKey, creds.SecretKey)
+		}
+	}
+
+	// keys are returned as is unless encoding-type=url is given
+	if encodingType == "url" {
+		searchResp.EncodingType = encodingType
+		for i := range objs {
+			objs[i].Key = urlEncodeKey(objs[i].Key)
+		}
+		for i := range searchResp.CommonPrefixes {
+			searchResp.CommonPrefixes[i] = urlEncodeKey(searchResp.CommonPrefixes[i])
 		}
 	}
 
 	searchResp.Objects = objs
-	c.JSON(http.StatusOK, searchResp)
+	writeSearchResponse(c, http.StatusOK, searchResp)
 }
@@ -0,0 +1,1014 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/olivere/elastic"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/inwinstack/kaoliang/pkg/config"
+)
+
+func TestURLEncodeKey(t *testing.T) {
+	Convey("Given keys with special characters", t, func() {
+		keys := map[string]string{
+			"report.pdf":        "report.pdf",
+			"dir/a b+c.txt":     "dir/a%20b%2Bc.txt",
+			"dir/sub/&=?#%.log": "dir/sub/%26%3D%3F%23%25.log",
+			"line\nbreak\x01":   "line%0Abreak%01",
+			"文件/名.jpg":          "%E6%96%87%E4%BB%B6/%E5%90%8D.jpg",
+		}
+
+		Convey("When encoding them for encoding-type=url", func() {
+			Convey("The keys should be percent-encoded and keep the delimiters", func() {
+				for key, encoded := range keys {
+					So(urlEncodeKey(key), ShouldEqual, encoded)
+				}
+			})
+		})
+	})
+}
+
+func TestObjectExtension(t *testing.T) {
+	Convey("Given object names", t, func() {
+		names := map[string]string{
+			"report.PDF":         "pdf",
+			"dir/archive.tar.gz": "gz",
+			"dir.d/README":       "",
+			".bashrc":            "",
+			"dir/":               "",
+		}
+
+		Convey("The extension should be lowercased and without the dot", func() {
+			for name, ext := range names {
+				So(objectExtension(name), ShouldEqual, ext)
+			}
+		})
+	})
+}
+
+func TestParseExtensionClause(t *testing.T) {
+	Convey("Given an ext clause", t, func() {
+		Convey("When the extension is valid", func() {
+			query, body := parseClause("ext==.PDF", "request")
+
+			Convey("A term query on meta.extension should be returned", func() {
+				So(body, ShouldBeNil)
+				source, _ := query.Source()
+				So(source, ShouldResemble, map[string]interface{}{
+					"term": map[string]interface{}{"meta.extension": "pdf"},
+				})
+			})
+		})
+
+		Convey("When the extension has a wildcard or a bad operator", func() {
+			for _, clause := range []string{"ext==*.pdf", "ext==tar.gz", "ext>pdf"} {
+				_, body := parseClause(clause, "request")
+				So(body, ShouldNotBeNil)
+				So(body.Code, ShouldEqual, "InvalidSyntax")
+			}
+		})
+	})
+}
+
+func TestMakeDirMarkerQuery(t *testing.T) {
+	Convey("Given a folder marker object photos/ of zero bytes", t, func() {
+		source, err := makeDirMarkerQuery().Source()
+		data, _ := json.Marshal(source)
+
+		Convey("The query should match keys ending in / with a size of 0", func() {
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual,
+				`{"bool":{"must":[{"wildcard":{"name":{"wildcard":"*/"}}},{"term":{"meta.size":0}}]}}`)
+		})
+	})
+}
+
+func TestParseQuery(t *testing.T) {
+	Convey("Given search queries", t, func() {
+		Convey("A single clause should be parsed as before", func() {
+			query, body := parseQuery("contenttype==image/png", "request", "")
+			So(body, ShouldBeNil)
+			data, _ := json.Marshal(mustSource(query))
+			So(string(data), ShouldEqual, `{"term":{"meta.content_type":"image/png"}}`)
+		})
+
+		Convey("A content type with a ? should be a wildcard", func() {
+			query, body := parseQuery("contenttype==image/?ng", "request", "")
+			So(body, ShouldBeNil)
+			data, _ := json.Marshal(mustSource(query))
+			So(string(data), ShouldEqual, `{"wildcard":{"meta.content_type":{"wildcard":"image/?ng"}}}`)
+		})
+
+		Convey("Clauses joined by AND should all be required", func() {
+			query, body := parseQuery("size>1000 AND contenttype==*jpg", "request", "")
+			So(body, ShouldBeNil)
+			data, _ := json.Marshal(mustSource(query))
+			So(string(data), ShouldEqual,
+				`{"bool":{"must":[{"range":{"meta.size":{"from":"1000","include_lower":false,"include_upper":true,"to":null}}},`+
+					`{"wildcard":{"meta.content_type":{"wildcard":"*jpg"}}}]}}`)
+		})
+
+		Convey("Clauses joined by OR should match any of them", func() {
+			query, body := parseQuery("name==*log OR name==*txt", "request", "")
+			So(body, ShouldBeNil)
+			data, _ := json.Marshal(mustSource(query))
+			So(string(data), ShouldEqual,
+				`{"bool":{"minimum_should_match":"1","should":[{"wildcard":{"name":{"wildcard":"*log"}}},`+
+					`{"wildcard":{"name":{"wildcard":"*txt"}}}]}}`)
+		})
+
+		Convey("Mixing AND and OR should be rejected", func() {
+			_, body := parseQuery("name==*log OR name==*txt AND size>0", "request", "")
+			So(body, ShouldNotBeNil)
+			So(body.Code, ShouldEqual, "InvalidSyntax")
+			So(body.Message, ShouldContainSubstring, "can not be mixed")
+		})
+
+		Convey("An invalid clause should fail the whole query", func() {
+			_, body := parseQuery("size>1000 AND etag==xyz", "request", "")
+			So(body, ShouldNotBeNil)
+			So(body.Message, ShouldStartWith, "Syntax should be etag==(MD5 hash value)")
+		})
+	})
+}
+
+func mustSource(query elastic.Query) interface{} {
+	source, err := query.Source()
+	if err != nil {
+		panic(err)
+	}
+
+	return source
+}
+
+func TestMakePermissionQuery(t *testing.T) {
+	Convey("Given a user", t, func() {
+		Convey("The objects should be filtered by the read permissions of the user", func() {
+			data, _ := json.Marshal(mustSource(makePermissionQuery("tester")))
+			So(string(data), ShouldEqual, `{"terms":{"permissions":["tester"]}}`)
+		})
+	})
+}
+
+func TestParseSort(t *testing.T) {
+	Convey("Given sort parameters", t, func() {
+		Convey("The known fields should be sorted by the indexed fields", func() {
+			sorts := map[string]string{
+				"size:asc":          `{"meta.size":{"order":"asc"}}`,
+				"size:desc":         `{"meta.size":{"order":"desc"}}`,
+				"lastmodified:desc": `{"meta.mtime":{"order":"desc"}}`,
+				"name:asc":          `{"name":{"order":"asc"}}`,
+			}
+			for value, expected := range sorts {
+				sorter, ok := parseSort(value)
+				So(ok, ShouldBeTrue)
+				source, _ := sorter.Source()
+				data, _ := json.Marshal(source)
+				So(string(data), ShouldEqual, expected)
+			}
+		})
+
+		Convey("Unknown fields and orders should be rejected", func() {
+			for _, value := range []string{"etag:asc", "size", "size:up", ""} {
+				_, ok := parseSort(value)
+				So(ok, ShouldBeFalse)
+			}
+		})
+	})
+}
+
+func TestSearchCursor(t *testing.T) {
+	Convey("Given the sort values of the last hit", t, func() {
+		sortValues := []interface{}{int64(1533117600123), "object#photos/cat.jpg"}
+
+		Convey("When the cursor is encoded and decoded", func() {
+			cursor, err := encodeCursor(sortValues)
+			So(err, ShouldBeNil)
+			decoded, err := decodeCursor(cursor)
+
+			Convey("The sort values should be kept exactly", func() {
+				So(err, ShouldBeNil)
+				So(decoded, ShouldResemble, []interface{}{json.Number("1533117600123"), "object#photos/cat.jpg"})
+			})
+		})
+
+		Convey("A full page should continue from its last hit", func() {
+			hits := []*elastic.SearchHit{{Sort: []interface{}{1}}, {Sort: sortValues}}
+			cursor, ok := nextCursor(hits, 2)
+			So(ok, ShouldBeTrue)
+			expected, _ := encodeCursor(sortValues)
+			So(cursor, ShouldEqual, expected)
+
+			_, ok = nextCursor(hits, 3)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("An empty page of max-keys=0 should not panic", func() {
+			So(func() { nextCursor([]*elastic.SearchHit{}, 0) }, ShouldNotPanic)
+			_, ok := nextCursor(nil, 0)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("An invalid cursor should be rejected", func() {
+			for _, cursor := range []string{"not base64!", "W10=", "e30="} {
+				_, err := decodeCursor(cursor)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
+
+func TestParseSize(t *testing.T) {
+	Convey("Given sizes of a size clause", t, func() {
+		Convey("Plain bytes and sizes with units should be parsed", func() {
+			sizes := map[string]int64{
+				"0":    0,
+				"1000": 1000,
+				"1kb":  1024,
+				"3MB":  3 << 20,
+				"1GB":  1073741824,
+				"2Tb":  2 << 40,
+			}
+			for value, bytes := range sizes {
+				size, ok := parseSize(value)
+				So(ok, ShouldBeTrue)
+				So(size, ShouldEqual, bytes)
+			}
+		})
+
+		Convey("Unknown units and overflows should be rejected", func() {
+			for _, value := range []string{"1PB", "1.5GB", "GB", "-1", "99999999999TB"} {
+				_, ok := parseSize(value)
+				So(ok, ShouldBeFalse)
+			}
+		})
+
+		Convey("The size clause should mention the units on error", func() {
+			_, body := parseClause("size>1XB", "request")
+			So(body, ShouldNotBeNil)
+			So(body.Message, ShouldContainSubstring, "KB, MB, GB or TB")
+		})
+	})
+}
+
+func TestSearchResponseEncodings(t *testing.T) {
+	Convey("Given a search response", t, func() {
+		var d ObjectType
+		d.Bucket, d.Name, d.Meta.Etag = "photos", "cat.jpg", "0cc175b9c0f1b6a831c399e269772661"
+		resp := SearchResponse{IsTruncated: "false", Objects: []Object{makeObject(d)}}
+
+		Convey("The JSON and XML encodings should carry the same ETag", func() {
+			var fromJSON, fromXML struct {
+				Objects []Object
+			}
+			data, err := json.Marshal(resp)
+			So(err, ShouldBeNil)
+			So(json.Unmarshal(data, &fromJSON), ShouldBeNil)
+
+			data, err = xml.Marshal(resp)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldContainSubstring, "<ETag>")
+			So(xml.Unmarshal(data, &fromXML), ShouldBeNil)
+
+			So(fromXML.Objects[0].Etag, ShouldEqual, fromJSON.Objects[0].Etag)
+			So(fromXML.Objects[0].Key, ShouldEqual, "cat.jpg")
+		})
+	})
+}
+
+func TestParseNameClause(t *testing.T) {
+	Convey("Given name clauses", t, func() {
+		Convey("The name should be matched as is by default", func() {
+			query, body := parseClause("name==*TXT", "request")
+			So(body, ShouldBeNil)
+			data, _ := json.Marshal(mustSource(query))
+			So(string(data), ShouldEqual, `{"wildcard":{"name":{"wildcard":"*TXT"}}}`)
+		})
+
+		Convey("The /i flag should match the lowercased name", func() {
+			query, body := parseClause("name==*TXT/i", "request")
+			So(body, ShouldBeNil)
+			data, _ := json.Marshal(mustSource(query))
+			So(string(data), ShouldEqual, `{"wildcard":{"name.lower":{"wildcard":"*txt"}}}`)
+
+			query, _ = parseClause("name==Report.PDF/i", "request")
+			data, _ = json.Marshal(mustSource(query))
+			So(string(data), ShouldEqual, `{"term":{"name.lower":"report.pdf"}}`)
+		})
+
+		Convey("A ? should be a wildcard like a *", func() {
+			for clause, expected := range map[string]string{
+				"name==cat?.jpg":           `{"wildcard":{"name":{"wildcard":"cat?.jpg"}}}`,
+				"owner.display_name==dev?": `{"wildcard":{"owner.display_name":{"wildcard":"dev?"}}}`,
+				"tag.project==alpha?":      `{"wildcard":{"meta.tags.project":{"wildcard":"alpha?"}}}`,
+				"x-amz-meta-serial==a950?": `"wildcard":{"meta.custom-string.value":{"wildcard":"a950?"}}`,
+			} {
+				query, body := parseClause(clause, "request")
+				So(body, ShouldBeNil)
+				data, _ := json.Marshal(mustSource(query))
+				So(string(data), ShouldContainSubstring, expected)
+			}
+		})
+	})
+}
+
+func TestEscapeWildcard(t *testing.T) {
+	Convey("Given a prefix with wildcard characters", t, func() {
+		Convey("The characters should be matched literally", func() {
+			So(escapeWildcard("logs/*?\\"), ShouldEqual, "logs/\\*\\?\\\\")
+			So(escapeWildcard("photos/2018/"), ShouldEqual, "photos/2018/")
+		})
+	})
+}
+
+func TestParseTagClause(t *testing.T) {
+	Convey("Given a tag clause", t, func() {
+		Convey("A term query on the tag should be returned", func() {
+			query, body := parseClause("tag.project==alpha", "request")
+			So(body, ShouldBeNil)
+			data, _ := json.Marshal(mustSource(query))
+			So(string(data), ShouldEqual, `{"term":{"meta.tags.project":"alpha"}}`)
+		})
+
+		Convey("Other operators should be rejected", func() {
+			_, body := parseClause("tag.project>alpha", "request")
+			So(body, ShouldNotBeNil)
+			So(body.Code, ShouldEqual, "InvalidSyntax")
+		})
+	})
+
+	Convey("Given an indexed object with tags", t, func() {
+		var d ObjectType
+		d.Meta.Tags = map[string]string{"project": "alpha", "owner": "ops"}
+
+		Convey("The tags should be returned sorted by key", func() {
+			So(makeObject(d).Tags, ShouldResemble, []TagEntry{{Key: "owner", Value: "ops"}, {Key: "project", Value: "alpha"}})
+		})
+	})
+}
+
+func TestVersionSorters(t *testing.T) {
+	Convey("Given the sort of includeVersions", t, func() {
+		Convey("The versions of a key should be sorted together newest first", func() {
+			sources := []string{}
+			for _, sorter := range versionSorters() {
+				data, _ := json.Marshal(mustSource(sorter))
+				sources = append(sources, string(data))
+			}
+			So(sources, ShouldResemble, []string{
+				`{"name":{"order":"asc"}}`,
+				`{"versioned_epoch":{"order":"desc"}}`,
+				`{"meta.mtime":{"order":"desc"}}`,
+			})
+		})
+	})
+}
+
+func TestPageMarkers(t *testing.T) {
+	Convey("Given pages of 10 results", t, func() {
+		Convey("The first page should only have the next marker", func() {
+			next, prev := pageMarkers(0, 10, 25)
+			So(next, ShouldEqual, "10")
+			So(prev, ShouldEqual, "")
+		})
+
+		Convey("A middle page should have both markers", func() {
+			next, prev := pageMarkers(10, 10, 25)
+			So(next, ShouldEqual, "20")
+			So(prev, ShouldEqual, "0")
+		})
+
+		Convey("The last partial page should only have the previous marker", func() {
+			next, prev := pageMarkers(20, 10, 25)
+			So(next, ShouldEqual, "")
+			So(prev, ShouldEqual, "10")
+		})
+
+		Convey("A page exactly filled by the last results should be the last page", func() {
+			next, _ := pageMarkers(10, 10, 20)
+			So(next, ShouldEqual, "")
+			next, _ = pageMarkers(10, 10, 21)
+			So(next, ShouldEqual, "20")
+		})
+
+		Convey("The previous marker should not go below zero", func() {
+			_, prev := pageMarkers(5, 10, 25)
+			So(prev, ShouldEqual, "0")
+		})
+	})
+}
+
+func TestParseUnknownFieldClause(t *testing.T) {
+	Convey("Given clauses with an unknown field", t, func() {
+		Convey("A well formed clause should name the field and the supported ones", func() {
+			_, body := parseClause("foo==bar", "request")
+			So(body, ShouldNotBeNil)
+			So(body.Code, ShouldEqual, "InvalidSyntax")
+			So(body.Message, ShouldStartWith, "Unknown field 'foo'; supported: name, ext, lastmodified")
+			So(body.Message, ShouldEndWith, "tag.<key>, x-amz-meta-<name>")
+		})
+
+		Convey("A misspelled field should also be suggested", func() {
+			_, body := parseClause("sise>10", "request")
+			So(body, ShouldNotBeNil)
+			So(body.Message, ShouldStartWith, "Unknown field 'sise', did you mean 'size'? Supported: ")
+		})
+
+		Convey("An unparseable clause should get the full help", func() {
+			_, body := parseClause("size", "request")
+			So(body, ShouldNotBeNil)
+			So(body.Message, ShouldEqual, makeInvalidSyntaxResponse("request").Message)
+		})
+	})
+}
+
+func TestParseSHA256Clause(t *testing.T) {
+	Convey("Given sha256 clauses", t, func() {
+		hash := "E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855"
+
+		Convey("A hash should be a lowercased term query", func() {
+			query, body := parseClause("sha256=="+hash, "request")
+			So(body, ShouldBeNil)
+			data, _ := json.Marshal(mustSource(query))
+			So(string(data), ShouldEqual, `{"term":{"meta.x-amz-content-sha256":"`+strings.ToLower(hash)+`"}}`)
+		})
+
+		Convey("Another operator or a malformed hash should be rejected", func() {
+			for _, clause := range []string{"sha256>" + hash, "sha256==" + hash[:63], "sha256==UNSIGNED-PAYLOAD"} {
+				_, body := parseClause(clause, "request")
+				So(body, ShouldNotBeNil)
+				So(body.Code, ShouldEqual, "InvalidSyntax")
+			}
+		})
+	})
+}
+
+func TestParseStorageClassClause(t *testing.T) {
+	Convey("Given storage class clauses", t, func() {
+		Convey("A term query on the storage class should be returned", func() {
+			for clause, class := range map[string]string{"storageclass==GLACIER": "GLACIER", "storageclass==standard": "STANDARD"} {
+				query, body := parseClause(clause, "request")
+				So(body, ShouldBeNil)
+				data, _ := json.Marshal(mustSource(query))
+				So(string(data), ShouldEqual, `{"term":{"meta.x-amz-storage-class":"`+class+`"}}`)
+			}
+		})
+
+		Convey("Other operators should be rejected", func() {
+			_, body := parseClause("storageclass>=STANDARD", "request")
+			So(body, ShouldNotBeNil)
+			So(body.Code, ShouldEqual, "InvalidSyntax")
+		})
+	})
+}
+
+func TestParseOwnerClause(t *testing.T) {
+	Convey("Given owner clauses", t, func() {
+		Convey("The owner id should be matched by a term query", func() {
+			query, body := parseClause("owner==tester", "request")
+			So(body, ShouldBeNil)
+			data, _ := json.Marshal(mustSource(query))
+			So(string(data), ShouldEqual, `{"term":{"owner.id":"tester"}}`)
+		})
+
+		Convey("The display name should support wildcards", func() {
+			query, body := parseClause("owner.display_name==dev*", "request")
+			So(body, ShouldBeNil)
+			data, _ := json.Marshal(mustSource(query))
+			So(string(data), ShouldEqual, `{"wildcard":{"owner.display_name":{"wildcard":"dev*"}}}`)
+		})
+
+		Convey("Other operators should be rejected", func() {
+			for _, clause := range []string{"owner>tester", "owner.display_name<dev"} {
+				_, body := parseClause(clause, "request")
+				So(body, ShouldNotBeNil)
+				So(body.Code, ShouldEqual, "InvalidSyntax")
+			}
+		})
+	})
+}
+
+func TestParseBetweenClause(t *testing.T) {
+	Convey("Given lastmodified between clauses", t, func() {
+		Convey("A window should be parsed into one range query", func() {
+			query, body := parseClause("lastmodified between 2018-05-01T00:00,2018-05-31T23:59", "request")
+			So(body, ShouldBeNil)
+			data, _ := json.Marshal(mustSource(query))
+			So(string(data), ShouldEqual,
+				`{"range":{"meta.mtime":{"from":"2018-05-01T00:00","include_lower":true,"include_upper":true,"to":"2018-05-31T23:59"}}}`)
+		})
+
+		Convey("A start after the end or a bad time should be rejected", func() {
+			for _, clause := range []string{
+				"lastmodified between 2018-06-01T00:00,2018-05-31T23:59",
+				"lastmodified between 2018-05-01,2018-05-31T23:59",
+				"lastmodified between 2018-05-01T00:00",
+			} {
+				_, body := parseClause(clause, "request")
+				So(body, ShouldNotBeNil)
+				So(body.Code, ShouldEqual, "InvalidSyntax")
+			}
+		})
+	})
+}
+
+// matchesMtime evaluates the range query of a lastmodified clause on the
+// mtime of an object, now-<n>d and now-<n>h are resolved against now.
+func matchesMtime(query elastic.Query, mtime time.Time, now time.Time) bool {
+	params := mustSource(query).(map[string]interface{})["range"].(map[string]interface{})["meta.mtime"].(map[string]interface{})
+	bound := func(value interface{}) time.Time {
+		var n int
+		var unit string
+		fmt.Sscanf(strings.TrimPrefix(value.(string), "now-"), "%d%s", &n, &unit)
+		if unit == "d" {
+			return now.Add(-time.Duration(n) * 24 * time.Hour)
+		}
+		return now.Add(-time.Duration(n) * time.Hour)
+	}
+
+	if from := params["from"]; from != nil {
+		lower := bound(from)
+		if mtime.Before(lower) || (mtime.Equal(lower) && !params["include_lower"].(bool)) {
+			return false
+		}
+	}
+	if to := params["to"]; to != nil {
+		upper := bound(to)
+		if mtime.After(upper) || (mtime.Equal(upper) && !params["include_upper"].(bool)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestParseLastModifiedDurationClause(t *testing.T) {
+	Convey("Given lastmodified duration clauses", t, func() {
+		now := time.Date(2018, 5, 26, 12, 0, 0, 0, time.UTC)
+		objects := map[string]time.Time{
+			"hour-old":  now.Add(-time.Hour),
+			"day-old":   now.Add(-24 * time.Hour),
+			"week-old":  now.Add(-7 * 24 * time.Hour),
+			"in-future": now.Add(time.Hour),
+		}
+		matched := func(clause string) []string {
+			query, body := parseClause(clause, "request")
+			So(body, ShouldBeNil)
+			names := []string{}
+			for _, name := range []string{"in-future", "hour-old", "day-old", "week-old"} {
+				if matchesMtime(query, objects[name], now) {
+					names = append(names, name)
+				}
+			}
+			return names
+		}
+
+		Convey("The duration should compare the age of the objects", func() {
+			So(matched("lastmodified<1d"), ShouldResemble, []string{"in-future", "hour-old"})
+			So(matched("lastmodified<=1d"), ShouldResemble, []string{"in-future", "hour-old", "day-old"})
+			So(matched("lastmodified>1d"), ShouldResemble, []string{"week-old"})
+			So(matched("lastmodified>=1d"), ShouldResemble, []string{"day-old", "week-old"})
+			So(matched("lastmodified>2h"), ShouldResemble, []string{"day-old", "week-old"})
+		})
+
+		Convey("The range should be bounded by now minus the duration only", func() {
+			query, _ := parseClause("lastmodified>1d", "request")
+			data, _ := json.Marshal(mustSource(query))
+			So(string(data), ShouldEqual,
+				`{"range":{"meta.mtime":{"from":null,"include_lower":true,"include_upper":false,"to":"now-1d"}}}`)
+		})
+
+		Convey("Other operators or units should be rejected", func() {
+			for _, clause := range []string{"lastmodified==1d", "lastmodified>1|"} {
+				_, body := parseClause(clause, "request")
+				So(body, ShouldNotBeNil)
+				So(body.Code, ShouldEqual, "InvalidSyntax")
+			}
+		})
+	})
+}
+
+func TestParseNameRegexp(t *testing.T) {
+	Convey("Given name=~ clauses", t, func() {
+		Convey("A valid pattern should build a bounded regexp query", func() {
+			query, body := parseClause("name=~log-[0-9]+\\.gz", "request")
+			So(body, ShouldBeNil)
+			data, _ := json.Marshal(mustSource(query))
+			So(string(data), ShouldEqual,
+				`{"regexp":{"name":{"max_determinized_states":10000,"value":"log-[0-9]+\\.gz"}}}`)
+		})
+
+		Convey("An invalid pattern should report the compile error", func() {
+			_, body := parseClause("name=~log-[0-9", "request")
+			So(body, ShouldNotBeNil)
+			So(body.Code, ShouldEqual, "InvalidSyntax")
+			So(body.Message, ShouldContainSubstring, "missing closing ]")
+		})
+
+		Convey("A too long pattern should be rejected", func() {
+			_, body := parseClause("name=~"+strings.Repeat("a", 257), "request")
+			So(body, ShouldNotBeNil)
+			So(body.Message, ShouldContainSubstring, "longer than 256")
+		})
+	})
+}
+
+func TestParseNotClause(t *testing.T) {
+	Convey("Given queries with NOT clauses", t, func() {
+		Convey("A single NOT clause should exclude the matches", func() {
+			query, body := parseQuery("NOT name==*tmp", "request", "")
+			So(body, ShouldBeNil)
+			data, _ := json.Marshal(mustSource(query))
+			So(string(data), ShouldEqual, `{"bool":{"must_not":{"wildcard":{"name":{"wildcard":"*tmp"}}}}}`)
+		})
+
+		Convey("NOT should compose with AND", func() {
+			query, body := parseQuery("contenttype==text/plain AND NOT name==*tmp", "request", "")
+			So(body, ShouldBeNil)
+			data, _ := json.Marshal(mustSource(query))
+			So(string(data), ShouldEqual,
+				`{"bool":{"must":{"term":{"meta.content_type":"text/plain"}},"must_not":{"wildcard":{"name":{"wildcard":"*tmp"}}}}}`)
+		})
+
+		Convey("NOT should compose with OR", func() {
+			query, body := parseQuery("name==*log OR NOT size>0", "request", "")
+			So(body, ShouldBeNil)
+			data, _ := json.Marshal(mustSource(query))
+			So(string(data), ShouldContainSubstring, `{"bool":{"must_not":{"range":{"meta.size"`)
+			So(string(data), ShouldContainSubstring, `"minimum_should_match":"1"`)
+		})
+
+		Convey("A bare NOT should be rejected", func() {
+			for _, query := range []string{"NOT", "NOT  ", "name==*log AND NOT"} {
+				_, body := parseQuery(query, "request", "")
+				So(body, ShouldNotBeNil)
+				So(body.Code, ShouldEqual, "InvalidSyntax")
+			}
+		})
+	})
+}
+
+func TestExplainQuery(t *testing.T) {
+	Convey("Given queries to explain", t, func() {
+		Convey("Each clause should be explained with its query", func() {
+			operator, clauses, body := explainQuery("name==*log AND NOT size>0", "request", "")
+			So(body, ShouldBeNil)
+			So(operator, ShouldEqual, "AND")
+			So(len(clauses), ShouldEqual, 2)
+			So(clauses[0].Clause, ShouldEqual, "name==*log")
+			So(clauses[0].Negated, ShouldBeFalse)
+			data, _ := json.Marshal(clauses[0].Query)
+			So(string(data), ShouldEqual, `{"wildcard":{"name":{"wildcard":"*log"}}}`)
+			So(clauses[1].Clause, ShouldEqual, "NOT size>0")
+			So(clauses[1].Negated, ShouldBeTrue)
+		})
+
+		Convey("A single clause should have no operator", func() {
+			operator, clauses, body := explainQuery("etag==d41d8cd98f00b204e9800998ecf8427e", "request", "")
+			So(body, ShouldBeNil)
+			So(operator, ShouldEqual, "")
+			So(len(clauses), ShouldEqual, 1)
+		})
+
+		Convey("An invalid clause should be rejected", func() {
+			_, _, body := explainQuery("name==*log AND colour==red", "request", "")
+			So(body, ShouldNotBeNil)
+			So(body.Code, ShouldEqual, "InvalidSyntax")
+		})
+	})
+}
+
+func TestParseEtagClause(t *testing.T) {
+	Convey("Given etag clauses", t, func() {
+		Convey("Quoted, uppercase and multipart ETags should be normalized", func() {
+			etags := map[string]string{
+				`etag==9bb58f26192e4ba00f01e2e7b136bbd8`:      "9bb58f26192e4ba00f01e2e7b136bbd8",
+				`etag=="9BB58F26192E4BA00F01E2E7B136BBD8"`:    "9bb58f26192e4ba00f01e2e7b136bbd8",
+				`etag=="d41d8cd98f00b204e9800998ecf8427e-12"`: "d41d8cd98f00b204e9800998ecf8427e-12",
+			}
+			for clause, etag := range etags {
+				query, body := parseClause(clause, "request")
+				So(body, ShouldBeNil)
+				data, _ := json.Marshal(mustSource(query))
+				So(string(data), ShouldEqual, `{"term":{"meta.etag":"`+etag+`"}}`)
+			}
+		})
+
+		Convey("Malformed ETags should be rejected", func() {
+			for _, clause := range []string{"etag==xyz", "etag==9bb58f26192e4ba00f01e2e7b136bbd8-", "etag==9bb58f26192e4ba00f01e2e7b136bbd8-0"} {
+				_, body := parseClause(clause, "request")
+				So(body, ShouldNotBeNil)
+				So(body.Code, ShouldEqual, "InvalidSyntax")
+			}
+		})
+	})
+}
+
+func TestMakeObjectEtag(t *testing.T) {
+	Convey("Given an indexed object", t, func() {
+		var d ObjectType
+		d.Meta.Etag = "0cc175b9c0f1b6a831c399e269772661"
+
+		Convey("The ETag should be wrapped in double quotes", func() {
+			data, err := json.Marshal(makeObject(d))
+			So(err, ShouldBeNil)
+			So(string(data), ShouldContainSubstring, `"ETag":"\"0cc175b9c0f1b6a831c399e269772661\""`)
+
+			data, err = xml.Marshal(makeObject(d))
+			So(err, ShouldBeNil)
+			So(string(data), ShouldContainSubstring, `<ETag>&#34;0cc175b9c0f1b6a831c399e269772661&#34;</ETag>`)
+		})
+	})
+}
+
+func TestParseFuzzyClause(t *testing.T) {
+	Convey("Given name~= clauses", t, func() {
+		Convey("A fuzzy query of AUTO fuzziness should be built by default", func() {
+			query, body := parseQuery("name~=reprot", "request", "")
+			So(body, ShouldBeNil)
+			data, _ := json.Marshal(mustSource(query))
+			So(string(data), ShouldEqual, `{"fuzzy":{"name":{"fuzziness":"AUTO","value":"reprot"}}}`)
+		})
+
+		Convey("The fuzziness parameter should override AUTO", func() {
+			query, body := parseQuery("name~=reprot AND size>0", "request", "2")
+			So(body, ShouldBeNil)
+			data, _ := json.Marshal(mustSource(query))
+			So(string(data), ShouldContainSubstring, `{"fuzzy":{"name":{"fuzziness":"2","value":"reprot"}}}`)
+		})
+
+		Convey("The fuzziness format should be validated", func() {
+			for fuzziness, ok := range map[string]bool{"AUTO": true, "AUTO:3,6": true, "1": true, "3": false, "auto": false} {
+				So(fuzzinessFormat.MatchString(fuzziness), ShouldEqual, ok)
+			}
+		})
+	})
+}
+
+func TestParseClauseRejectsMaliciousValues(t *testing.T) {
+	Convey("Given clauses with malicious values", t, func() {
+		clauses := map[string]string{
+			"name==a\x00b":                           "control characters",
+			"name==a\nb":                             "control characters",
+			"x-amz-meta-id==\x1b[31m":                "control characters",
+			"name==" + strings.Repeat("a", 1025):     "longer than 1024",
+			"contenttype==*a*b*c*d*e*f*g*h*":         "more than 8 wildcard",
+			"name==*?????????":                       "more than 8 wildcard",
+			"tag.project==" + strings.Repeat("*", 9): "more than 8 wildcard",
+		}
+
+		Convey("Every clause should be rejected with the reason", func() {
+			for clause, reason := range clauses {
+				_, body := parseClause(clause, "request")
+				So(body, ShouldNotBeNil)
+				So(body.Code, ShouldEqual, "InvalidSyntax")
+				So(body.Message, ShouldContainSubstring, reason)
+			}
+		})
+
+		Convey("Fuzzy clauses should be validated as well", func() {
+			_, body := parseQuery("name~=a\x00b", "request", "")
+			So(body, ShouldNotBeNil)
+			So(body.Message, ShouldContainSubstring, "control characters")
+		})
+
+		Convey("Ordinary wildcard values should still be accepted", func() {
+			_, body := parseClause("name==logs/*/2018-??-*.gz", "request")
+			So(body, ShouldBeNil)
+		})
+	})
+}
+
+func TestIndexForBucket(t *testing.T) {
+	Convey("Given the metadata index settings", t, func() {
+		os.Setenv("METADATA_INDEX", "metadata")
+		defer os.Unsetenv("METADATA_INDEX")
+		defer os.Unsetenv("METADATA_INDEX_PATTERN")
+
+		Convey("Without a pattern the default index is used", func() {
+			os.Unsetenv("METADATA_INDEX_PATTERN")
+			So(indexForBucket("photos"), ShouldEqual, "metadata")
+		})
+
+		Convey("The tenant of the bucket fills the pattern", func() {
+			os.Setenv("METADATA_INDEX_PATTERN", "metadata-{tenant}")
+			So(indexForBucket("acme:photos"), ShouldEqual, "metadata-acme")
+			So(indexForBucket("photos"), ShouldEqual, "metadata")
+		})
+
+		Convey("The bucket fills the pattern", func() {
+			os.Setenv("METADATA_INDEX_PATTERN", "metadata-{bucket}")
+			So(indexForBucket("photos"), ShouldEqual, "metadata-photos")
+		})
+	})
+}
+
+func TestMakeSearchResponse(t *testing.T) {
+	Convey("Given a search result of a batch query", t, func() {
+		source := json.RawMessage(`{"bucket":"photos","name":"cat.jpg","meta":{"size":10,"etag":"abc"}}`)
+		result := &elastic.SearchResult{Hits: &elastic.SearchHits{
+			TotalHits: 3,
+			Hits:      []*elastic.SearchHit{{Source: &source}},
+		}}
+
+		Convey("A result with more hits than the page should be truncated", func() {
+			resp := makeSearchResponse(result, 1)
+			So(resp.TotalHits, ShouldEqual, 3)
+			So(len(resp.Objects), ShouldEqual, 1)
+			So(resp.Objects[0].Key, ShouldEqual, "cat.jpg")
+			So(resp.IsTruncated, ShouldEqual, "true")
+			So(resp.Marker, ShouldEqual, "1")
+		})
+
+		Convey("A result filling the page should not be truncated", func() {
+			resp := makeSearchResponse(result, 100)
+			So(resp.IsTruncated, ShouldEqual, "false")
+			So(resp.Marker, ShouldEqual, "")
+		})
+	})
+}
+
+func TestMakeKeysResponse(t *testing.T) {
+	Convey("Given a keys-only search result", t, func() {
+		source := json.RawMessage(`{"name":"cat.jpg"}`)
+		result := &elastic.SearchResult{Hits: &elastic.SearchHits{
+			TotalHits: 3,
+			Hits:      []*elastic.SearchHit{{Source: &source}},
+		}}
+
+		Convey("The markers should be the ones of the search response", func() {
+			resp := makeKeysResponse(result, 1, 1, "")
+			So(resp.Keys, ShouldResemble, []string{"cat.jpg"})
+			So(resp.IsTruncated, ShouldEqual, "true")
+			So(resp.Marker, ShouldEqual, "2")
+			So(resp.PrevMarker, ShouldEqual, "0")
+		})
+
+		Convey("The last page should not have a marker", func() {
+			resp := makeKeysResponse(result, 2, 1, "")
+			So(resp.IsTruncated, ShouldEqual, "false")
+			So(resp.Marker, ShouldEqual, "")
+			So(resp.PrevMarker, ShouldEqual, "1")
+		})
+	})
+}
+
+func TestParsePaging(t *testing.T) {
+	Convey("Given the paging of a search", t, func() {
+		Convey("The paging should default to the first 100 objects", func() {
+			from, size, errResp := parsePaging("", "", "request")
+			So(errResp, ShouldBeNil)
+			So(from, ShouldEqual, 0)
+			So(size, ShouldEqual, 100)
+		})
+
+		Convey("A large max-keys should be clamped to SEARCH_MAX_KEYS", func() {
+			_, size, errResp := parsePaging("10", "1000000", "request")
+			So(errResp, ShouldBeNil)
+			So(size, ShouldEqual, 1000)
+
+			os.Setenv("SEARCH_MAX_KEYS", "50")
+			defer os.Unsetenv("SEARCH_MAX_KEYS")
+			_, size, _ = parsePaging("", "100", "request")
+			So(size, ShouldEqual, 50)
+		})
+
+		Convey("A negative or malformed value should be rejected", func() {
+			for _, paging := range [][]string{{"-1", ""}, {"abc", ""}, {"", "-10"}, {"", "ten"}} {
+				_, _, errResp := parsePaging(paging[0], paging[1], "request")
+				So(errResp, ShouldNotBeNil)
+				So(errResp.Code, ShouldEqual, "InvalidSyntax")
+			}
+
+			_, _, errResp := parsePaging("", "-10", "request")
+			So(errResp.Message, ShouldContainSubstring, "1000")
+		})
+	})
+}
+
+func TestCanSearchBucket(t *testing.T) {
+	Convey("Given a bucket granting one user", t, func() {
+		os.Setenv("ADMIN_USERS", "ops")
+		defer os.Unsetenv("ADMIN_USERS")
+		config.SetServerConfig()
+		defer config.SetServerConfig()
+		users := []string{"tester"}
+
+		Convey("The granted user should search the bucket", func() {
+			So(canSearchBucket(users, "tester"), ShouldBeTrue)
+		})
+
+		Convey("The admin users should search any bucket", func() {
+			So(canSearchBucket(users, "ops"), ShouldBeTrue)
+		})
+
+		Convey("The other users should be denied", func() {
+			So(canSearchBucket(users, "other"), ShouldBeFalse)
+		})
+	})
+}
+
+func TestFilterSearchPermissions(t *testing.T) {
+	Convey("Given the permissions parameter of a search", t, func() {
+		newContext := func(target string) *gin.Context {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request, _ = http.NewRequest("GET", target, nil)
+			return c
+		}
+
+		Convey("The searches should be filtered by default, admins included", func() {
+			filter, errResp := filterSearchPermissions(newContext("/?query=name==a"), true, "request")
+			So(errResp, ShouldBeNil)
+			So(filter, ShouldBeTrue)
+		})
+
+		Convey("An admin should turn the filter off by permissions=all", func() {
+			filter, errResp := filterSearchPermissions(newContext("/?query=name==a&permissions=all"), true, "request")
+			So(errResp, ShouldBeNil)
+			So(filter, ShouldBeFalse)
+		})
+
+		Convey("The other users should be denied permissions=all", func() {
+			_, errResp := filterSearchPermissions(newContext("/?query=name==a&permissions=all"), false, "request")
+			So(errResp, ShouldNotBeNil)
+			So(errResp.Code, ShouldEqual, "AccessDenied")
+		})
+
+		Convey("SEARCH_PERMISSION_FILTER=false should turn the filter off", func() {
+			os.Setenv("SEARCH_PERMISSION_FILTER", "false")
+			defer os.Unsetenv("SEARCH_PERMISSION_FILTER")
+			filter, _ := filterSearchPermissions(newContext("/?query=name==a"), false, "request")
+			So(filter, ShouldBeFalse)
+		})
+	})
+}
+
+// fakeKeysIndex answers the searches over the keys like Elasticsearch does,
+// the aggregations see the documents matched by the query and the hits are
+// filtered again by the post filter. The rollup exclusion is the only
+// wildcard query of the tests.
+func fakeKeysIndex(keys []string, prefix, delimiter string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]json.RawMessage
+		json.NewDecoder(r.Body).Decode(&body)
+		rolledUp := func(key string) bool {
+			return strings.Contains(strings.TrimPrefix(key, prefix), delimiter)
+		}
+
+		matched := []string{}
+		for _, key := range keys {
+			if !strings.Contains(string(body["query"]), "wildcard") || !rolledUp(key) {
+				matched = append(matched, key)
+			}
+		}
+		hits := []map[string]interface{}{}
+		buckets := []map[string]interface{}{}
+		seen := map[string]bool{}
+		for _, key := range matched {
+			if !strings.Contains(string(body["post_filter"]), "wildcard") || !rolledUp(key) {
+				hits = append(hits, map[string]interface{}{"_source": map[string]string{"name": key}})
+			}
+			if rest := strings.TrimPrefix(key, prefix); rolledUp(key) {
+				commonPrefix := prefix + rest[:strings.Index(rest, delimiter)+len(delimiter)]
+				if !seen[commonPrefix] {
+					seen[commonPrefix] = true
+					buckets = append(buckets, map[string]interface{}{"key": commonPrefix, "doc_count": 1})
+				}
+			}
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"hits":         map[string]interface{}{"total": len(hits), "hits": hits},
+			"aggregations": map[string]interface{}{"common_prefixes": map[string]interface{}{"buckets": buckets}},
+		})
+	}))
+}
+
+func TestWithCommonPrefixes(t *testing.T) {
+	Convey("Given the keys indexed under a prefix", t, func() {
+		server := fakeKeysIndex([]string{"a/b/c", "a/d"}, "a/", "/")
+		defer server.Close()
+		client, err := elastic.NewClient(elastic.SetURL(server.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+		So(err, ShouldBeNil)
+
+		Convey("The keys under a delimiter should be rolled up into the common prefixes", func() {
+			searchService := client.Search().Index("bucket").
+				Query(elastic.NewPrefixQuery("name", "a/"))
+			result, err := withCommonPrefixes(searchService, "a/", "/", 10).Do(context.Background())
+			So(err, ShouldBeNil)
+			So(commonPrefixes(result), ShouldResemble, []string{"a/b/"})
+			So(makeKeysResponse(result, 0, 10, "").Keys, ShouldResemble, []string{"a/d"})
+		})
+	})
+}
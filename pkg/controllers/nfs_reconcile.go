@@ -0,0 +1,167 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ceph/go-ceph/rados"
+	sh "github.com/codeskyblue/go-sh"
+
+	"github.com/inwinstack/kaoliang/pkg/utils"
+)
+
+// NfsExportDiff lists the users whose export is missing and the users whose
+// export is stale, i.e. the user is gone or can not be exported anymore.
+type NfsExportDiff struct {
+	Missing []string
+	Stale   []string
+}
+
+// listRgwUsers loads the info of every RGW user. A user failing to load fails
+// the listing, otherwise its export would be taken as stale. The tests
+// replace it by a fixed list.
+var listRgwUsers = func() ([]RgwUser, error) {
+	output, err := sh.Command("radosgw-admin", "metadata", "list", "user").Output()
+	if err != nil {
+		return nil, fmt.Errorf("can not list users: %s", err)
+	}
+	var uids []string
+	if err := json.Unmarshal(output, &uids); err != nil {
+		return nil, fmt.Errorf("can not parse user list output: %s", err)
+	}
+
+	users := make([]RgwUser, 0, len(uids))
+	for _, uid := range uids {
+		output, err := sh.Command("radosgw-admin", "user", "info", "--uid", uid).Output()
+		if err != nil {
+			return nil, fmt.Errorf("can not get user info of %s: %s", uid, err)
+		}
+		var user RgwUser
+		if err := json.Unmarshal(output, &user); err != nil {
+			return nil, fmt.Errorf("can not parse user info output of %s: %s", uid, err)
+		}
+		users = append(users, user)
+	}
+
+	return users, nil
+}
+
+// ReconcileNfsExports creates the missing exports of the RGW users and
+// removes the stale ones, which drift when the user requests are missed by
+// kaoliang. The changes take the lock of the export list one by one like the
+// user requests do. dryRun only reports the diff.
+func ReconcileNfsExports(dryRun bool) (NfsExportDiff, error) {
+	users, err := listRgwUsers()
+	if err != nil {
+		return NfsExportDiff{}, err
+	}
+
+	nfsConfig := loadNfsExportConfig()
+	store, closeStore, err := openExportStore(nfsConfig)
+	if err != nil {
+		return NfsExportDiff{}, fmt.Errorf("can not connect nfs config pool %s: %s", nfsConfig.Pool, err)
+	}
+	defer closeStore()
+
+	return reconcileNfsExports(store, nfsConfig, users, dryRun)
+}
+
+func reconcileNfsExports(store exportStore, nfsConfig nfsExportConfig, users []RgwUser, dryRun bool) (NfsExportDiff, error) {
+	exportable := make(map[string]*RgwUser)
+	for i := range users {
+		if isExportable(&users[i]) {
+			exportable[users[i].UserId] = &users[i]
+		}
+	}
+
+	diff, err := diffNfsExports(store, nfsConfig, exportable)
+	if err != nil || dryRun {
+		return diff, err
+	}
+
+	failed := 0
+	for _, uid := range diff.Missing {
+		if err := exportNfsUser(store, nfsConfig, exportable[uid]); err != nil {
+			utils.Error("Can not create nfs export", utils.Fields{"uid": uid, "error": err})
+			failed++
+		}
+	}
+	for _, uid := range diff.Stale {
+		if err := unexportNfsUser(store, nfsConfig, uid); err != nil {
+			utils.Error("Can not remove nfs export", utils.Fields{"uid": uid, "error": err})
+			failed++
+		}
+	}
+	if failed > 0 {
+		return diff, fmt.Errorf("%d of %d nfs exports can not be reconciled", failed, len(diff.Missing)+len(diff.Stale))
+	}
+
+	return diff, nil
+}
+
+// isExportable tells whether addNfsExport exports the user.
+func isExportable(data *RgwUser) bool {
+	_, ok := exportKey(data)
+	return ok && data.MaxBuckets != -1
+}
+
+// diffNfsExports compares the exportable users with the export list and the
+// export objects. An export is missing when it is not listed or has no
+// object, and stale when either is left for a user not exportable.
+func diffNfsExports(store exportStore, nfsConfig nfsExportConfig, exportable map[string]*RgwUser) (NfsExportDiff, error) {
+	exports, err := readObject(store, nfsConfig.ExportList)
+	if err != nil && err != rados.RadosErrorNotFound {
+		return NfsExportDiff{}, err
+	}
+
+	listed := make(map[string]bool)
+	entry := regexp.MustCompile("%url \"rados://" + regexp.QuoteMeta(nfsConfig.Pool) + "/export_([^\"]+)\"")
+	for _, group := range entry.FindAllStringSubmatch(string(exports), -1) {
+		listed[group[1]] = true
+	}
+
+	objects := make(map[string]bool)
+	err = store.ListObjects(func(oid string) {
+		if strings.HasPrefix(oid, "export_") {
+			objects[strings.TrimPrefix(oid, "export_")] = true
+		}
+	})
+	if err != nil {
+		return NfsExportDiff{}, err
+	}
+
+	diff := NfsExportDiff{Missing: []string{}, Stale: []string{}}
+	for uid := range exportable {
+		if !listed[uid] || !objects[uid] {
+			diff.Missing = append(diff.Missing, uid)
+		}
+	}
+	for _, uids := range []map[string]bool{listed, objects} {
+		for uid := range uids {
+			if _, ok := exportable[uid]; !ok && !contains(diff.Stale, uid) {
+				diff.Stale = append(diff.Stale, uid)
+			}
+		}
+	}
+	sort.Strings(diff.Missing)
+	sort.Strings(diff.Stale)
+
+	return diff, nil
+}
@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReconcileNfsExports(t *testing.T) {
+	Convey("Given exports drifted from the rgw users", t, func() {
+		store := newFakeExportStore()
+		keys := []RgwKey{{User: "tester", AccessKey: "access", SecretKey: "secret"}}
+		kept := RgwUser{UserId: "kept", DisplayName: "kept", Keys: keys}
+		missed := RgwUser{UserId: "missed", DisplayName: "missed", Keys: keys}
+		gone := RgwUser{UserId: "gone", DisplayName: "gone", Keys: keys}
+		So(exportNfsUser(store, testNfsConfig, &kept), ShouldBeNil)
+		So(exportNfsUser(store, testNfsConfig, &gone), ShouldBeNil)
+		// an export obj left by a half-done removal
+		store.objects["export_orphan"] = []byte("partial")
+		users := []RgwUser{
+			kept,
+			missed,
+			{UserId: "nobucket", MaxBuckets: -1, Keys: keys},
+			{UserId: "nokeys"},
+		}
+
+		Convey("A dry run should only report the diff", func() {
+			diff, err := reconcileNfsExports(store, testNfsConfig, users, true)
+			So(err, ShouldBeNil)
+			So(diff.Missing, ShouldResemble, []string{"missed"})
+			So(diff.Stale, ShouldResemble, []string{"gone", "orphan"})
+			So(store.objects, ShouldNotContainKey, "export_missed")
+			So(store.objects, ShouldContainKey, "export_gone")
+		})
+
+		Convey("The missing exports should be created and the stale ones removed", func() {
+			_, err := reconcileNfsExports(store, testNfsConfig, users, false)
+			So(err, ShouldBeNil)
+			exports := string(store.objects["export"])
+			So(exports, ShouldContainSubstring, makeExport("nfs-ganesha", "export_kept"))
+			So(exports, ShouldContainSubstring, makeExport("nfs-ganesha", "export_missed"))
+			So(exports, ShouldNotContainSubstring, "export_gone")
+			So(store.objects, ShouldNotContainKey, "export_gone")
+			So(store.objects, ShouldNotContainKey, "export_orphan")
+
+			diff, err := reconcileNfsExports(store, testNfsConfig, users, true)
+			So(err, ShouldBeNil)
+			So(diff.Missing, ShouldBeEmpty)
+			So(diff.Stale, ShouldBeEmpty)
+		})
+
+		Convey("A failed change should be reported after the others are applied", func() {
+			store.failures["WriteFull"] = 1
+			_, err := reconcileNfsExports(store, testNfsConfig, users, false)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldStartWith, "1 of 3 nfs exports")
+			So(strings.Contains(string(store.objects["export"]), "export_gone"), ShouldBeFalse)
+		})
+	})
+}
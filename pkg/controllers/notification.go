@@ -20,13 +20,20 @@ import (
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
 	sh "github.com/codeskyblue/go-sh"
 	"github.com/gin-gonic/gin"
 	"github.com/go-sql-driver/mysql"
@@ -34,6 +41,7 @@ import (
 	"github.com/inwinstack/kaoliang/pkg/config"
 	"github.com/inwinstack/kaoliang/pkg/models"
 	"github.com/inwinstack/kaoliang/pkg/utils"
+	"github.com/jinzhu/gorm"
 	"github.com/minio/minio/cmd"
 	"github.com/minio/minio/pkg/event"
 )
@@ -107,119 +115,505 @@ func PutBucketNotification(c *gin.Context) {
 		writeErrorResponse(c, cmd.ErrAccessDenied)
 		return
 	}
+	defer getNotificationConfigs().remove(bucket)
 
-	xmlConfig := models.Config{}
 	data, _ := ioutil.ReadAll(c.Request.Body)
+	if names := findUnsupportedEvents(data); len(names) > 0 {
+		supported := []string{}
+		for _, name := range emittedEvents {
+			supported = append(supported, models.EventNameString(name))
+		}
+		writeErrorMessageResponse(c, cmd.ErrEventNotification, fmt.Sprintf("The events %s are not supported, supported: %s",
+			strings.Join(names, ", "), strings.Join(supported, ", ")))
+		return
+	}
+
+	xmlConfig := models.Config{}
 	xml.Unmarshal(data, &xmlConfig)
 	xmlConfig.Bucket = bucket
-	db := models.GetDB()
+	if arn, ok := findMissingTarget(xmlConfig); !ok {
+		writeErrorMessageResponse(c, cmd.ErrARNNotification, fmt.Sprintf("The notification target %s does not exist", arn))
+		return
+	}
 
-	if err := db.Create(&xmlConfig).Error; err != nil {
-		if mysqlErr, ok := err.(*mysql.MySQLError); ok {
-			if mysqlErr.Number == 1062 {
-				config := models.Config{}
-				db.Where(&models.Config{Bucket: bucket}).
-					Preload("Queues.Events").Preload("Queues.Resource").Preload("Queues.Filter.RuleList.Rules").
-					Preload("Topics.Events").Preload("Topics.Resource").Preload("Topics.Filter.RuleList.Rules").
-					First(&config)
-				if len(xmlConfig.Queues) == 0 && len(xmlConfig.Topics) == 0 {
-					db.Delete(&config)
-					c.Status(http.StatusOK)
-					return
-				}
-				for _, xmlQueue := range xmlConfig.Queues {
-					targetResource, err := models.ParseARN(xmlQueue.ARN)
-					if err != nil {
-						writeErrorResponse(c, cmd.ErrARNNotification)
-						return
-					}
-					if db.Where(models.Resource{
-						AccountID: targetResource.AccountID,
-						Service:   targetResource.Service,
-						Name:      targetResource.Name,
-					}).First(&targetResource).RecordNotFound() {
-						writeErrorResponse(c, cmd.ErrARNNotification)
-						return
-					}
-
-					queue := models.Queue{}
-					if db.Where(models.Queue{
-						QueueIdentifier: xmlQueue.QueueIdentifier,
-						ConfigID:        config.ID,
-					}).First(&queue).RecordNotFound() {
-						xmlQueue.ResourceID = targetResource.ID
-						xmlQueue.ConfigID = config.ID
-						db.Create(&xmlQueue)
-					} else {
-						queue.ARN = targetResource.ARN()
-						queue.ResourceID = targetResource.ID
-						db.Save(&queue)
-					}
-				}
+	// the config is written in a transaction, a failed write leaves the
+	// previous config as is
+	tx := models.GetDB().Begin()
+	if tx.Error != nil {
+		utils.Error("Can not begin transaction", utils.Fields{"bucket": bucket, "error": tx.Error})
+		writeErrorResponse(c, cmd.ErrInternalError)
+		return
+	}
+	if errCode := saveNotificationConfig(tx, bucket, &xmlConfig); errCode != cmd.ErrNone {
+		tx.Rollback()
+		writeErrorResponse(c, errCode)
+		return
+	}
+	if err := tx.Commit().Error; err != nil {
+		utils.Error("Can not save notification config", utils.Fields{"bucket": bucket, "error": err})
+		writeErrorResponse(c, cmd.ErrInternalError)
+		return
+	}
 
-				for _, xmlTopic := range xmlConfig.Topics {
-					targetResource, err := models.ParseARN(xmlTopic.ARN)
-					if err != nil {
-						writeErrorResponse(c, cmd.ErrARNNotification)
-						return
-					}
-					if db.Where(models.Resource{
-						AccountID: targetResource.AccountID,
-						Service:   targetResource.Service,
-						Name:      targetResource.Name,
-					}).First(&targetResource).RecordNotFound() {
-						writeErrorResponse(c, cmd.ErrARNNotification)
-						return
-					}
-
-					topic := models.Topic{}
-					if db.Where(models.Topic{
-						TopicIdentifier: xmlTopic.TopicIdentifier,
-						ConfigID:        config.ID,
-					}).First(&topic).RecordNotFound() {
-						xmlTopic.ResourceID = targetResource.ID
-						xmlTopic.ConfigID = config.ID
-						db.Create(&xmlTopic)
-					} else {
-						topic.ARN = targetResource.ARN()
-						topic.ResourceID = targetResource.ID
-						db.Save(&topic)
-					}
-				}
-			}
-		}
-	} else {
+	c.Status(http.StatusOK)
+}
+
+// saveNotificationConfig creates the notification config of the bucket, or
+// updates the existing one. A config without queues and topics removes the
+// existing one.
+func saveNotificationConfig(tx *gorm.DB, bucket string, xmlConfig *models.Config) cmd.APIErrorCode {
+	err := tx.Create(xmlConfig).Error
+	if err == nil {
 		for _, queue := range xmlConfig.Queues {
-			targetResource, err := models.ParseARN(queue.ARN)
-			if err != nil {
-				writeErrorResponse(c, cmd.ErrARNNotification)
-				return
+			targetResource, errCode := findTargetResource(tx, queue.ARN)
+			if errCode != cmd.ErrNone {
+				return errCode
 			}
-			db.Where(models.Resource{
-				AccountID: targetResource.AccountID,
-				Service:   targetResource.Service,
-				Name:      targetResource.Name,
-			}).First(&targetResource)
 			queue.ResourceID = targetResource.ID
-			db.Save(&queue)
+			if err := tx.Save(&queue).Error; err != nil {
+				return dbErrorCode("Can not save notification queue", bucket, err)
+			}
 		}
 		for _, topic := range xmlConfig.Topics {
-			targetResource, err := models.ParseARN(topic.ARN)
-			if err != nil {
-				writeErrorResponse(c, cmd.ErrARNNotification)
-				return
+			targetResource, errCode := findTargetResource(tx, topic.ARN)
+			if errCode != cmd.ErrNone {
+				return errCode
 			}
-			db.Where(models.Resource{
-				AccountID: targetResource.AccountID,
-				Service:   targetResource.Service,
-				Name:      targetResource.Name,
-			}).First(&targetResource)
 			topic.ResourceID = targetResource.ID
-			db.Save(&topic)
+			if err := tx.Save(&topic).Error; err != nil {
+				return dbErrorCode("Can not save notification topic", bucket, err)
+			}
 		}
+
+		return cmd.ErrNone
+	}
+	if mysqlErr, ok := err.(*mysql.MySQLError); !ok || mysqlErr.Number != 1062 {
+		return dbErrorCode("Can not create notification config", bucket, err)
 	}
 
-	c.Status(http.StatusOK)
+	// the bucket has a config already
+	config := models.Config{}
+	err = tx.Where(&models.Config{Bucket: bucket}).
+		Preload("Queues.Events").Preload("Queues.Resource").Preload("Queues.Filter.RuleList.Rules").
+		Preload("Topics.Events").Preload("Topics.Resource").Preload("Topics.Filter.RuleList.Rules").
+		First(&config).Error
+	if err != nil {
+		return dbErrorCode("Can not load notification config", bucket, err)
+	}
+	if len(xmlConfig.Queues) == 0 && len(xmlConfig.Topics) == 0 {
+		if err := deleteNotificationConfig(tx, &config); err != nil {
+			return dbErrorCode("Can not delete notification config", bucket, err)
+		}
+		return cmd.ErrNone
+	}
+
+	for _, xmlQueue := range xmlConfig.Queues {
+		targetResource, errCode := findTargetResource(tx, xmlQueue.ARN)
+		if errCode != cmd.ErrNone {
+			return errCode
+		}
+
+		queue := models.Queue{}
+		result := tx.Where(models.Queue{
+			QueueIdentifier: xmlQueue.QueueIdentifier,
+			ConfigID:        config.ID,
+		}).First(&queue)
+		switch {
+		case result.RecordNotFound():
+			xmlQueue.ResourceID = targetResource.ID
+			xmlQueue.ConfigID = config.ID
+			err = tx.Create(&xmlQueue).Error
+		case result.Error != nil:
+			err = result.Error
+		default:
+			queue.ARN = targetResource.ARN()
+			queue.ResourceID = targetResource.ID
+			err = tx.Save(&queue).Error
+		}
+		if err != nil {
+			return dbErrorCode("Can not save notification queue", bucket, err)
+		}
+	}
+
+	for _, xmlTopic := range xmlConfig.Topics {
+		targetResource, errCode := findTargetResource(tx, xmlTopic.ARN)
+		if errCode != cmd.ErrNone {
+			return errCode
+		}
+
+		topic := models.Topic{}
+		result := tx.Where(models.Topic{
+			TopicIdentifier: xmlTopic.TopicIdentifier,
+			ConfigID:        config.ID,
+		}).First(&topic)
+		switch {
+		case result.RecordNotFound():
+			xmlTopic.ResourceID = targetResource.ID
+			xmlTopic.ConfigID = config.ID
+			err = tx.Create(&xmlTopic).Error
+		case result.Error != nil:
+			err = result.Error
+		default:
+			topic.ARN = targetResource.ARN()
+			topic.ResourceID = targetResource.ID
+			err = tx.Save(&topic).Error
+		}
+		if err != nil {
+			return dbErrorCode("Can not save notification topic", bucket, err)
+		}
+	}
+
+	return cmd.ErrNone
+}
+
+// findTargetResource looks up the resource of the ARN of a queue or topic.
+func findTargetResource(tx *gorm.DB, arn string) (*models.Resource, cmd.APIErrorCode) {
+	targetResource, err := models.ParseARN(arn)
+	if err != nil {
+		return nil, cmd.ErrARNNotification
+	}
+
+	result := tx.Where(models.Resource{
+		AccountID: targetResource.AccountID,
+		Service:   targetResource.Service,
+		Name:      targetResource.Name,
+	}).First(targetResource)
+	if result.RecordNotFound() {
+		return nil, cmd.ErrARNNotification
+	}
+	if result.Error != nil {
+		utils.Error("Can not load notification target", utils.Fields{"arn": arn, "error": result.Error})
+		return nil, cmd.ErrInternalError
+	}
+
+	return targetResource, cmd.ErrNone
+}
+
+// dbErrorCode logs the failed query and returns the internal error.
+func dbErrorCode(message string, bucket string, err error) cmd.APIErrorCode {
+	utils.Error(message, utils.Fields{"bucket": bucket, "error": err})
+	return cmd.ErrInternalError
+}
+
+// deleteNotificationConfig deletes the preloaded config with its queues,
+// topics and their events and filters. The rows are deleted for good, a soft
+// deleted config would keep the unique bucket from getting a new one.
+func deleteNotificationConfig(tx *gorm.DB, config *models.Config) error {
+	rows := []interface{}{}
+	addFilter := func(filter *models.S3Key) {
+		for i := range filter.RuleList.Rules {
+			rows = append(rows, &filter.RuleList.Rules[i])
+		}
+		rows = append(rows, &filter.RuleList, filter)
+	}
+	for i := range config.Queues {
+		queue := &config.Queues[i]
+		for j := range queue.Events {
+			rows = append(rows, &queue.Events[j])
+		}
+		addFilter(&queue.Filter)
+		rows = append(rows, queue)
+	}
+	for i := range config.Topics {
+		topic := &config.Topics[i]
+		for j := range topic.Events {
+			rows = append(rows, &topic.Events[j])
+		}
+		addFilter(&topic.Filter)
+		rows = append(rows, topic)
+	}
+	rows = append(rows, config)
+
+	db := tx.Unscoped()
+	for _, row := range rows {
+		// gorm deletes the whole table by a blank primary key
+		if db.NewScope(row).PrimaryKeyZero() {
+			continue
+		}
+		if err := db.Delete(row).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteBucketNotification removes the notification config of the bucket,
+// no events are emitted for the bucket afterwards.
+func DeleteBucketNotification(c *gin.Context) {
+	if _, ok := c.GetQuery("notification"); !ok {
+		// not notification related, just pass
+		ReverseProxy()(c)
+		return
+	}
+
+	userID, errCode := authenticate(c.Request)
+	if errCode != cmd.ErrNone {
+		writeErrorResponse(c, errCode)
+		return
+	}
+
+	tokens := strings.Split(userID, ":")
+	if len(tokens) > 1 {
+		userID = tokens[0]
+	}
+
+	bucket := c.Param("bucket")
+	users, ok := getBucketUsers(bucket)
+	if !ok {
+		writeErrorResponse(c, cmd.ErrNoSuchBucket)
+		return
+	}
+
+	if !contains(users, userID) {
+		writeErrorResponse(c, cmd.ErrAccessDenied)
+		return
+	}
+
+	// the config is deleted in a transaction, a failed delete leaves it as is
+	tx := models.GetDB().Begin()
+	if tx.Error != nil {
+		utils.Error("Can not begin transaction", utils.Fields{"bucket": bucket, "error": tx.Error})
+		writeErrorResponse(c, cmd.ErrInternalError)
+		return
+	}
+	config := models.Config{}
+	result := tx.Where(&models.Config{Bucket: bucket}).
+		Preload("Queues.Events").Preload("Queues.Filter.RuleList.Rules").
+		Preload("Topics.Events").Preload("Topics.Filter.RuleList.Rules").
+		First(&config)
+	switch {
+	case result.RecordNotFound():
+		tx.Rollback()
+		c.Status(http.StatusNoContent)
+		return
+	case result.Error != nil:
+		tx.Rollback()
+		writeErrorResponse(c, dbErrorCode("Can not load notification config", bucket, result.Error))
+		return
+	}
+	if err := deleteNotificationConfig(tx, &config); err != nil {
+		tx.Rollback()
+		writeErrorResponse(c, dbErrorCode("Can not delete notification config", bucket, err))
+		return
+	}
+	if err := tx.Commit().Error; err != nil {
+		writeErrorResponse(c, dbErrorCode("Can not delete notification config", bucket, err))
+		return
+	}
+	getNotificationConfigs().remove(bucket)
+
+	c.Status(http.StatusNoContent)
+}
+
+// emittedEvents are the events generated by ReverseProxy, keep it in sync
+// with modifyResponse. The other events of a notification config would never
+// fire.
+var emittedEvents = []event.Name{
+	event.ObjectCreatedPut,
+	event.ObjectCreatedCopy,
+	event.ObjectCreatedCompleteMultipartUpload,
+	event.ObjectRemovedDelete,
+	models.ObjectRemovedDeleteMarkerCreated,
+}
+
+// deleteEventName returns the event of a DELETE response. A delete without a
+// version id on a versioned bucket only adds a delete marker, which RGW tells
+// by X-Amz-Delete-Marker. X-Amz-Version-Id is also set when a version is
+// deleted for good, so it can not tell them apart.
+func deleteEventName(resp *http.Response) event.Name {
+	if resp.Header.Get("X-Amz-Delete-Marker") == "true" {
+		return models.ObjectRemovedDeleteMarkerCreated
+	}
+
+	return event.ObjectRemovedDelete
+}
+
+// findUnsupportedEvents returns the event names of the notification config
+// document which are not emitted, a wildcard is supported when it covers an
+// emitted event. The names are checked before parsing the config, which
+// fails on the unknown names.
+func findUnsupportedEvents(data []byte) []string {
+	type configuration struct {
+		Events []string `xml:"Event"`
+	}
+	doc := struct {
+		Queues []configuration `xml:"QueueConfiguration"`
+		Topics []configuration `xml:"TopicConfiguration"`
+	}{}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil
+	}
+
+	names := []string{}
+	for _, conf := range append(doc.Queues, doc.Topics...) {
+		for _, name := range conf.Events {
+			name = strings.TrimSpace(name)
+			if isEmittedEvent(name) || contains(names, name) {
+				continue
+			}
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+func isEmittedEvent(s string) bool {
+	name, err := models.ParseEventName(s)
+	if err != nil {
+		return false
+	}
+	for _, expanded := range models.ExpandEventName(name) {
+		for _, emitted := range emittedEvents {
+			if expanded == emitted {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// findMissingTarget returns the first queue or topic ARN of the config which
+// is not a registered target of its service, so no events would reach it.
+func findMissingTarget(nConfig models.Config) (arn string, ok bool) {
+	arns := []string{}
+	services := []models.Service{}
+	for _, queue := range nConfig.Queues {
+		arns, services = append(arns, queue.ARN), append(services, models.SQS)
+	}
+	for _, topic := range nConfig.Topics {
+		arns, services = append(arns, topic.ARN), append(services, models.SNS)
+	}
+
+	db := models.GetDB()
+	for i, arn := range arns {
+		targetResource, err := models.ParseARN(arn)
+		if err != nil || targetResource.Service != services[i] {
+			return arn, false
+		}
+		if db.Where(models.Resource{
+			AccountID: targetResource.AccountID,
+			Service:   targetResource.Service,
+			Name:      targetResource.Name,
+		}).First(targetResource).RecordNotFound() {
+			return arn, false
+		}
+	}
+
+	return "", true
+}
+
+type NotificationConfigReport struct {
+	Bucket    string   `json:"bucket"`
+	Valid     bool     `json:"valid"`
+	Errors    []string `json:"errors"`
+	Rewritten bool     `json:"rewritten"`
+}
+
+type RevalidateNotificationsResponse struct {
+	Configs []NotificationConfigReport `json:"configs"`
+}
+
+// RevalidateNotifications re-parses every stored notification config with the
+// current event package and region, and reports the configs which no longer
+// pass validation. With rewrite=true the normalized ARNs are saved back.
+func RevalidateNotifications(c *gin.Context) {
+	userID, errCode := authenticate(c.Request)
+	if errCode != cmd.ErrNone {
+		writeErrorResponse(c, errCode)
+		return
+	}
+
+	tokens := strings.Split(userID, ":")
+	if len(tokens) > 1 {
+		userID = tokens[0]
+	}
+
+	if !isAdmin(userID) {
+		writeErrorResponse(c, cmd.ErrAccessDenied)
+		return
+	}
+
+	rewrite := c.Query("rewrite") == "true"
+	db := models.GetDB()
+	var configs []models.Config
+	db.Preload("Queues.Events").Preload("Queues.Resource").Preload("Queues.Filter.RuleList.Rules").
+		Preload("Topics.Events").Preload("Topics.Resource").Preload("Topics.Filter.RuleList.Rules").
+		Find(&configs)
+
+	respBody := RevalidateNotificationsResponse{
+		Configs: []NotificationConfigReport{},
+	}
+	for _, nConfig := range configs {
+		report := NotificationConfigReport{
+			Bucket: nConfig.Bucket,
+			Errors: []string{},
+		}
+
+		// round trip through XML, so events which the current event package
+		// can not parse are reported
+		data, err := xml.Marshal(&nConfig)
+		if err == nil {
+			err = xml.Unmarshal(data, &models.Config{})
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		}
+
+		for i := range nConfig.Queues {
+			queue := &nConfig.Queues[i]
+			arn, err := revalidateARN(queue.ARN)
+			if err != nil {
+				report.Errors = append(report.Errors, err.Error())
+				continue
+			}
+			if arn != queue.ARN && rewrite {
+				queue.ARN = arn
+				db.Model(queue).Update("arn", arn)
+				report.Rewritten = true
+			}
+		}
+		for i := range nConfig.Topics {
+			topic := &nConfig.Topics[i]
+			arn, err := revalidateARN(topic.ARN)
+			if err != nil {
+				report.Errors = append(report.Errors, err.Error())
+				continue
+			}
+			if arn != topic.ARN && rewrite {
+				topic.ARN = arn
+				db.Model(topic).Update("arn", arn)
+				report.Rewritten = true
+			}
+		}
+
+		report.Valid = len(report.Errors) == 0
+		respBody.Configs = append(respBody.Configs, report)
+	}
+
+	c.JSON(http.StatusOK, respBody)
+}
+
+// revalidateARN parses the ARN of a notification target, and returns the
+// normalized ARN of the registered resource.
+func revalidateARN(arn string) (string, error) {
+	targetResource, err := models.ParseARN(arn)
+	if err != nil {
+		return "", err
+	}
+
+	db := models.GetDB()
+	if db.Where(models.Resource{
+		Service:   targetResource.Service,
+		AccountID: targetResource.AccountID,
+		Name:      targetResource.Name,
+	}).First(targetResource).RecordNotFound() {
+		return "", fmt.Errorf("target %s does not exist", arn)
+	}
+
+	return targetResource.ARN(), nil
 }
 
 func checkResponse(resp *http.Response, method string, statusCode int) bool {
@@ -232,44 +626,149 @@ func checkResponse(resp *http.Response, method string, statusCode int) bool {
 	return false
 }
 
+var errNoObjectName = errors.New("The request does not address an object")
+
+// getObjectName splits the request into the bucket and the object, the bucket
+// is taken from the subdomain of RGW_DNS_NAME for virtual-hosted-style
+// requests and from the first path segment otherwise. The object is the key
+// decoded from the escaped path, which the filter rules are matched against,
+// a + is a literal + in the path of S3. The bucket is returned along with
+// errNoObjectName for the requests without an object.
 func getObjectName(req *http.Request) (bucketName string, objectName string, err error) {
 	config := config.GetServerConfig()
-	re := regexp.MustCompile("([A-Za-z0-9]*)\\." + config.Host)
-	if group := re.FindStringSubmatch(req.Host); len(group) == 2 {
+	re := regexp.MustCompile("^(.+)\\." + regexp.QuoteMeta(config.Host) + "(:[0-9]+)?$")
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	if group := re.FindStringSubmatch(req.Host); len(group) == 3 {
 		bucketName = group[1]
-		segments := strings.Split(req.URL.Path, "/")
-		objectName = strings.Join(segments[1:], "/")
+		objectName = path
 	} else { // path-style syntax
-		segments := strings.Split(req.URL.Path, "/")
-		bucketName = segments[1]
-		objectName = strings.Join(segments[2:], "/")
+		segments := strings.SplitN(path, "/", 2)
+		bucketName = segments[0]
+		if len(segments) == 2 {
+			objectName = segments[1]
+		}
+	}
+
+	if bucketName == "" || objectName == "" {
+		err = errNoObjectName
 	}
 
 	return
 }
 
 func sendEvent(resp *http.Response, eventType event.Name) error {
+	var etag string
+	if val, ok := resp.Header["Etag"]; ok {
+		etag = val[0]
+	}
+
+	return sendObjectEvent(resp, eventType, etag, objectSize(resp.Request, eventType))
+}
+
+// unknownObjectSize is the size of an event whose object size is looked up in
+// RGW before it is published. When the lookup fails the event is published
+// with the size -1, so the consumers can tell it from a zero-byte object.
+const unknownObjectSize = -1
+
+// objectSize returns the size of the object written by the request. The
+// response of a put or a copy only describes its own body, so the size comes
+// from the request: the decoded length of an aws-chunked upload, otherwise the
+// body length, which is 0 for a zero-byte object. The size of a copy or of a
+// chunked upload without a length is unknownObjectSize.
+func objectSize(req *http.Request, eventType event.Name) int64 {
+	if eventType == event.ObjectCreatedCopy {
+		return unknownObjectSize
+	}
+
+	if decoded := req.Header.Get("X-Amz-Decoded-Content-Length"); decoded != "" {
+		if size, err := strconv.ParseInt(decoded, 10, 64); err == nil && size >= 0 {
+			return size
+		}
+	}
+	if req.ContentLength >= 0 {
+		return req.ContentLength
+	}
+
+	return unknownObjectSize
+}
+
+// headObjectSize looks up the size of the object in RGW with the credentials
+// of the requester, unknownObjectSize is returned when it can not be looked
+// up.
+func headObjectSize(req *http.Request, bucketName string, objectName string, versionID string) int64 {
+	_, creds, errCode := cmd.GetCredentials(ExtractAccessKey(req))
+	if errCode != cmd.ErrNone {
+		return unknownObjectSize
+	}
+
+	input := &s3.HeadObjectInput{Bucket: aws.String(bucketName), Key: aws.String(objectName)}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	client, err := newRGWClient(creds.AccessKey, creds.SecretKey)
+	if err != nil {
+		utils.Warn("Can not look up object size", utils.Fields{"bucket": bucketName, "object": objectName, "error": err})
+		return unknownObjectSize
+	}
+	output, err := client.HeadObject(input)
+	if err != nil || output.ContentLength == nil {
+		utils.Warn("Can not look up object size", utils.Fields{"bucket": bucketName, "object": objectName, "error": err})
+		return unknownObjectSize
+	}
+
+	return *output.ContentLength
+}
+
+// sendObjectEvent sends the event with the given ETag and size of the object,
+// for the responses which do not describe the object in their headers.
+func sendObjectEvent(resp *http.Response, eventType event.Name, etag string, size int64) error {
+	enqueueEvent(eventJob{
+		resp:      resp,
+		eventType: eventType,
+		etag:      etag,
+		size:      size,
+		eventTime: time.Now().UTC(),
+	})
+
+	return nil
+}
+
+// publishEvent delivers the event of the job to the targets whose rules
+// match the object.
+func publishEvent(job eventJob) {
+	resp, eventType, eventTime := job.resp, job.eventType, job.eventTime
 	clientReq := resp.Request
-	bucketName, objectName, _ := getObjectName(clientReq)
+	bucketName, objectName, err := getObjectName(clientReq)
+	if err != nil {
+		return
+	}
 
-	client := models.GetCache()
 	serverConfig := config.GetServerConfig()
-	nConfig := models.Config{}
-	db := models.GetDB()
-	db.Where(&models.Config{Bucket: bucketName}).
-		Preload("Queues.Events").Preload("Queues.Resource").Preload("Queues.Filter.RuleList.Rules").
-		Preload("Topics.Events").Preload("Topics.Resource.Endpoints").Preload("Topics.Filter.RuleList.Rules").
-		First(&nConfig)
+	nConfig, ok := loadNotificationConfig(bucketName)
+	if !ok {
+		return
+	}
 
 	rulesMap := nConfig.ToRulesMap()
-	eventTime := time.Now().UTC()
-
-	var etag string
-	if val, ok := resp.Header["Etag"]; ok {
-		etag = val[0]
+	contentType, userMetadata := objectMetadata(resp)
+	requestParameters := map[string]string{
+		"sourceIPAddress": clientIP(clientReq, serverConfig.TrustedProxies),
+	}
+	if copySource := clientReq.Header.Get("X-Amz-Copy-Source"); copySource != "" {
+		requestParameters["x-amz-copy-source"] = copySource
 	}
 
-	for _, resource := range rulesMap[eventType].Match(objectName) {
+	requestID := responseRequestID(resp)
+	versionID := resp.Header.Get("X-Amz-Version-Id")
+	resources := rulesMap[eventType].Match(objectName)
+	size := job.size
+	if size == unknownObjectSize && len(resources) > 0 {
+		size = headObjectSize(clientReq, bucketName, objectName, versionID)
+	}
+	// the queues get the event together, see models.PushEvents, the other
+	// targets can not join them and are delivered one by one
+	queues, queueValues := []models.Resource{}, [][]byte{}
+	for _, resource := range resources {
 		newEvent := event.Event{
 			EventVersion: "2.0",
 			EventSource:  "aws:s3",
@@ -279,11 +778,9 @@ func sendEvent(resp *http.Response, eventType event.Name) error {
 			UserIdentity: event.Identity{
 				PrincipalID: "",
 			},
-			RequestParameters: map[string]string{
-				"sourceIPAddress": clientReq.RemoteAddr,
-			},
+			RequestParameters: requestParameters,
 			ResponseElements: map[string]string{
-				"x-amz-request-id": resp.Header["X-Amz-Request-Id"][0],
+				"x-amz-request-id": requestID,
 			},
 			S3: event.Metadata{
 				SchemaVersion:   "1.0",
@@ -296,28 +793,137 @@ func sendEvent(resp *http.Response, eventType event.Name) error {
 					ARN: resource.ARN(),
 				},
 				Object: event.Object{
-					Key:       objectName,
-					Size:      clientReq.ContentLength,
-					ETag:      etag,
-					Sequencer: fmt.Sprintf("%X", eventTime.UnixNano()),
+					Key:          objectName,
+					Size:         size,
+					ETag:         job.etag,
+					ContentType:  contentType,
+					UserMetadata: userMetadata,
+					VersionID:    versionID,
+					Sequencer:    fmt.Sprintf("%X", eventTime.UnixNano()),
 				},
 			},
 		}
 
-		value, err := json.Marshal(newEvent)
+		if resource.Service == models.SQS && serverConfig.KafkaTopics[resource.ARN()] == "" {
+			value, err := models.MarshalEvent(newEvent, resource)
+			if err != nil {
+				utils.Error("Can not push event", utils.Fields{"target": resource.ARN(), "request_id": requestID, "error": err})
+				continue
+			}
+			queues, queueValues = append(queues, resource), append(queueValues, value)
+			continue
+		}
+
+		if err := deliverEvent(resource, newEvent); err != nil {
+			utils.Error("Can not push event", utils.Fields{"target": resource.ARN(), "request_id": requestID, "error": err})
+			continue
+		}
+		models.EventsPublished.WithLabelValues(models.EventNameString(eventType)).Inc()
+	}
+
+	for i, err := range models.PushEvents(queues, queueValues) {
 		if err != nil {
-			panic(err)
+			utils.Error("Can not push event", utils.Fields{"target": queues[i].ARN(), "request_id": requestID, "error": err})
+			continue
+		}
+		models.EventsPublished.WithLabelValues(models.EventNameString(eventType)).Inc()
+	}
+}
+
+// objectMetadata returns the content type and the x-amz-meta-* metadata of
+// the object. RGW does not echo them in the write responses, so they are taken
+// from the client request, the x-amz-meta-* response headers win when set.
+func objectMetadata(resp *http.Response) (contentType string, userMetadata map[string]string) {
+	for _, header := range []http.Header{resp.Request.Header, resp.Header} {
+		for name, values := range header {
+			if len(values) == 0 {
+				continue
+			}
+			if name := strings.ToLower(name); strings.HasPrefix(name, "x-amz-meta-") {
+				if userMetadata == nil {
+					userMetadata = make(map[string]string)
+				}
+				userMetadata[name] = values[0]
+			}
+		}
+	}
+
+	// a copy keeps the content type of the source unless the metadata is replaced
+	contentType = resp.Request.Header.Get("Content-Type")
+	if resp.Request.Header.Get("X-Amz-Copy-Source") != "" && resp.Request.Header.Get("X-Amz-Metadata-Directive") != "REPLACE" {
+		contentType = ""
+	}
+
+	return contentType, userMetadata
+}
+
+// loadNotificationConfig loads the notification config of the bucket through
+// the config cache, ok is false when the bucket has no config.
+func loadNotificationConfig(bucketName string) (nConfig models.Config, ok bool) {
+	cache := getNotificationConfigs()
+	if nConfig, ok, found := cache.get(bucketName); found {
+		return nConfig, ok
+	}
+
+	db := models.GetDB()
+	result := db.Where(&models.Config{Bucket: bucketName}).
+		Preload("Queues.Events").Preload("Queues.Resource").Preload("Queues.Filter.RuleList.Rules").
+		Preload("Topics.Events").Preload("Topics.Resource.Endpoints").Preload("Topics.Filter.RuleList.Rules").
+		First(&nConfig)
+	if result.Error != nil && !result.RecordNotFound() {
+		// do not cache a failed query as a missing config
+		return nConfig, false
+	}
+
+	ok = !result.RecordNotFound()
+	cache.add(bucketName, nConfig, ok)
+
+	return nConfig, ok
+}
+
+// responseRequestID returns the request id set by RGW, some error responses
+// come without it so an id is generated the same way instead.
+func responseRequestID(resp *http.Response) string {
+	if requestID := resp.Header.Get("X-Amz-Request-Id"); requestID != "" {
+		return requestID
+	}
+
+	return fmt.Sprintf("%X", time.Now().UTC().UnixNano())
+}
+
+// deliverEvent pushes the event to the queue or hands it to the workers of
+// the topic endpoints.
+func deliverEvent(resource models.Resource, newEvent event.Event) error {
+	value, err := models.MarshalEvent(newEvent, resource)
+	if err != nil {
+		return err
+	}
+
+	if ok, err := models.SendKafkaEvent(resource, newEvent); ok {
+		if err == nil {
+			return nil
 		}
+		// keep the event in the Kafka buffer of the target until Kafka is
+		// back, the eventconsumer produces it again
+		utils.Warn("Can not produce event to Kafka", utils.Fields{"target": resource.ARN(), "error": err})
+		return models.BufferKafkaEvent(resource, newEvent)
+	}
 
-		switch resource.Service {
-		case models.SQS:
-			client.RPush(fmt.Sprintf("%s:%s:%s", resource.Service.String(), resource.AccountID, resource.Name), value)
-		case models.SNS:
-			celeryBroker, celeryBackend := models.GetCelery()
-			celeryClient, _ := gocelery.NewCeleryClient(celeryBroker, celeryBackend, 0)
+	switch resource.Service {
+	case models.SQS:
+		return models.PushEvent(resource, value)
+	case models.SNS:
+		celeryBroker, celeryBackend := models.GetCelery()
+		celeryClient, _ := gocelery.NewCeleryClient(celeryBroker, celeryBackend, 0)
 
-			for _, endpoint := range resource.Endpoints {
-				celeryClient.Delay("worker.send_event", endpoint.URI, string(value))
+		for _, endpoint := range resource.Endpoints {
+			if endpoint.Protocol == models.WebhookProtocol {
+				uri := endpoint.URI
+				goBackground(func() { postWebhook(uri, value) })
+				continue
+			}
+			if _, err := celeryClient.Delay("worker.send_event", endpoint.URI, string(value)); err != nil {
+				return err
 			}
 		}
 	}
@@ -325,50 +931,199 @@ func sendEvent(resp *http.Response, eventType event.Name) error {
 	return nil
 }
 
+// maxCompleteMultipartBodySize bounds the CompleteMultipartUpload response
+// read for the ETag of the object.
+const maxCompleteMultipartBodySize = 1 << 16
+
+// CompleteMultipartUploadResult is the response of a completed multipart
+// upload. The response is sent with 200 before the upload is done, so a
+// failure comes back as an Error document instead.
+type CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+// parseCompleteMultipartUpload returns the result of a completed multipart
+// upload, ok is false when the upload failed.
+func parseCompleteMultipartUpload(data []byte) (result CompleteMultipartUploadResult, ok bool) {
+	if err := xml.Unmarshal(data, &result); err != nil {
+		return result, false
+	}
+
+	return result, true
+}
+
+// sendCompleteMultipartUploadEvent reads the ETag of the completed object
+// from the response body, then puts the body back for the client. The
+// response has no size of the object, so the size is looked up in RGW.
+func sendCompleteMultipartUploadEvent(resp *http.Response) error {
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCompleteMultipartBodySize+1))
+	if err != nil {
+		return err
+	}
+	if len(b) > maxCompleteMultipartBodySize {
+		resp.Body = readCloser{io.MultiReader(bytes.NewReader(b), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+	result, ok := parseCompleteMultipartUpload(b)
+	if !ok {
+		return nil
+	}
+
+	return sendObjectEvent(resp, event.ObjectCreatedCompleteMultipartUpload, result.ETag, unknownObjectSize)
+}
+
+// postWebhook posts the event to the webhook endpoint, retried with
+// WEBHOOK_RETRIES and WEBHOOK_RETRY_DELAY. It runs apart from the response,
+// so a slow endpoint does not hold the client.
+func postWebhook(uri string, value []byte) {
+	attempts := utils.GetEnvPositiveInt("WEBHOOK_RETRIES", 3)
+	delay := utils.GetEnvDuration("WEBHOOK_RETRY_DELAY", 500*time.Millisecond)
+
+	err := retry(attempts, delay, func() error {
+		return models.PostWebhook(uri, value)
+	})
+	if err != nil {
+		utils.Error("Can not post event to webhook", utils.Fields{"uri": uri, "error": err})
+	}
+}
+
 func isMultipartUpload(request *http.Request) bool {
 	q := request.URL.Query()
 	return len(q["partNumber"]) != 0 && len(q["uploadId"]) != 0
 }
 
+// s3Subresources are the query parameters of the S3 requests reading or
+// writing a subresource of an object or a bucket, like PUT /bucket/key?acl.
+// They never create or delete an object.
+var s3Subresources = []string{
+	"acl", "cors", "encryption", "legal-hold", "lifecycle", "logging", "notification", "object-lock",
+	"policy", "replication", "requestPayment", "restore", "retention", "select", "tagging", "torrent",
+	"versioning", "website",
+}
+
+// isSubresourceRequest reports whether the query addresses a subresource.
+func isSubresourceRequest(query url.Values) bool {
+	for _, subresource := range s3Subresources {
+		if _, ok := query[subresource]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
 func IsAdminUserPath(path string) bool {
 	return path == "/admin/user/" || path == "/admin/user"
 }
 
+// maxAdminUserBodySize bounds the admin user response read for NFS exports.
+const maxAdminUserBodySize = 1 << 20
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func cloneHeader(header http.Header) http.Header {
+	clone := make(http.Header, len(header))
+	for name, values := range header {
+		clone[name] = append([]string(nil), values...)
+	}
+
+	return clone
+}
+
+var (
+	reverseProxy       gin.HandlerFunc
+	reverseProxyLoaded sync.Once
+)
+
+// ReverseProxy returns the handler proxying the requests to TARGET_HOST. The
+// target and its transport are built by the first call, which main makes at
+// startup, so the connections to RGW are reused by every request.
 func ReverseProxy() gin.HandlerFunc {
-	target := utils.GetEnv("TARGET_HOST", "127.0.0.1")
+	reverseProxyLoaded.Do(func() {
+		reverseProxy = newReverseProxy()
+	})
+
+	return reverseProxy
+}
+
+func newReverseProxy() gin.HandlerFunc {
+	rgw, err := loadUpstream()
+	if err != nil {
+		utils.Error("Can not load TARGET_HOST", utils.Fields{"error": err})
+		os.Exit(1)
+	}
+	target, transport := rgw.target, rgw.transport
 
 	return func(c *gin.Context) {
 		director := func(req *http.Request) {
-			req.URL.Scheme = "http"
-			req.URL.Host = target
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			withBasePath(req.URL, target.Path)
+			setForwardedHeaders(req, config.GetServerConfig().TrustedProxies)
+			config.GetServerConfig().ProxyRequestHeaders.Apply(req.Header)
 		}
 
+		// modifyResponse generates the events from the response headers only,
+		// object bodies are never read here. The admin user body is the only
+		// one buffered and its size is bounded by maxAdminUserBodySize.
 		modifyResponse := func(resp *http.Response) error {
 			cfg := config.GetServerConfig()
 			clientReq := resp.Request
-			go LoggingOps(resp)
+			// the response headers are filtered after the events are sent,
+			// so the ops log gets its own copy
+			logResp := *resp
+			logResp.Header = cloneHeader(resp.Header)
+			goBackground(func() { LoggingOps(&logResp) })
 			switch {
 			case IsAdminUserPath(clientReq.URL.Path):
 				statusCode := resp.StatusCode
-				b, _ := ioutil.ReadAll(resp.Body)
+				b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxAdminUserBodySize+1))
+				if err != nil {
+					return err
+				}
+				if len(b) > maxAdminUserBodySize {
+					// too large to be a user info, stream it back without export handling
+					resp.Body = readCloser{io.MultiReader(bytes.NewReader(b), resp.Body), resp.Body}
+					return nil
+				}
 				resp.Body.Close()
-				go HandleNfsExport(clientReq, b, statusCode)
+				goBackground(func() { HandleNfsExport(clientReq, b, statusCode) })
 				resp.Body = ioutil.NopCloser(bytes.NewReader(b)) // put body back for client response
 				return nil
+			case isSubresourceRequest(clientReq.URL.Query()):
+				return nil
 			case len(clientReq.Header["X-Amz-Copy-Source"]) > 0 && cfg.EnableKaoliangCopy == "True":
 				return sendEvent(resp, event.ObjectCreatedCopy)
 			case checkResponse(resp, "POST", 200) && len(clientReq.URL.Query()["uploadId"]) != 0:
-				return sendEvent(resp, event.ObjectCreatedCompleteMultipartUpload)
+				return sendCompleteMultipartUploadEvent(resp)
 			case len(resp.Header["Etag"]) > 0 && checkResponse(resp, "PUT", 200) && !isMultipartUpload(clientReq) && cfg.EnableKaoliangCreate == "True":
 				return sendEvent(resp, event.ObjectCreatedPut)
 			case checkResponse(resp, "DELETE", 204) && cfg.EnableKaoliangDelete == "True":
-				return sendEvent(resp, event.ObjectRemovedDelete)
+				return sendEvent(resp, deleteEventName(resp))
 			default:
 				return nil
 			}
 		}
 
-		proxy := &httputil.ReverseProxy{Director: director, ModifyResponse: modifyResponse}
+		filterResponse := func(resp *http.Response) error {
+			models.ProxiedRequests.WithLabelValues(resp.Request.Method, strconv.Itoa(resp.StatusCode)).Inc()
+			resp.Request = withoutBasePath(resp.Request, target.Path)
+			err := modifyResponse(resp)
+			config.GetServerConfig().ProxyResponseHeaders.Apply(resp.Header)
+			return err
+		}
+
+		proxy := &httputil.ReverseProxy{Director: director, ModifyResponse: filterResponse, Transport: transport}
 		proxy.ServeHTTP(c.Writer, c.Request)
 	}
 }
@@ -385,7 +1140,24 @@ type ACL struct {
 	GrantMap []Grant `json:"grant_map"`
 }
 
+// getBucketUsers returns the users granted by the policy of the bucket, the
+// users are cached for BUCKET_USERS_CACHE_TTL.
 func getBucketUsers(bucketName string) (users []string, ok bool) {
+	cache := getBucketUsersCache()
+	if cache != nil {
+		if users, found := cache.get(bucketName); found {
+			return users, true
+		}
+	}
+
+	if users, ok = loadBucketUsers(bucketName); ok && cache != nil {
+		cache.add(bucketName, users)
+	}
+
+	return users, ok
+}
+
+func loadBucketUsers(bucketName string) (users []string, ok bool) {
 	var policy Policy
 	output, err := sh.Command("radosgw-admin", "policy", "--bucket="+bucketName).Output()
 	if err != nil {
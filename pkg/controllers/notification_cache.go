@@ -0,0 +1,71 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/inwinstack/kaoliang/pkg/models"
+	"github.com/inwinstack/kaoliang/pkg/utils"
+)
+
+// configCache is an LRU of the notification configs of the buckets, which
+// saves a query on every proxied write. The entries are removed when the
+// config is changed through this instance, and expire after the TTL so the
+// changes made through other instances are picked up.
+type configCache struct {
+	*lruCache
+}
+
+type configCacheEntry struct {
+	config models.Config
+	ok     bool
+}
+
+func newConfigCache(size int, ttl time.Duration) *configCache {
+	return &configCache{newLRUCache(size, ttl, models.NotificationConfigCacheRequests)}
+}
+
+func (c *configCache) get(bucket string) (nConfig models.Config, ok bool, found bool) {
+	value, found := c.lruCache.get(bucket)
+	if !found {
+		return nConfig, false, false
+	}
+	entry := value.(configCacheEntry)
+
+	return entry.config, entry.ok, true
+}
+
+func (c *configCache) add(bucket string, nConfig models.Config, ok bool) {
+	c.lruCache.add(bucket, configCacheEntry{config: nConfig, ok: ok})
+}
+
+var (
+	notificationConfigs       *configCache
+	notificationConfigsLoaded sync.Once
+)
+
+// getNotificationConfigs returns the cache of NOTIFICATION_CONFIG_CACHE_SIZE
+// configs expiring after NOTIFICATION_CONFIG_CACHE_TTL.
+func getNotificationConfigs() *configCache {
+	notificationConfigsLoaded.Do(func() {
+		size := utils.GetEnvPositiveInt("NOTIFICATION_CONFIG_CACHE_SIZE", 1024)
+		ttl := utils.GetEnvDuration("NOTIFICATION_CONFIG_CACHE_TTL", 10*time.Second)
+		notificationConfigs = newConfigCache(size, ttl)
+	})
+
+	return notificationConfigs
+}
@@ -0,0 +1,378 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/minio/minio/pkg/event"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/inwinstack/kaoliang/pkg/config"
+	"github.com/inwinstack/kaoliang/pkg/models"
+)
+
+func TestResponseRequestID(t *testing.T) {
+	Convey("Given responses of RGW", t, func() {
+		Convey("The request id set by RGW should be used", func() {
+			resp := &http.Response{Header: http.Header{"X-Amz-Request-Id": []string{"tx000001"}}}
+			So(responseRequestID(resp), ShouldEqual, "tx000001")
+		})
+
+		Convey("A response without the request id should not panic", func() {
+			resp := &http.Response{Header: http.Header{}}
+			So(func() { responseRequestID(resp) }, ShouldNotPanic)
+			So(responseRequestID(resp), ShouldNotBeEmpty)
+		})
+	})
+}
+
+func TestParseCompleteMultipartUpload(t *testing.T) {
+	Convey("Given a recorded CompleteMultipartUpload response", t, func() {
+		body := "  \n<?xml version=\"1.0\" encoding=\"UTF-8\"?>" +
+			"<CompleteMultipartUploadResult xmlns=\"http://s3.amazonaws.com/doc/2006-03-01/\">" +
+			"<Location>http://cloud.inwinstack.com/photos/large.iso</Location>" +
+			"<Bucket>photos</Bucket><Key>large.iso</Key>" +
+			"<ETag>&quot;0c78aef83f66abc1fa1e8477f296d394-3&quot;</ETag>" +
+			"</CompleteMultipartUploadResult>"
+
+		Convey("The final ETag of the object should be parsed", func() {
+			result, ok := parseCompleteMultipartUpload([]byte(body))
+			So(ok, ShouldBeTrue)
+			So(result.Key, ShouldEqual, "large.iso")
+			So(result.ETag, ShouldEqual, "\"0c78aef83f66abc1fa1e8477f296d394-3\"")
+		})
+
+		Convey("A failed upload should not be parsed", func() {
+			body := "<?xml version=\"1.0\" encoding=\"UTF-8\"?>" +
+				"<Error><Code>InvalidPart</Code></Error>"
+			_, ok := parseCompleteMultipartUpload([]byte(body))
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func TestGetObjectName(t *testing.T) {
+	os.Setenv("RGW_DNS_NAME", "s3.example.com")
+	config.SetServerConfig()
+	defer os.Unsetenv("RGW_DNS_NAME")
+
+	Convey("Given requests to RGW", t, func() {
+		Convey("A path-style request should be split on the first segment", func() {
+			req, _ := http.NewRequest("PUT", "http://s3.example.com/photos/2018/cat.jpg", nil)
+			bucket, object, err := getObjectName(req)
+			So(err, ShouldBeNil)
+			So(bucket, ShouldEqual, "photos")
+			So(object, ShouldEqual, "2018/cat.jpg")
+		})
+
+		Convey("A virtual-hosted-style request should take the bucket from the host", func() {
+			req, _ := http.NewRequest("PUT", "http://my-photos.v2.s3.example.com:7480/2018/cat.jpg", nil)
+			bucket, object, err := getObjectName(req)
+			So(err, ShouldBeNil)
+			So(bucket, ShouldEqual, "my-photos.v2")
+			So(object, ShouldEqual, "2018/cat.jpg")
+		})
+
+		Convey("An escaped key should be decoded and match the filter rules", func() {
+			rulesMap := models.NewRulesMap([]event.Name{event.ObjectCreatedPut}, models.NewPattern("my photos/", " 猫.jpg"), models.Resource{Name: "foo"})
+			for url, key := range map[string]string{
+				"http://s3.example.com/photos/my%20photos/a%20%E7%8C%AB.jpg": "my photos/a 猫.jpg",
+				"http://s3.example.com/photos/my%20photos/a+猫.jpg":           "my photos/a+猫.jpg",
+			} {
+				req, _ := http.NewRequest("PUT", url, nil)
+				_, object, err := getObjectName(req)
+				So(err, ShouldBeNil)
+				So(object, ShouldEqual, key)
+			}
+
+			req, _ := http.NewRequest("PUT", "http://s3.example.com/photos/my%20photos/a%20%E7%8C%AB.jpg", nil)
+			_, object, _ := getObjectName(req)
+			So(len(rulesMap[event.ObjectCreatedPut].Match(object)), ShouldEqual, 1)
+			req, _ = http.NewRequest("PUT", "http://s3.example.com/photos/my%20photos/a+%E7%8C%AB.jpg", nil)
+			_, object, _ = getObjectName(req)
+			So(rulesMap[event.ObjectCreatedPut].Match(object), ShouldBeEmpty)
+		})
+
+		Convey("A request without an object should return an error", func() {
+			for _, url := range []string{"http://s3.example.com/", "http://s3.example.com/photos", "http://photos.s3.example.com/"} {
+				req, _ := http.NewRequest("DELETE", url, nil)
+				_, _, err := getObjectName(req)
+				So(err, ShouldEqual, errNoObjectName)
+			}
+
+			req, _ := http.NewRequest("DELETE", "http://s3.example.com/photos", nil)
+			bucket, _, _ := getObjectName(req)
+			So(bucket, ShouldEqual, "photos")
+		})
+	})
+}
+
+func TestEnqueueEventDropsWhenFull(t *testing.T) {
+	Convey("Given a full event queue", t, func() {
+		eventWorkersLoaded.Do(func() {})
+		eventJobs = make(chan eventJob)
+
+		req, _ := http.NewRequest("PUT", "http://s3.example.com/photos/cat.jpg", nil)
+		resp := &http.Response{Header: http.Header{}, Request: req}
+
+		Convey("Enqueueing an event should not block the proxy", func() {
+			done := make(chan bool)
+			go func() {
+				enqueueEvent(eventJob{resp: resp, eventType: event.ObjectCreatedPut})
+				done <- true
+			}()
+
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("enqueueEvent blocked on a full queue")
+			}
+		})
+	})
+}
+
+func TestDrainEvents(t *testing.T) {
+	Convey("Given queued events", t, func() {
+		eventWorkersLoaded.Do(func() {})
+		eventJobs = make(chan eventJob, 2)
+		defer func() { eventJobsClosed = false }()
+
+		published := 0
+		eventWorkers.Add(1)
+		go func(jobs chan eventJob) {
+			defer eventWorkers.Done()
+			for range jobs {
+				published++
+			}
+		}(eventJobs)
+
+		req, _ := http.NewRequest("PUT", "http://s3.example.com/photos/cat.jpg", nil)
+		resp := &http.Response{Header: http.Header{}, Request: req}
+		enqueueEvent(eventJob{resp: resp, eventType: event.ObjectCreatedPut})
+		enqueueEvent(eventJob{resp: resp, eventType: event.ObjectCreatedPut})
+
+		Convey("Draining should wait for the queued events to be published", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			So(DrainEvents(ctx), ShouldBeNil)
+			So(published, ShouldEqual, 2)
+
+			Convey("The events enqueued afterwards should be dropped", func() {
+				So(func() { enqueueEvent(eventJob{resp: resp, eventType: event.ObjectCreatedPut}) }, ShouldNotPanic)
+				So(DrainEvents(ctx), ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestWaitBackgroundTasks(t *testing.T) {
+	Convey("Given a running background task", t, func() {
+		release := make(chan struct{})
+		finished := false
+		goBackground(func() {
+			<-release
+			finished = true
+		})
+
+		Convey("Waiting should time out while the task runs", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			So(WaitBackgroundTasks(ctx), ShouldResemble, context.DeadlineExceeded)
+
+			close(release)
+			So(WaitBackgroundTasks(context.Background()), ShouldBeNil)
+			So(finished, ShouldBeTrue)
+		})
+	})
+}
+
+func TestObjectMetadata(t *testing.T) {
+	Convey("Given a put of an object with metadata", t, func() {
+		req, _ := http.NewRequest("PUT", "http://s3.example.com/photos/cat.jpg", nil)
+		req.Header.Set("Content-Type", "image/jpeg")
+		req.Header.Set("X-Amz-Meta-Camera", "x100")
+		resp := &http.Response{Header: http.Header{}, Request: req}
+
+		Convey("The metadata should round-trip into the marshaled event", func() {
+			contentType, userMetadata := objectMetadata(resp)
+			data, err := json.Marshal(event.Object{Key: "cat.jpg", ContentType: contentType, UserMetadata: userMetadata})
+			So(err, ShouldBeNil)
+			So(string(data), ShouldContainSubstring, `"contentType":"image/jpeg"`)
+			So(string(data), ShouldContainSubstring, `"userMetadata":{"x-amz-meta-camera":"x100"}`)
+		})
+
+		Convey("A copy should not take the content type of the request", func() {
+			req.Header.Set("X-Amz-Copy-Source", "/photos/dog.jpg")
+			contentType, _ := objectMetadata(resp)
+			So(contentType, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestConfigCache(t *testing.T) {
+	Convey("Given a config cache of two buckets", t, func() {
+		cache := newConfigCache(2, time.Minute)
+		cache.add("photos", models.Config{Bucket: "photos"}, true)
+		cache.add("videos", models.Config{}, false)
+
+		Convey("A cached missing config should be found", func() {
+			_, ok, found := cache.get("videos")
+			So(found, ShouldBeTrue)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("The least recently used bucket should be evicted", func() {
+			cache.get("photos")
+			cache.add("music", models.Config{Bucket: "music"}, true)
+			_, _, found := cache.get("videos")
+			So(found, ShouldBeFalse)
+			nConfig, ok, found := cache.get("photos")
+			So(found, ShouldBeTrue)
+			So(ok, ShouldBeTrue)
+			So(nConfig.Bucket, ShouldEqual, "photos")
+		})
+
+		Convey("A removed bucket should be loaded again", func() {
+			cache.remove("photos")
+			_, _, found := cache.get("photos")
+			So(found, ShouldBeFalse)
+		})
+
+		Convey("An expired entry should not be found", func() {
+			cache := newConfigCache(2, -time.Second)
+			cache.add("photos", models.Config{Bucket: "photos"}, true)
+			_, _, found := cache.get("photos")
+			So(found, ShouldBeFalse)
+		})
+	})
+}
+
+func TestUsersCache(t *testing.T) {
+	Convey("Given a users cache of two buckets", t, func() {
+		cache := newUsersCache(2, time.Minute)
+		cache.add("photos", []string{"tester"})
+
+		Convey("The cached users should be found", func() {
+			users, found := cache.get("photos")
+			So(found, ShouldBeTrue)
+			So(users, ShouldResemble, []string{"tester"})
+			_, found = cache.get("videos")
+			So(found, ShouldBeFalse)
+		})
+
+		Convey("A full cache should evict the least recently used bucket", func() {
+			cache.add("videos", []string{"tester"})
+			cache.get("photos")
+			cache.add("music", []string{"tester"})
+			So(cache.entries, ShouldNotContainKey, "videos")
+			So(cache.entries, ShouldContainKey, "photos")
+			So(cache.entries, ShouldContainKey, "music")
+		})
+
+		Convey("Concurrent lookups should be safe", func() {
+			done := make(chan bool)
+			for i := 0; i < 8; i++ {
+				go func() {
+					cache.add("photos", []string{"tester"})
+					cache.get("photos")
+					done <- true
+				}()
+			}
+			for i := 0; i < 8; i++ {
+				<-done
+			}
+			_, found := cache.get("photos")
+			So(found, ShouldBeTrue)
+		})
+
+		Convey("An expired entry should not be found", func() {
+			cache := newUsersCache(2, -time.Second)
+			cache.add("photos", []string{"tester"})
+			_, found := cache.get("photos")
+			So(found, ShouldBeFalse)
+		})
+	})
+}
+
+func TestObjectSize(t *testing.T) {
+	Convey("Given object write requests", t, func() {
+		Convey("A put should use the body length", func() {
+			req, _ := http.NewRequest("PUT", "/photos/cat.jpg", nil)
+			req.ContentLength = 2048
+			So(objectSize(req, event.ObjectCreatedPut), ShouldEqual, 2048)
+		})
+
+		Convey("A zero-byte put should be 0", func() {
+			req, _ := http.NewRequest("PUT", "/photos/empty", nil)
+			req.ContentLength = 0
+			So(objectSize(req, event.ObjectCreatedPut), ShouldEqual, 0)
+		})
+
+		Convey("A chunked upload should use the decoded length", func() {
+			req, _ := http.NewRequest("PUT", "/photos/cat.jpg", nil)
+			req.ContentLength = -1
+			req.Header.Set("X-Amz-Decoded-Content-Length", "66560")
+			So(objectSize(req, event.ObjectCreatedPut), ShouldEqual, 66560)
+		})
+
+		Convey("A chunked upload without a length should be looked up", func() {
+			req, _ := http.NewRequest("PUT", "/photos/cat.jpg", nil)
+			req.ContentLength = -1
+			So(objectSize(req, event.ObjectCreatedPut), ShouldEqual, unknownObjectSize)
+		})
+
+		Convey("A copy should be looked up instead of using its empty body", func() {
+			req, _ := http.NewRequest("PUT", "/photos/copy.jpg", nil)
+			req.ContentLength = 0
+			req.Header.Set("X-Amz-Copy-Source", "/photos/cat.jpg")
+			So(objectSize(req, event.ObjectCreatedCopy), ShouldEqual, unknownObjectSize)
+		})
+	})
+}
+
+func TestFindUnsupportedEvents(t *testing.T) {
+	Convey("Given notification configs", t, func() {
+		Convey("The emitted events and the wildcards covering them should be supported", func() {
+			data := []byte(`<NotificationConfiguration><QueueConfiguration><Event>s3:ObjectCreated:*</Event>` +
+				`<Event>s3:ObjectRemoved:Delete</Event></QueueConfiguration><TopicConfiguration>` +
+				`<Event>s3:ObjectCreated:Copy</Event></TopicConfiguration></NotificationConfiguration>`)
+			So(findUnsupportedEvents(data), ShouldBeEmpty)
+		})
+
+		Convey("The unknown and never emitted events should be returned once", func() {
+			data := []byte(`<NotificationConfiguration><QueueConfiguration><Event>s3:Replication:*</Event>` +
+				`<Event>s3:ObjectAccessed:*</Event><Event>s3:ObjectCreated:Post</Event></QueueConfiguration>` +
+				`<TopicConfiguration><Event>s3:Replication:*</Event></TopicConfiguration></NotificationConfiguration>`)
+			So(findUnsupportedEvents(data), ShouldResemble, []string{"s3:Replication:*", "s3:ObjectAccessed:*", "s3:ObjectCreated:Post"})
+		})
+	})
+}
+
+func TestDeleteEventName(t *testing.T) {
+	Convey("Given the DELETE responses of a versioned bucket", t, func() {
+		Convey("A delete marker should be reported as DeleteMarkerCreated", func() {
+			resp := &http.Response{Header: http.Header{
+				"X-Amz-Delete-Marker": []string{"true"},
+				"X-Amz-Version-Id":    []string{"marker-version"},
+			}}
+			So(deleteEventName(resp), ShouldEqual, models.ObjectRemovedDeleteMarkerCreated)
+		})
+
+		Convey("A version deleted for good should be reported as Delete", func() {
+			resp := &http.Response{Header: http.Header{"X-Amz-Version-Id": []string{"some-version"}}}
+			So(deleteEventName(resp), ShouldEqual, event.ObjectRemovedDelete)
+		})
+
+		Convey("The new event should be parsed and covered by the wildcard", func() {
+			name, err := models.ParseEventName("s3:ObjectRemoved:DeleteMarkerCreated")
+			So(err, ShouldBeNil)
+			So(models.EventNameString(name), ShouldEqual, "s3:ObjectRemoved:DeleteMarkerCreated")
+			So(models.ExpandEventName(event.ObjectRemovedAll), ShouldContain, models.ObjectRemovedDeleteMarkerCreated)
+			So(isEmittedEvent("s3:ObjectRemoved:DeleteMarkerCreated"), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,108 @@
+package controllers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/inwinstack/kaoliang/pkg/config"
+	"github.com/inwinstack/kaoliang/pkg/controllers"
+	"github.com/inwinstack/kaoliang/pkg/models"
+)
+
+func TestUnauthenticatedBucketNotification(t *testing.T) {
+	os.Setenv("AUTH_BACKEND", "CephBackend")
+	setup()
+	defer func() {
+		os.Unsetenv("AUTH_BACKEND")
+		config.SetServerConfig()
+	}()
+
+	Convey("Given a request without signature", t, func() {
+		body := `<NotificationConfiguration><QueueConfiguration><Id>1</Id>` +
+			`<Queue>arn:aws:sqs:us-east-1:tester:foo</Queue><Event>s3:ObjectCreated:*</Event>` +
+			`</QueueConfiguration></NotificationConfiguration>`
+
+		Convey("When putting the bucket notification", func() {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Params = gin.Params{{Key: "bucket", Value: "unauthenticated"}}
+			c.Request, _ = http.NewRequest("PUT", "/unauthenticated?notification", strings.NewReader(body))
+			controllers.PutBucketNotification(c)
+
+			Convey("The request should be rejected before saving the config", func() {
+				So(w.Code, ShouldNotEqual, http.StatusOK)
+
+				count := 0
+				models.GetDB().Model(&models.Config{}).Where("bucket = ?", "unauthenticated").Count(&count)
+				So(count, ShouldEqual, 0)
+			})
+		})
+
+		Convey("When getting the bucket notification", func() {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Params = gin.Params{{Key: "bucket", Value: "unauthenticated"}}
+			c.Request, _ = http.NewRequest("GET", "/unauthenticated?notification", nil)
+			controllers.GetBucketNotification(c)
+
+			Convey("The request should be rejected without reading the config", func() {
+				So(w.Code, ShouldNotEqual, http.StatusOK)
+				So(w.Body.String(), ShouldNotContainSubstring, "NotificationConfiguration")
+			})
+		})
+
+		Convey("When deleting the bucket notification", func() {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Params = gin.Params{{Key: "bucket", Value: "unauthenticated"}}
+			c.Request, _ = http.NewRequest("DELETE", "/unauthenticated?notification", nil)
+			controllers.DeleteBucketNotification(c)
+
+			Convey("The request should be rejected", func() {
+				So(w.Code, ShouldNotEqual, http.StatusNoContent)
+			})
+		})
+	})
+}
+
+func TestSendBucketTestEvent(t *testing.T) {
+	os.Setenv("AUTH_BACKEND", "CephBackend")
+	setup()
+	defer func() {
+		os.Unsetenv("AUTH_BACKEND")
+		config.SetServerConfig()
+	}()
+
+	Convey("Given the test event handler ahead of another handler", t, func() {
+		passed := false
+		r := gin.New()
+		r.NoRoute(controllers.SendBucketTestEvent, func(c *gin.Context) {
+			passed = true
+			c.Status(http.StatusNoContent)
+		})
+
+		Convey("The other requests should be passed on", func() {
+			for _, target := range []string{"/photos?notification", "/photos/key?notification&test", "/photos"} {
+				passed = false
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest("POST", target, nil)
+				r.ServeHTTP(w, req)
+				So(passed, ShouldBeTrue)
+			}
+		})
+
+		Convey("A test request without signature should be rejected", func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/photos?notification&test", nil)
+			r.ServeHTTP(w, req)
+			So(passed, ShouldBeFalse)
+			So(w.Code, ShouldNotEqual, http.StatusOK)
+		})
+	})
+}
@@ -15,17 +15,52 @@ import (
 	"github.com/minio/minio/cmd"
 )
 
+// OperationLog is a line of the ops log objects, one per proxied request of a
+// bucket. The json names are the field names of the opslog indices, so they
+// are kept as they are, typos included.
 type OperationLog struct {
-	Project      string `json:"project"`
-	ProjectId    string `json:"project_id"`
-	User         string `json:"user"`
-	Date         string `json:"date"`
-	Method       string `json:"method"`
-	StatusCode   string `json:"status_code"`
-	Bucket       string `json:"bucket"`
-	Uri          string `json:"uri"`
-	ByteSend     int    `json:"byte_sned"`
-	ByteRecieved int    `json:"byte_recieved"`
+	Project      string `json:"project"`       // display name of the user
+	ProjectId    string `json:"project_id"`    // uid of the user
+	User         string `json:"user"`          // subuser, empty for the user itself
+	Date         string `json:"date"`          // time of the request in RFC 3339
+	Method       string `json:"method"`        // http method of the operation
+	StatusCode   string `json:"status_code"`   // http status of the response
+	Bucket       string `json:"bucket"`        // bucket of the operation
+	Uri          string `json:"uri"`           // request uri
+	ByteSend     int    `json:"byte_sned"`     // bytes sent to the client
+	ByteRecieved int    `json:"byte_recieved"` // bytes received from the client
+}
+
+// Validate returns an error naming the first required field which is missing
+// or malformed.
+func (log OperationLog) Validate() error {
+	required := []struct {
+		name  string
+		value string
+	}{
+		{"project_id", log.ProjectId},
+		{"bucket", log.Bucket},
+		{"method", log.Method},
+		{"status_code", log.StatusCode},
+		{"date", log.Date},
+	}
+	for _, field := range required {
+		if field.value == "" {
+			return fmt.Errorf("The field %s is missing", field.name)
+		}
+	}
+
+	if _, err := strconv.Atoi(log.StatusCode); err != nil {
+		return fmt.Errorf("The status_code %s is not a number", log.StatusCode)
+	}
+	if _, err := time.Parse(time.RFC3339, log.Date); err != nil {
+		return fmt.Errorf("The date %s is not in RFC 3339", log.Date)
+	}
+	if log.ByteSend < 0 || log.ByteRecieved < 0 {
+		return fmt.Errorf("The byte counts can not be negative")
+	}
+
+	return nil
 }
 
 func toInteger(contentLength string) int {
@@ -45,13 +80,13 @@ func isExists(bucket string) bool {
 	}
 	output, err := sh.Command("radosgw-admin", "bucket", "list").Output()
 	if err != nil {
-		fmt.Println("Can not get bucket list", bucket)
+		utils.Error("Can not get bucket list", utils.Fields{"bucket": bucket, "error": err})
 		return false
 	}
 	var buckets []string
 	err = json.Unmarshal([]byte(output), &buckets)
 	if err != nil {
-		fmt.Println("Can not parse bucket list", bucket)
+		utils.Error("Can not parse bucket list", utils.Fields{"bucket": bucket, "error": err})
 		return false
 	}
 	for _, b := range buckets {
@@ -133,7 +168,7 @@ func LoggingOps(resp *http.Response) {
 	log := OperationLog{displayName, uid, subuser, date.Format(time.RFC3339), method, statusCode, bucket, resp.Request.RequestURI, byteSend, byteRecieved}
 	data, err := json.Marshal(log)
 	if err != nil {
-		fmt.Println("operation log can not be generated", uid)
+		utils.Error("Operation log can not be generated", utils.Fields{"uid": uid, "error": err})
 		return
 	}
 	data = append(data, "\n"...)
@@ -149,7 +184,7 @@ func LoggingOps(resp *http.Response) {
 	defer conn.Shutdown()
 	ioctx, err := conn.OpenIOContext(poolName)
 	if err != nil {
-		return	
+		return
 	}
 	defer ioctx.Destroy()
 
@@ -0,0 +1,33 @@
+package controllers
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestOperationLogValidate(t *testing.T) {
+	Convey("Given an operation log", t, func() {
+		log := OperationLog{
+			ProjectId:  "tester",
+			Bucket:     "photos",
+			Method:     "PUT",
+			StatusCode: "200",
+			Date:       "2018-05-26T10:00:00Z",
+		}
+
+		Convey("A complete log should be valid", func() {
+			So(log.Validate(), ShouldBeNil)
+		})
+
+		Convey("A log without a bucket should name the field", func() {
+			log.Bucket = ""
+			So(log.Validate().Error(), ShouldContainSubstring, "bucket")
+		})
+
+		Convey("A log with a malformed date should be invalid", func() {
+			log.Date = "Sat, 26 May 2018 10:00:00 GMT"
+			So(log.Validate(), ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,268 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/minio/minio/cmd"
+	"github.com/minio/minio/pkg/event"
+	"github.com/olivere/elastic"
+
+	"github.com/inwinstack/kaoliang/pkg/config"
+	"github.com/inwinstack/kaoliang/pkg/models"
+	"github.com/inwinstack/kaoliang/pkg/utils"
+)
+
+type ReplayEventsResponse struct {
+	Start      string `json:"start"`
+	End        string `json:"end"`
+	DryRun     bool   `json:"dry_run"`
+	Events     int    `json:"events"`
+	Deliveries int    `json:"deliveries"`
+	Failed     int    `json:"failed"`
+}
+
+// opsLogEvent maps an operation log to the event it has generated, only the
+// successful object writes and deletes are mapped, the subresource requests
+// are skipped like ReverseProxy does. A copy can not be told from a put in
+// the operation log, so both are replayed as a put.
+func opsLogEvent(log OperationLog) (objectName string, eventType event.Name, ok bool) {
+	if !strings.HasPrefix(log.StatusCode, "2") {
+		return "", 0, false
+	}
+
+	uri, err := url.Parse(log.Uri)
+	if err != nil {
+		return "", 0, false
+	}
+
+	// the uri of a path-style request starts with the bucket
+	objectName = strings.TrimPrefix(uri.Path, "/")
+	if strings.HasPrefix(objectName, log.Bucket+"/") {
+		objectName = strings.TrimPrefix(objectName, log.Bucket+"/")
+	}
+	if objectName == "" || objectName == log.Bucket {
+		return "", 0, false
+	}
+
+	query := uri.Query()
+	if isSubresourceRequest(query) {
+		return "", 0, false
+	}
+	multipart := len(query["uploadId"]) != 0
+	switch {
+	case log.Method == "PUT" && !multipart:
+		return objectName, event.ObjectCreatedPut, true
+	case log.Method == "POST" && multipart:
+		return objectName, event.ObjectCreatedCompleteMultipartUpload, true
+	case log.Method == "DELETE" && !multipart:
+		return objectName, event.ObjectRemovedDelete, true
+	default:
+		return "", 0, false
+	}
+}
+
+// ReplayEvents re-delivers the events of the operation logs indexed in
+// EVENT_REPLAY_INDEX between start and end, which default to the last
+// EVENT_REPLAY_WINDOW. It is meant to recover the consumers after an outage,
+// with dry-run=true only the events which would be delivered are counted.
+func ReplayEvents(c *gin.Context) {
+	userID, errCode := authenticate(c.Request)
+	if errCode != cmd.ErrNone {
+		writeErrorResponse(c, errCode)
+		return
+	}
+
+	tokens := strings.Split(userID, ":")
+	if len(tokens) > 1 {
+		userID = tokens[0]
+	}
+
+	if !isAdmin(userID) {
+		writeErrorResponse(c, cmd.ErrAccessDenied)
+		return
+	}
+
+	window, err := time.ParseDuration(c.DefaultQuery("window", utils.GetEnv("EVENT_REPLAY_WINDOW", "1h")))
+	if err != nil || window <= 0 {
+		writeErrorResponse(c, cmd.ErrInvalidQueryParams)
+		return
+	}
+
+	end := time.Now().UTC()
+	if c.Query("end") != "" {
+		if end, err = time.Parse(time.RFC3339, c.Query("end")); err != nil {
+			writeErrorResponse(c, cmd.ErrInvalidQueryParams)
+			return
+		}
+	}
+	start := end.Add(-window)
+	if c.Query("start") != "" {
+		if start, err = time.Parse(time.RFC3339, c.Query("start")); err != nil {
+			writeErrorResponse(c, cmd.ErrInvalidQueryParams)
+			return
+		}
+	}
+	if !start.Before(end) {
+		writeErrorResponse(c, cmd.ErrInvalidQueryParams)
+		return
+	}
+
+	maxEvents := utils.GetEnvPositiveInt("EVENT_REPLAY_MAX", 10000)
+
+	client, err := models.NewElasticsearch()
+	if err != nil {
+		writeErrorResponse(c, cmd.ErrInternalError)
+		return
+	}
+
+	dateQuery := elastic.NewRangeQuery("date").
+		Gte(start.Format(time.RFC3339)).
+		Lte(end.Format(time.RFC3339))
+	query := elastic.NewBoolQuery().Filter(dateQuery)
+	if bucket := c.Query("bucket"); bucket != "" {
+		query = query.Filter(elastic.NewTermQuery("bucket", bucket))
+	}
+
+	// every page is fetched within SEARCH_TIMEOUT, so a hung node does not
+	// hold the request
+	timeout := utils.GetEnvDuration("SEARCH_TIMEOUT", 5*time.Second)
+	ctx := context.Background()
+	scroll := client.Scroll(utils.GetEnv("EVENT_REPLAY_INDEX", "opslog-*")).
+		Type("log").
+		Query(query).
+		Sort("date", true).
+		Size(500)
+	defer scroll.Clear(ctx)
+
+	respBody := ReplayEventsResponse{
+		Start:  start.Format(time.RFC3339),
+		End:    end.Format(time.RFC3339),
+		DryRun: c.Query("dry-run") == "true",
+	}
+	serverConfig := config.GetServerConfig()
+	rulesMaps := map[string]models.RulesMap{}
+
+	for respBody.Events < maxEvents {
+		pageCtx, cancel := context.WithTimeout(ctx, timeout)
+		result, err := scroll.Do(pageCtx)
+		timedOut := pageCtx.Err() == context.DeadlineExceeded
+		cancel()
+		if err == io.EOF {
+			break
+		}
+		if err != nil && timedOut {
+			utils.Error("Can not scroll ops logs in time", utils.Fields{"timeout": timeout, "events": respBody.Events, "error": err})
+			c.XML(http.StatusGatewayTimeout, makeErrorResponse(c, cmd.APIError{
+				Code:           "GatewayTimeout",
+				Description:    "The ops logs are not fetched in time. Please try again.",
+				HTTPStatusCode: http.StatusGatewayTimeout,
+			}))
+			return
+		}
+		if err != nil {
+			writeErrorResponse(c, cmd.ErrInternalError)
+			return
+		}
+
+		for _, hit := range result.Hits.Hits {
+			var log OperationLog
+			if err := json.Unmarshal(*hit.Source, &log); err != nil {
+				continue
+			}
+
+			objectName, eventType, ok := opsLogEvent(log)
+			if !ok {
+				continue
+			}
+
+			if _, ok := rulesMaps[log.Bucket]; !ok {
+				nConfig, _ := loadNotificationConfig(log.Bucket)
+				rulesMaps[log.Bucket] = nConfig.ToRulesMap()
+			}
+			resources := rulesMaps[log.Bucket][eventType].Match(objectName)
+			if len(resources) == 0 {
+				continue
+			}
+
+			respBody.Events++
+			eventTime, err := time.Parse(time.RFC3339, log.Date)
+			if err != nil {
+				eventTime = time.Now()
+			}
+			eventTime = eventTime.UTC()
+
+			for _, resource := range resources {
+				respBody.Deliveries++
+				if respBody.DryRun {
+					continue
+				}
+
+				newEvent := event.Event{
+					EventVersion: "2.0",
+					EventSource:  "aws:s3",
+					AwsRegion:    serverConfig.Region,
+					EventTime:    eventTime.Format("2006-01-02T15:04:05Z"),
+					EventName:    eventType,
+					UserIdentity: event.Identity{
+						PrincipalID: log.ProjectId,
+					},
+					RequestParameters: map[string]string{
+						"sourceIPAddress": "",
+					},
+					ResponseElements: map[string]string{
+						"x-amz-request-id": "",
+					},
+					S3: event.Metadata{
+						SchemaVersion:   "1.0",
+						ConfigurationID: "Config",
+						Bucket: event.Bucket{
+							Name: log.Bucket,
+							OwnerIdentity: event.Identity{
+								PrincipalID: "",
+							},
+							ARN: resource.ARN(),
+						},
+						Object: event.Object{
+							Key:       objectName,
+							Size:      int64(log.ByteRecieved),
+							Sequencer: fmt.Sprintf("%X", eventTime.UnixNano()),
+						},
+					},
+				}
+
+				if err := deliverEvent(resource, newEvent); err != nil {
+					utils.Error("Can not replay event", utils.Fields{"target": resource.ARN(), "error": err})
+					respBody.Failed++
+				}
+			}
+
+			if respBody.Events >= maxEvents {
+				break
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, respBody)
+}
@@ -0,0 +1,53 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/minio/minio/pkg/event"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestOpsLogEvent(t *testing.T) {
+	Convey("Given operation logs of a bucket", t, func() {
+		log := OperationLog{Bucket: "photos", StatusCode: "200"}
+
+		Convey("A put of an object should be replayed as ObjectCreated:Put", func() {
+			log.Method, log.Uri = "PUT", "/photos/2018/cat%20a.jpg"
+			objectName, eventType, ok := opsLogEvent(log)
+			So(ok, ShouldBeTrue)
+			So(objectName, ShouldEqual, "2018/cat a.jpg")
+			So(eventType, ShouldEqual, event.ObjectCreatedPut)
+		})
+
+		Convey("A completed multipart upload should be replayed", func() {
+			log.Method, log.Uri = "POST", "/photos/video.mp4?uploadId=2~abc"
+			objectName, eventType, ok := opsLogEvent(log)
+			So(ok, ShouldBeTrue)
+			So(objectName, ShouldEqual, "video.mp4")
+			So(eventType, ShouldEqual, event.ObjectCreatedCompleteMultipartUpload)
+		})
+
+		Convey("A delete should be replayed as ObjectRemoved:Delete", func() {
+			log.Method, log.Uri, log.StatusCode = "DELETE", "/photos/cat.jpg", "204"
+			_, eventType, ok := opsLogEvent(log)
+			So(ok, ShouldBeTrue)
+			So(eventType, ShouldEqual, event.ObjectRemovedDelete)
+		})
+
+		Convey("Parts, subresources, bucket operations and failures should be skipped", func() {
+			for _, l := range []OperationLog{
+				{Bucket: "photos", Method: "PUT", StatusCode: "200", Uri: "/photos/video.mp4?partNumber=1&uploadId=2~abc"},
+				{Bucket: "photos", Method: "PUT", StatusCode: "200", Uri: "/photos"},
+				{Bucket: "photos", Method: "PUT", StatusCode: "200", Uri: "/photos/cat.jpg?acl"},
+				{Bucket: "photos", Method: "DELETE", StatusCode: "204", Uri: "/photos/cat.jpg?tagging"},
+				{Bucket: "photos", Method: "PUT", StatusCode: "200", Uri: "/photos/cat.jpg?retention"},
+				{Bucket: "photos", Method: "PUT", StatusCode: "200", Uri: "/photos/?lifecycle"},
+				{Bucket: "photos", Method: "PUT", StatusCode: "403", Uri: "/photos/cat.jpg"},
+				{Bucket: "photos", Method: "GET", StatusCode: "200", Uri: "/photos/cat.jpg"},
+			} {
+				_, _, ok := opsLogEvent(l)
+				So(ok, ShouldBeFalse)
+			}
+		})
+	})
+}
@@ -16,9 +16,11 @@ package controllers
 
 import (
 	"encoding/xml"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/minio/minio/cmd"
+	"github.com/satori/go.uuid"
 )
 
 type ListQueuesResponse struct {
@@ -108,6 +110,32 @@ type UnsubscribeResponse struct {
 
 func writeErrorResponse(c *gin.Context, errorCode cmd.APIErrorCode) {
 	apiError := cmd.GetAPIError(errorCode)
-	errorResponse := cmd.GetAPIErrorResponse(apiError, c.Request.URL.Path)
-	c.XML(apiError.HTTPStatusCode, errorResponse)
+	c.XML(apiError.HTTPStatusCode, makeErrorResponse(c, apiError))
+}
+
+// writeErrorMessageResponse writes the error with a description telling which
+// part of the request failed.
+func writeErrorMessageResponse(c *gin.Context, errorCode cmd.APIErrorCode, message string) {
+	apiError := cmd.GetAPIError(errorCode)
+	apiError.Description = message
+	c.XML(apiError.HTTPStatusCode, makeErrorResponse(c, apiError))
+}
+
+// makeErrorResponse makes the S3 error document of the request. The request id
+// is generated and returned in X-Amz-Request-Id too, unless one was already
+// set on the response.
+func makeErrorResponse(c *gin.Context, apiError cmd.APIError) cmd.APIErrorResponse {
+	requestID := c.Writer.Header().Get("X-Amz-Request-Id")
+	if requestID == "" {
+		id, _ := uuid.NewV4()
+		requestID = id.String()
+		c.Header("X-Amz-Request-Id", requestID)
+	}
+
+	response := cmd.GetAPIErrorResponse(apiError, c.Request.URL.Path)
+	response.BucketName = c.Param("bucket")
+	response.Key = strings.TrimPrefix(c.Param("object"), "/")
+	response.RequestID = requestID
+	response.HostID = ""
+	return response
 }
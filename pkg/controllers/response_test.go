@@ -0,0 +1,36 @@
+package controllers
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/minio/minio/cmd"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWriteErrorResponse(t *testing.T) {
+	Convey("Given a request to a bucket failing with an S3 error", t, func() {
+		r := gin.New()
+		r.GET("/:bucket", func(c *gin.Context) {
+			writeErrorResponse(c, cmd.ErrNoSuchBucket)
+		})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/photos", nil)
+		r.ServeHTTP(w, req)
+
+		Convey("The error should be an S3 error document with a request id", func() {
+			var body cmd.APIErrorResponse
+			So(xml.Unmarshal(w.Body.Bytes(), &body), ShouldBeNil)
+			So(w.Code, ShouldEqual, http.StatusNotFound)
+			So(body.Code, ShouldEqual, "NoSuchBucket")
+			So(body.Message, ShouldNotBeEmpty)
+			So(body.Resource, ShouldEqual, "/photos")
+			So(body.BucketName, ShouldEqual, "photos")
+			So(body.RequestID, ShouldNotBeEmpty)
+			So(w.Header().Get("X-Amz-Request-Id"), ShouldEqual, body.RequestID)
+		})
+	})
+}
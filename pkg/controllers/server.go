@@ -0,0 +1,68 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/inwinstack/kaoliang/pkg/utils"
+)
+
+// RunServer serves the handler on PORT like gin does until SIGINT or
+// SIGTERM. On a signal the server stops accepting connections, waits for the
+// active requests, then for the queued events to be published and the
+// webhook deliveries and log writes to finish, all within SHUTDOWN_TIMEOUT.
+// The error of the listener is returned.
+func RunServer(handler http.Handler) error {
+	server := &http.Server{
+		Addr:    ":" + utils.GetEnv("PORT", "8080"),
+		Handler: handler,
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		utils.Info("Shutting down, draining the requests and events", utils.Fields{"signal": sig})
+	}
+
+	timeout := utils.GetEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		utils.Error("Can not drain the active requests", utils.Fields{"timeout": timeout, "error": err})
+	}
+	if err := DrainEvents(ctx); err != nil {
+		utils.Error("Can not drain the queued events", utils.Fields{"timeout": timeout, "error": err})
+	}
+	if err := WaitBackgroundTasks(ctx); err != nil {
+		utils.Error("Can not finish the webhook deliveries and log writes", utils.Fields{"timeout": timeout, "error": err})
+	}
+
+	return nil
+}
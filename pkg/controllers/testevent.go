@@ -0,0 +1,167 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocelery/gocelery"
+	"github.com/minio/minio/cmd"
+	"github.com/satori/go.uuid"
+
+	"github.com/inwinstack/kaoliang/pkg/models"
+)
+
+// TestEvent is the s3:TestEvent message S3 sends to a target when the
+// notification config is set.
+type TestEvent struct {
+	Service   string `json:"Service"`
+	Event     string `json:"Event"`
+	Time      string `json:"Time"`
+	Bucket    string `json:"Bucket"`
+	RequestID string `json:"RequestId"`
+	HostID    string `json:"HostId"`
+}
+
+type TestTargetResult struct {
+	ARN      string `json:"arn"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Success  bool   `json:"success"`
+	Error    string `json:"error,omitempty"`
+}
+
+type TestEventResponse struct {
+	Bucket    string             `json:"bucket"`
+	RequestID string             `json:"request_id"`
+	Targets   []TestTargetResult `json:"targets"`
+}
+
+// SendBucketTestEvent handles POST /<bucket>?notification&test, which
+// publishes a s3:TestEvent to every target of the saved notification config
+// of the bucket and reports the result of each one. The route can not be
+// registered next to POST /objects, so it runs ahead of the proxy in NoRoute
+// and passes the other requests on.
+func SendBucketTestEvent(c *gin.Context) {
+	query := c.Request.URL.Query()
+	bucket := strings.Trim(c.Request.URL.Path, "/")
+	if _, ok := query["notification"]; !ok || c.Request.Method != "POST" || bucket == "" || strings.Contains(bucket, "/") {
+		return
+	}
+	if _, ok := query["test"]; !ok {
+		return
+	}
+	defer c.Abort()
+
+	userID, errCode := authenticate(c.Request)
+	if errCode != cmd.ErrNone {
+		writeErrorResponse(c, errCode)
+		return
+	}
+
+	tokens := strings.Split(userID, ":")
+	if len(tokens) > 1 {
+		userID = tokens[0]
+	}
+
+	users, ok := getBucketUsers(bucket)
+	if !ok {
+		writeErrorResponse(c, cmd.ErrNoSuchBucket)
+		return
+	}
+
+	if !contains(users, userID) {
+		writeErrorResponse(c, cmd.ErrAccessDenied)
+		return
+	}
+
+	nConfig, ok := loadNotificationConfig(bucket)
+	if !ok {
+		writeErrorMessageResponse(c, cmd.ErrARNNotification, "The bucket has no notification config")
+		return
+	}
+
+	requestID, _ := uuid.NewV4()
+	respBody := TestEventResponse{
+		Bucket:    bucket,
+		RequestID: requestID.String(),
+		Targets:   []TestTargetResult{},
+	}
+	value, _ := json.Marshal(TestEvent{
+		Service:   "Amazon S3",
+		Event:     "s3:TestEvent",
+		Time:      time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+		Bucket:    bucket,
+		RequestID: respBody.RequestID,
+	})
+
+	// the targets are tested on the path of deliverEvent, the targets in
+	// KAFKA_TOPICS are produced to Kafka
+	for _, queue := range nConfig.Queues {
+		result := TestTargetResult{ARN: queue.Resource.ARN()}
+		if ok, err := models.SendKafkaValue(queue.Resource, bucket+"/", value); ok {
+			setTestResult(&result, err)
+		} else {
+			setTestResult(&result, models.PushEvent(queue.Resource, value))
+		}
+		respBody.Targets = append(respBody.Targets, result)
+	}
+	for _, topic := range nConfig.Topics {
+		if ok, err := models.SendKafkaValue(topic.Resource, bucket+"/", value); ok {
+			result := TestTargetResult{ARN: topic.Resource.ARN()}
+			setTestResult(&result, err)
+			respBody.Targets = append(respBody.Targets, result)
+			continue
+		}
+		respBody.Targets = append(respBody.Targets, publishTestEvent(topic.Resource, value)...)
+	}
+
+	c.JSON(http.StatusOK, respBody)
+}
+
+// publishTestEvent sends the test event to each endpoint of the topic without
+// retrying, so a failing endpoint is reported at once.
+func publishTestEvent(resource models.Resource, value []byte) []TestTargetResult {
+	results := []TestTargetResult{}
+	if len(resource.Endpoints) == 0 {
+		return append(results, TestTargetResult{ARN: resource.ARN(), Error: "The topic has no subscriptions"})
+	}
+
+	celeryBroker, celeryBackend := models.GetCelery()
+	for _, endpoint := range resource.Endpoints {
+		result := TestTargetResult{ARN: resource.ARN(), Endpoint: endpoint.URI}
+		if endpoint.Protocol == models.WebhookProtocol {
+			setTestResult(&result, models.PostWebhook(endpoint.URI, value))
+		} else if celeryClient, err := gocelery.NewCeleryClient(celeryBroker, celeryBackend, 0); err != nil {
+			setTestResult(&result, err)
+		} else {
+			_, err := celeryClient.Delay("worker.send_event", endpoint.URI, string(value))
+			setTestResult(&result, err)
+		}
+		results = append(results, result)
+	}
+
+	return results
+}
+
+func setTestResult(result *TestTargetResult, err error) {
+	result.Success = err == nil
+	if err != nil {
+		result.Error = err.Error()
+	}
+}
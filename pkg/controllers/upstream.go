@@ -0,0 +1,212 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/inwinstack/kaoliang/pkg/utils"
+)
+
+// upstream is RGW behind kaoliang, target is TARGET_HOST and transport its
+// transport from TARGET_TLS_SKIP_VERIFY and TARGET_CA_CERT.
+type upstream struct {
+	target    *url.URL
+	transport http.RoundTripper
+}
+
+var (
+	rgwUpstream       upstream
+	rgwUpstreamErr    error
+	rgwUpstreamLoaded sync.Once
+)
+
+// loadUpstream parses the upstream settings once, the proxy and the S3
+// client of RGW share the target and the transport.
+func loadUpstream() (upstream, error) {
+	rgwUpstreamLoaded.Do(func() {
+		rgwUpstream.target, rgwUpstreamErr = parseUpstream(utils.GetEnv("TARGET_HOST", "127.0.0.1"))
+		if rgwUpstreamErr != nil {
+			return
+		}
+		rgwUpstream.transport, rgwUpstreamErr = upstreamTransport(utils.GetEnvBool("TARGET_TLS_SKIP_VERIFY", false), utils.GetEnv("TARGET_CA_CERT", ""))
+	})
+
+	return rgwUpstream, rgwUpstreamErr
+}
+
+// parseUpstream parses TARGET_HOST, a URL with an optional base path such as
+// https://rgw.example.com/s3. A bare host is served over http, which keeps
+// the host-only values working.
+func parseUpstream(value string) (*url.URL, error) {
+	if !strings.Contains(value, "://") {
+		value = "http://" + value
+	}
+
+	target, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, errors.New("The scheme of the target host should be http or https")
+	}
+	if target.Host == "" {
+		return nil, errors.New("The target host should not be empty")
+	}
+	target.Path = strings.TrimSuffix(target.Path, "/")
+	target.RawPath = ""
+
+	return target, nil
+}
+
+// upstreamTransport returns the transport to RGW, the nil transport is the
+// default one. caCert is a PEM file of the CAs trusted for the RGW
+// certificate, skipVerify turns the verification off.
+func upstreamTransport(skipVerify bool, caCert string) (http.RoundTripper, error) {
+	if !skipVerify && caCert == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: skipVerify}
+	if caCert != "" {
+		pem, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificate is found in " + caCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}, nil
+}
+
+// withBasePath prefixes the path of the URL by the base path of the target.
+func withBasePath(u *url.URL, basePath string) {
+	if basePath == "" {
+		return
+	}
+	if u.RawPath != "" {
+		u.RawPath = (&url.URL{Path: basePath}).EscapedPath() + u.RawPath
+	}
+	u.Path = basePath + u.Path
+}
+
+// withoutBasePath returns the request as the client sent it, without the
+// base path of the target, for the handlers parsing the bucket and object
+// from the path.
+func withoutBasePath(req *http.Request, basePath string) *http.Request {
+	if basePath == "" || !strings.HasPrefix(req.URL.Path, basePath) {
+		return req
+	}
+
+	clientReq := *req
+	u := *req.URL
+	u.Path = strings.TrimPrefix(u.Path, basePath)
+	if u.RawPath != "" {
+		u.RawPath = strings.TrimPrefix(u.RawPath, (&url.URL{Path: basePath}).EscapedPath())
+	}
+	clientReq.URL = &u
+
+	return &clientReq
+}
+
+// isTrustedProxy returns whether the ip is one of the trusted proxies.
+func isTrustedProxy(ip string, trusted []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, proxy := range trusted {
+		if proxy.Contains(parsed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// remoteIP returns the IP of the peer of the request.
+func remoteIP(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return ip
+}
+
+// setForwardedHeaders sets the X-Forwarded-* headers of the proxied request.
+// The headers sent by a peer which is not a trusted proxy are replaced so
+// they can not be spoofed, the peer is appended to X-Forwarded-For by the
+// reverse proxy.
+func setForwardedHeaders(req *http.Request, trusted []*net.IPNet) {
+	if !isTrustedProxy(remoteIP(req), trusted) {
+		req.Header.Del("X-Forwarded-For")
+		req.Header.Del("X-Forwarded-Proto")
+		req.Header.Del("X-Forwarded-Host")
+	}
+
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		proto := "http"
+		if req.TLS != nil {
+			proto = "https"
+		}
+		req.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+}
+
+// clientIP returns the IP of the client of the request. The X-Forwarded-For
+// chain is walked from the peer back while the hops are trusted proxies, the
+// first hop which is not trusted is the client.
+func clientIP(req *http.Request, trusted []*net.IPNet) string {
+	chain := []string{}
+	for _, value := range req.Header["X-Forwarded-For"] {
+		for _, ip := range strings.Split(value, ",") {
+			if ip = strings.TrimSpace(ip); ip != "" {
+				chain = append(chain, ip)
+			}
+		}
+	}
+	// the chain of a proxied request already ends with the peer
+	peer := remoteIP(req)
+	if len(chain) == 0 || chain[len(chain)-1] != peer {
+		chain = append(chain, peer)
+	}
+
+	for i := len(chain) - 1; i > 0; i-- {
+		if !isTrustedProxy(chain[i], trusted) {
+			return chain[i]
+		}
+	}
+
+	return chain[0]
+}
@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseUpstream(t *testing.T) {
+	Convey("Given TARGET_HOST values", t, func() {
+		Convey("A bare host should be served over http", func() {
+			target, err := parseUpstream("127.0.0.1:7480")
+			So(err, ShouldBeNil)
+			So(target.Scheme, ShouldEqual, "http")
+			So(target.Host, ShouldEqual, "127.0.0.1:7480")
+			So(target.Path, ShouldEqual, "")
+		})
+
+		Convey("A URL should keep its scheme and base path", func() {
+			target, err := parseUpstream("https://rgw.example.com/s3/")
+			So(err, ShouldBeNil)
+			So(target.Scheme, ShouldEqual, "https")
+			So(target.Host, ShouldEqual, "rgw.example.com")
+			So(target.Path, ShouldEqual, "/s3")
+		})
+
+		Convey("Other schemes should be rejected", func() {
+			_, err := parseUpstream("ftp://rgw.example.com")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestBasePath(t *testing.T) {
+	Convey("Given a target with a base path", t, func() {
+		req, _ := http.NewRequest("PUT", "http://s3.example.com/photos/a%2Fb.jpg", nil)
+
+		Convey("The base path should be prepended to the proxied request", func() {
+			withBasePath(req.URL, "/s3")
+			So(req.URL.Path, ShouldEqual, "/s3/photos/a/b.jpg")
+			So(req.URL.EscapedPath(), ShouldEqual, "/s3/photos/a%2Fb.jpg")
+
+			Convey("The client path should be restored for the events", func() {
+				clientReq := withoutBasePath(req, "/s3")
+				So(clientReq.URL.Path, ShouldEqual, "/photos/a/b.jpg")
+				So(clientReq.URL.EscapedPath(), ShouldEqual, "/photos/a%2Fb.jpg")
+				So(req.URL.Path, ShouldEqual, "/s3/photos/a/b.jpg")
+			})
+		})
+
+		Convey("No base path should leave the request as is", func() {
+			withBasePath(req.URL, "")
+			So(withoutBasePath(req, ""), ShouldEqual, req)
+			So(req.URL.Path, ShouldEqual, "/photos/a/b.jpg")
+		})
+	})
+}
+
+func TestUpstreamTransport(t *testing.T) {
+	Convey("Given the TLS options of the target", t, func() {
+		Convey("No options should use the default transport", func() {
+			transport, err := upstreamTransport(false, "")
+			So(err, ShouldBeNil)
+			So(transport, ShouldBeNil)
+		})
+
+		Convey("Skip verify should turn the verification off", func() {
+			transport, err := upstreamTransport(true, "")
+			So(err, ShouldBeNil)
+			So(transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify, ShouldBeTrue)
+		})
+
+		Convey("A missing CA file should be an error", func() {
+			_, err := upstreamTransport(false, "/nonexistent/ca.pem")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	Convey("Given a trusted proxy network", t, func() {
+		_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+		trusted := []*net.IPNet{proxies}
+		req, _ := http.NewRequest("PUT", "http://s3.example.com/photos/cat.jpg", nil)
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		req.Header.Set("X-Forwarded-Proto", "https")
+
+		Convey("The headers of a trusted proxy should be kept", func() {
+			req.RemoteAddr = "10.0.0.2:41234"
+			setForwardedHeaders(req, trusted)
+			So(req.Header.Get("X-Forwarded-For"), ShouldEqual, "203.0.113.7")
+			So(req.Header.Get("X-Forwarded-Proto"), ShouldEqual, "https")
+			So(req.Header.Get("X-Forwarded-Host"), ShouldEqual, "s3.example.com")
+
+			Convey("The client behind the proxy should be the source IP", func() {
+				req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.2")
+				So(clientIP(req, trusted), ShouldEqual, "203.0.113.7")
+			})
+		})
+
+		Convey("The headers of an untrusted client should be replaced", func() {
+			req.RemoteAddr = "198.51.100.3:41234"
+			setForwardedHeaders(req, trusted)
+			So(req.Header.Get("X-Forwarded-For"), ShouldEqual, "")
+			So(req.Header.Get("X-Forwarded-Proto"), ShouldEqual, "http")
+
+			Convey("The peer should be the source IP", func() {
+				req.Header.Set("X-Forwarded-For", "203.0.113.7, 198.51.100.3")
+				So(clientIP(req, trusted), ShouldEqual, "198.51.100.3")
+				req.Header.Del("X-Forwarded-For")
+				So(clientIP(req, trusted), ShouldEqual, "198.51.100.3")
+			})
+		})
+	})
+}
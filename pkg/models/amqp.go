@@ -0,0 +1,110 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package models
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// AMQPPublisher publishes the marshalled events to an AMQP exchange. The
+// connection is dialed on the first publish and again after it is closed.
+type AMQPPublisher struct {
+	url        string
+	exchange   string
+	routingKey string
+
+	lock sync.Mutex
+	conn *amqp.Connection
+}
+
+// NewAMQPPublisher - creates a publisher of the exchange on the broker url,
+// an empty exchange publishes to the queue named by the routing key.
+func NewAMQPPublisher(url string, exchange string, routingKey string) *AMQPPublisher {
+	return &AMQPPublisher{url: url, exchange: exchange, routingKey: routingKey}
+}
+
+func (p *AMQPPublisher) channel() (*amqp.Channel, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.conn != nil {
+		ch, err := p.conn.Channel()
+		if err == nil {
+			return ch, nil
+		}
+		p.conn.Close()
+		p.conn = nil
+	}
+
+	conn, err := amqp.Dial(p.url)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p.conn = conn
+
+	return ch, nil
+}
+
+// Publish - publishes the event as a persistent message and waits for the
+// broker to confirm it.
+func (p *AMQPPublisher) Publish(value []byte) error {
+	ch, err := p.channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	if err := ch.Confirm(false); err != nil {
+		return err
+	}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	err = ch.Publish(p.exchange, p.routingKey, false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Body:         value,
+	})
+	if err != nil {
+		return err
+	}
+
+	if confirm, ok := <-confirms; !ok || !confirm.Ack {
+		return fmt.Errorf("The AMQP broker did not confirm the event to %s", p.exchange)
+	}
+
+	return nil
+}
+
+// Close - closes the connection of the publisher.
+func (p *AMQPPublisher) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.conn == nil {
+		return nil
+	}
+	err := p.conn.Close()
+	p.conn = nil
+
+	return err
+}
@@ -15,21 +15,308 @@ Licensed under the Apache License, Version 2.0 (the "License");
 package models
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/go-redis/redis"
 
+	"github.com/inwinstack/kaoliang/pkg/config"
 	"github.com/inwinstack/kaoliang/pkg/utils"
 )
 
-var client *redis.Client
+var ErrEventQueueFull = errors.New("The event queue of the target is full")
+
+// Modes of the Redis deployment behind REDIS_MODE.
+const (
+	RedisModeSingle   = "single"
+	RedisModeSentinel = "sentinel"
+	RedisModeCluster  = "cluster"
+)
+
+var client redis.UniversalClient
 
+// SetCache connects to the Redis of REDIS_MODE. In sentinel mode the master
+// REDIS_MASTER_NAME is looked up on the comma separated REDIS_SENTINEL_ADDRS,
+// in cluster mode the cluster is discovered from the comma separated
+// REDIS_CLUSTER_ADDRS. Any other mode connects to the single node REDIS_ADDR.
 func SetCache() {
-	client = redis.NewClient(&redis.Options{
-		Addr:     utils.GetEnv("REDIS_ADDR", "localhost:6789"),
-		Password: utils.GetEnv("REDIS_PASSWORD", ""),
-		DB:       0,
-	})
+	client = newCacheClient(utils.GetEnv("REDIS_MODE", RedisModeSingle))
+}
+
+func newCacheClient(mode string) redis.UniversalClient {
+	password := utils.GetEnv("REDIS_PASSWORD", "")
+	// bounds the dial and every command, so a slow Redis does not hold the
+	// requests waiting on it
+	timeout := utils.GetEnvDuration("REDIS_TIMEOUT", 3*time.Second)
+
+	switch mode {
+	case RedisModeSentinel:
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    utils.GetEnv("REDIS_MASTER_NAME", "mymaster"),
+			SentinelAddrs: splitAddrs(utils.GetEnv("REDIS_SENTINEL_ADDRS", "localhost:26379")),
+			Password:      password,
+			DB:            0,
+			DialTimeout:   timeout,
+			ReadTimeout:   timeout,
+			WriteTimeout:  timeout,
+		})
+	case RedisModeCluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        splitAddrs(utils.GetEnv("REDIS_CLUSTER_ADDRS", "localhost:7000")),
+			Password:     password,
+			DialTimeout:  timeout,
+			ReadTimeout:  timeout,
+			WriteTimeout: timeout,
+		})
+	default:
+		return redis.NewClient(&redis.Options{
+			Addr:         utils.GetEnv("REDIS_ADDR", "localhost:6789"),
+			Password:     password,
+			DB:           0,
+			DialTimeout:  timeout,
+			ReadTimeout:  timeout,
+			WriteTimeout: timeout,
+		})
+	}
+}
+
+// splitAddrs splits a comma separated list of host:port, blank items are
+// dropped.
+func splitAddrs(value string) []string {
+	addrs := []string{}
+	for _, addr := range strings.Split(value, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs
 }
 
-func GetCache() *redis.Client {
+// GetCache returns the client of SetCache, the commands of the single node,
+// sentinel and cluster clients are all available on redis.UniversalClient.
+func GetCache() redis.UniversalClient {
 	return client
 }
+
+// QueueKey - returns the key of the event list of the resource.
+func (r Resource) QueueKey() string {
+	return fmt.Sprintf("%s:%s:%s", r.Service.String(), r.AccountID, r.Name)
+}
+
+// PushEvent - pushes the event to the list of the resource. When the target
+// has a limit in EVENT_QUEUE_LIMITS and its list is full, the overflow policy
+// drops the oldest event, rejects the new one or moves it to the dead-letter
+// list of the target.
+func PushEvent(resource Resource, value []byte) error {
+	return PushEvents([]Resource{resource}, [][]byte{value})[0]
+}
+
+// PushEvents pushes the value of every resource to its list in one
+// transaction, so either all the lists get the event or none of them. A
+// transaction of Redis Cluster can not span the slots of the lists, so in
+// cluster mode every target is pushed in a transaction of its own instead. The
+// error of every target is returned, nil for the pushed ones. A target
+// rejecting the event by its overflow policy gets ErrEventQueueFull and does
+// not fail the others. The dead-letter pushes follow the transaction and are
+// retried on their own, see pushDeadLetter.
+//
+// A failed push is retried EVENT_PUSH_RETRIES times after
+// EVENT_PUSH_RETRY_DELAY, doubled by every retry, a push timing out may be
+// pushed twice then. The events failing every attempt are dropped, or
+// appended to EVENT_FALLBACK_FILE when it is set.
+func PushEvents(resources []Resource, values [][]byte) []error {
+	errs := make([]error, len(resources))
+	for _, group := range transactionGroups(len(resources)) {
+		groupResources := make([]Resource, len(group))
+		groupValues := make([][]byte, len(group))
+		for j, i := range group {
+			groupResources[j], groupValues[j] = resources[i], values[i]
+		}
+
+		var rejected []error
+		err := retryPush(func() (err error) {
+			rejected, err = pushEvents(groupResources, groupValues)
+			return err
+		})
+		for j, i := range group {
+			if err != nil {
+				fallbackEvent(resources[i], resources[i].QueueKey(), values[i])
+				errs[i] = err
+				continue
+			}
+			errs[i] = rejected[j]
+		}
+	}
+
+	return errs
+}
+
+// transactionGroups returns the indexes of the targets pushed in the same
+// transaction, all of them but in cluster mode.
+func transactionGroups(count int) [][]int {
+	if count == 0 {
+		return nil
+	}
+	if _, ok := client.(*redis.ClusterClient); !ok {
+		group := make([]int, count)
+		for i := range group {
+			group[i] = i
+		}
+		return [][]int{group}
+	}
+
+	groups := make([][]int, count)
+	for i := range groups {
+		groups[i] = []int{i}
+	}
+	return groups
+}
+
+// retryPush runs the push until it succeeds, at most EVENT_PUSH_RETRIES times
+// after the first attempt.
+func retryPush(push func() error) (err error) {
+	attempts := utils.GetEnvInt("EVENT_PUSH_RETRIES", 3) + 1
+	if attempts < 1 {
+		attempts = 1
+	}
+	delay := utils.GetEnvDuration("EVENT_PUSH_RETRY_DELAY", 100*time.Millisecond)
+
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		if err = push(); err == nil {
+			return err
+		}
+		DependencyErrors.WithLabelValues(DependencyRedis).Inc()
+	}
+
+	return fmt.Errorf("can not push event after %d attempts: %s", attempts, err)
+}
+
+// fallbackEvent appends the event of the list key to EVENT_FALLBACK_FILE, or
+// drops it when the file is not set or can not be written.
+func fallbackEvent(resource Resource, key string, value []byte) {
+	if path := utils.GetEnv("EVENT_FALLBACK_FILE", ""); path != "" {
+		err := appendFallbackEvent(path, key, value)
+		if err == nil {
+			utils.Warn("Event written to fallback file", utils.Fields{"target": resource.ARN(), "path": path})
+			return
+		}
+		utils.Error("Can not write event to fallback file", utils.Fields{"path": path, "error": err})
+	}
+	EventsDropped.WithLabelValues(resource.ARN()).Inc()
+}
+
+// limitedPushScript pushes ARGV[1] to the list KEYS[1] limited to ARGV[2]
+// events, the check and the push are atomic so concurrent pushes can not
+// overflow the limit. A full list gets the event only when ARGV[3] is 1, it
+// is trimmed to the limit then. The length before the push is returned.
+const limitedPushScript = `
+local length = redis.call("LLEN", KEYS[1])
+local limit = tonumber(ARGV[2])
+if length < limit then
+	redis.call("RPUSH", KEYS[1], ARGV[1])
+elseif ARGV[3] == "1" then
+	redis.call("RPUSH", KEYS[1], ARGV[1])
+	redis.call("LTRIM", KEYS[1], -limit, -1)
+end
+return length
+`
+
+// pushEvents pushes the events in one transaction, the lists of the targets
+// in EVENT_QUEUE_LIMITS are pushed by limitedPushScript. A target overflowing
+// to its dead-letter list gets the event there after the transaction. The
+// rejections of the targets are returned when the transaction is committed.
+func pushEvents(resources []Resource, values [][]byte) ([]error, error) {
+	limits := config.GetServerConfig().EventQueueLimits
+	limited := make([]*redis.Cmd, len(resources))
+	_, err := client.TxPipelined(func(pipe redis.Pipeliner) error {
+		for i, resource := range resources {
+			limit, ok := limits[resource.ARN()]
+			if !ok {
+				pipe.RPush(resource.QueueKey(), values[i])
+				continue
+			}
+			trim := 0
+			if limit.Overflow != config.OverflowReject && limit.Overflow != config.OverflowDeadLetter {
+				trim = 1
+			}
+			limited[i] = pipe.Eval(limitedPushScript, []string{resource.QueueKey()}, values[i], limit.MaxLength, trim)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rejected := make([]error, len(resources))
+	for i, cmd := range limited {
+		if cmd == nil {
+			continue
+		}
+		limit := limits[resources[i].ARN()]
+		if length, _ := cmd.Val().(int64); length < limit.MaxLength {
+			continue
+		}
+
+		eventQueueLimitHits.WithLabelValues(resources[i].ARN(), limit.Overflow).Inc()
+		switch limit.Overflow {
+		case config.OverflowReject:
+			rejected[i] = ErrEventQueueFull
+		case config.OverflowDeadLetter:
+			pushDeadLetter(resources[i], values[i])
+		}
+	}
+
+	return rejected, nil
+}
+
+// pushDeadLetter pushes an overflowing event to the dead-letter list of the
+// target. The transaction is already committed then, so only the dead-letter
+// push is retried, pushing the transaction again would duplicate the event
+// in the lists of the other targets.
+func pushDeadLetter(resource Resource, value []byte) {
+	key := resource.QueueKey() + ":dead-letter"
+	err := retryPush(func() error {
+		return client.RPush(key, value).Err()
+	})
+	if err != nil {
+		utils.Error("Can not push event to dead-letter list", utils.Fields{"target": resource.ARN(), "error": err})
+		fallbackEvent(resource, key, value)
+	}
+}
+
+var fallbackLock sync.Mutex
+
+// appendFallbackEvent appends the event as a JSON line with the key of its
+// list, so it can be pushed again when Redis is back.
+func appendFallbackEvent(path string, key string, value []byte) error {
+	line, err := json.Marshal(struct {
+		Key   string          `json:"key"`
+		Event json.RawMessage `json:"event"`
+	}{key, value})
+	if err != nil {
+		return err
+	}
+
+	fallbackLock.Lock()
+	defer fallbackLock.Unlock()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
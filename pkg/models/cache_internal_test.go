@@ -0,0 +1,226 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/inwinstack/kaoliang/pkg/config"
+)
+
+func TestNewCacheClient(t *testing.T) {
+	Convey("Given the Redis modes", t, func() {
+		os.Setenv("REDIS_SENTINEL_ADDRS", "sentinel-0:26379, sentinel-1:26379,")
+		defer os.Unsetenv("REDIS_SENTINEL_ADDRS")
+
+		Convey("Sentinel mode should connect to the master through the sentinels", func() {
+			client := newCacheClient(RedisModeSentinel)
+			defer client.Close()
+			_, ok := client.(*redis.Client)
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("Cluster mode should return a cluster client", func() {
+			client := newCacheClient(RedisModeCluster)
+			defer client.Close()
+			_, ok := client.(*redis.ClusterClient)
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("Unknown modes should fall back to a single node", func() {
+			client := newCacheClient("")
+			defer client.Close()
+			So(client.(*redis.Client).Options().Addr, ShouldEqual, "localhost:6789")
+			So(client.(*redis.Client).Options().ReadTimeout, ShouldEqual, 3*time.Second)
+		})
+
+		Convey("The addresses should be split", func() {
+			So(splitAddrs(os.Getenv("REDIS_SENTINEL_ADDRS")), ShouldResemble, []string{"sentinel-0:26379", "sentinel-1:26379"})
+		})
+	})
+}
+
+func TestPushEventFallback(t *testing.T) {
+	Convey("Given an unreachable Redis", t, func() {
+		config.SetServerConfig()
+		dir, _ := ioutil.TempDir("", "kaoliang")
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "events.jsonl")
+		os.Setenv("EVENT_PUSH_RETRIES", "2")
+		os.Setenv("EVENT_PUSH_RETRY_DELAY", "1ms")
+		defer os.Unsetenv("EVENT_PUSH_RETRIES")
+		defer os.Unsetenv("EVENT_PUSH_RETRY_DELAY")
+
+		saved := client
+		client = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", DialTimeout: 10 * time.Millisecond, MaxRetries: 0})
+		defer func() {
+			client.Close()
+			client = saved
+		}()
+		resource := Resource{Service: SQS, AccountID: "tester", Name: "foo"}
+
+		Convey("The push should fail after every attempt", func() {
+			err := PushEvent(resource, []byte(`{"Records":[]}`))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "after 3 attempts")
+		})
+
+		Convey("The event should be appended to the fallback file", func() {
+			os.Setenv("EVENT_FALLBACK_FILE", path)
+			defer os.Unsetenv("EVENT_FALLBACK_FILE")
+			So(PushEvent(resource, []byte(`{"Records":[]}`)), ShouldNotBeNil)
+
+			data, err := ioutil.ReadFile(path)
+			So(err, ShouldBeNil)
+			var line struct {
+				Key   string          `json:"key"`
+				Event json.RawMessage `json:"event"`
+			}
+			So(json.Unmarshal([]byte(strings.TrimSpace(string(data))), &line), ShouldBeNil)
+			So(line.Key, ShouldEqual, resource.QueueKey())
+			So(string(line.Event), ShouldEqual, `{"Records":[]}`)
+		})
+
+		Convey("Every event of a failed transaction should be appended", func() {
+			os.Setenv("EVENT_FALLBACK_FILE", path)
+			defer os.Unsetenv("EVENT_FALLBACK_FILE")
+			other := Resource{Service: SQS, AccountID: "tester", Name: "bar"}
+			errs := PushEvents([]Resource{resource, other}, [][]byte{[]byte(`{"Records":[1]}`), []byte(`{"Records":[2]}`)})
+			So(errs[0], ShouldNotBeNil)
+			So(errs[1], ShouldNotBeNil)
+
+			data, err := ioutil.ReadFile(path)
+			So(err, ShouldBeNil)
+			lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+			So(len(lines), ShouldEqual, 2)
+			So(lines[0], ShouldContainSubstring, resource.QueueKey())
+			So(lines[1], ShouldContainSubstring, other.QueueKey())
+		})
+	})
+}
+
+// fakeListClient keeps the lists in memory, only the commands of pushEvents
+// are implemented. The first failRPush direct RPUSHes fail.
+type fakeListClient struct {
+	redis.UniversalClient
+	lists        map[string][]string
+	transactions int
+	failRPush    int
+}
+
+func (c *fakeListClient) TxPipelined(fn func(redis.Pipeliner) error) ([]redis.Cmder, error) {
+	c.transactions++
+	return nil, fn(&fakeListPipeline{client: c})
+}
+
+func (c *fakeListClient) RPush(key string, values ...interface{}) *redis.IntCmd {
+	if c.failRPush > 0 {
+		c.failRPush--
+		return redis.NewIntResult(0, errors.New("unavailable"))
+	}
+	for _, value := range values {
+		c.lists[key] = append(c.lists[key], string(value.([]byte)))
+	}
+	return redis.NewIntResult(int64(len(c.lists[key])), nil)
+}
+
+// fakeListPipeline runs the commands at once, the script is limitedPushScript
+// without the trim.
+type fakeListPipeline struct {
+	redis.Pipeliner
+	client *fakeListClient
+}
+
+func (p *fakeListPipeline) RPush(key string, values ...interface{}) *redis.IntCmd {
+	for _, value := range values {
+		p.client.lists[key] = append(p.client.lists[key], string(value.([]byte)))
+	}
+	return redis.NewIntResult(int64(len(p.client.lists[key])), nil)
+}
+
+func (p *fakeListPipeline) Eval(script string, keys []string, args ...interface{}) *redis.Cmd {
+	length := int64(len(p.client.lists[keys[0]]))
+	if length < args[1].(int64) {
+		p.client.lists[keys[0]] = append(p.client.lists[keys[0]], string(args[0].([]byte)))
+	}
+	return redis.NewCmdResult(length, nil)
+}
+
+func TestPushEventsDeadLetter(t *testing.T) {
+	Convey("Given a full target overflowing to its dead-letter list", t, func() {
+		os.Setenv("EVENT_QUEUE_LIMITS", "arn:aws:sqs:us-east-1:tester:full=1:dead-letter")
+		os.Setenv("EVENT_PUSH_RETRY_DELAY", "1ms")
+		config.SetServerConfig()
+		defer func() {
+			os.Unsetenv("EVENT_QUEUE_LIMITS")
+			os.Unsetenv("EVENT_PUSH_RETRY_DELAY")
+			config.SetServerConfig()
+		}()
+
+		full := Resource{Service: SQS, AccountID: "tester", Name: "full"}
+		other := Resource{Service: SQS, AccountID: "tester", Name: "other"}
+		fake := &fakeListClient{lists: map[string][]string{full.QueueKey(): {"old"}}, failRPush: 1}
+		saved := client
+		client = fake
+		defer func() { client = saved }()
+
+		Convey("A failed dead-letter push should not push the other targets again", func() {
+			errs := PushEvents([]Resource{full, other}, [][]byte{[]byte("new"), []byte("new")})
+			So(errs, ShouldResemble, []error{nil, nil})
+			So(fake.transactions, ShouldEqual, 1)
+			So(fake.lists[other.QueueKey()], ShouldResemble, []string{"new"})
+			So(fake.lists[full.QueueKey()], ShouldResemble, []string{"old"})
+			So(fake.lists[full.QueueKey()+":dead-letter"], ShouldResemble, []string{"new"})
+		})
+	})
+}
+
+func TestPushEventsOutcomes(t *testing.T) {
+	Convey("Given a full target rejecting the new events", t, func() {
+		os.Setenv("EVENT_QUEUE_LIMITS", "arn:aws:sqs:us-east-1:tester:full=1:reject")
+		config.SetServerConfig()
+		defer func() {
+			os.Unsetenv("EVENT_QUEUE_LIMITS")
+			config.SetServerConfig()
+		}()
+
+		full := Resource{Service: SQS, AccountID: "tester", Name: "full"}
+		other := Resource{Service: SQS, AccountID: "tester", Name: "other"}
+		fake := &fakeListClient{lists: map[string][]string{full.QueueKey(): {"old"}}}
+		saved := client
+		client = fake
+		defer func() { client = saved }()
+
+		Convey("Only the full target should fail", func() {
+			errs := PushEvents([]Resource{full, other}, [][]byte{[]byte("new"), []byte("new")})
+			So(errs, ShouldResemble, []error{ErrEventQueueFull, nil})
+			So(fake.lists[full.QueueKey()], ShouldResemble, []string{"old"})
+			So(fake.lists[other.QueueKey()], ShouldResemble, []string{"new"})
+		})
+	})
+
+	Convey("Given the Redis modes", t, func() {
+		saved := client
+		defer func() { client = saved }()
+
+		Convey("A single node should push all the targets in one transaction", func() {
+			client = &fakeListClient{}
+			So(transactionGroups(3), ShouldResemble, [][]int{{0, 1, 2}})
+		})
+
+		Convey("A cluster should push every target on its own", func() {
+			client = redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{"127.0.0.1:1"}})
+			defer client.Close()
+			So(transactionGroups(3), ShouldResemble, [][]int{{0}, {1}, {2}})
+		})
+	})
+}
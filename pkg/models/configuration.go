@@ -25,7 +25,7 @@ type Event struct {
 
 // MarshalXML - encodes to XML data.
 func (event *Event) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
-	return e.EncodeElement(event.Name.String(), start)
+	return e.EncodeElement(EventNameString(event.Name), start)
 }
 
 func (e *Event) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
@@ -34,7 +34,7 @@ func (e *Event) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 		return err
 	}
 
-	eventName, err := event.ParseName(s)
+	eventName, err := ParseEventName(s)
 	if err != nil {
 		return err
 	}
@@ -274,7 +274,7 @@ func (rulesMap RulesMap) add(eventNames []event.Name, pattern string, resource R
 	rules[pattern] = append(rules[pattern], resource)
 
 	for _, eventName := range eventNames {
-		for _, name := range eventName.Expand() {
+		for _, name := range ExpandEventName(eventName) {
 			rulesMap[name] = rulesMap[name].Union(rules)
 		}
 	}
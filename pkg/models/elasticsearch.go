@@ -1,18 +1,80 @@
 package models
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
 	"github.com/inwinstack/kaoliang/pkg/utils"
 	"github.com/olivere/elastic"
 )
 
 var elsClient *elastic.Client
 
-func SetElasticsearch() {
-	var err error
-	elsClient, err = elastic.NewClient(
+// ElasticsearchAuth is the basic auth and the CA certificate of a cluster
+// behind authentication and TLS, the empty fields are not used.
+type ElasticsearchAuth struct {
+	Username string
+	Password string
+	CACert   string
+}
+
+// ElasticsearchAuthFromEnv reads the auth from ELS_USERNAME, ELS_PASSWORD and
+// ELS_CA_CERT.
+func ElasticsearchAuthFromEnv() ElasticsearchAuth {
+	return ElasticsearchAuth{
+		Username: utils.GetEnv("ELS_USERNAME", ""),
+		Password: utils.GetEnv("ELS_PASSWORD", ""),
+		CACert:   utils.GetEnv("ELS_CA_CERT", ""),
+	}
+}
+
+// Options returns the client options of the auth.
+func (auth ElasticsearchAuth) Options() ([]elastic.ClientOptionFunc, error) {
+	options := []elastic.ClientOptionFunc{}
+	if auth.Username != "" {
+		options = append(options, elastic.SetBasicAuth(auth.Username, auth.Password))
+	}
+
+	if auth.CACert != "" {
+		pem, err := ioutil.ReadFile(auth.CACert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificate is found in " + auth.CACert)
+		}
+		options = append(options, elastic.SetHttpClient(&http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}))
+	}
+
+	return options, nil
+}
+
+// NewElasticsearch connects a client to ELS_URL, for the services which only
+// need Elasticsearch occasionally.
+func NewElasticsearch() (*elastic.Client, error) {
+	options, err := ElasticsearchAuthFromEnv().Options()
+	if err != nil {
+		return nil, err
+	}
+
+	return elastic.NewClient(append(options,
 		elastic.SetURL(utils.GetEnv("ELS_URL", "http://localhost:9200")),
 		elastic.SetSniff(false),
-	)
+	)...)
+}
+
+func SetElasticsearch() {
+	var err error
+	elsClient, err = NewElasticsearch()
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,87 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package models
+
+import (
+	"encoding/json"
+
+	"github.com/minio/minio/pkg/event"
+)
+
+// ObjectRemovedDeleteMarkerCreated is the event of a DELETE which only adds a
+// delete marker to a versioned bucket. The vendored minio names stop at
+// s3:ObjectRemoved:Delete, so the name is mapped by the functions below. The
+// value is kept far from the minio ones since it is stored in the database.
+const ObjectRemovedDeleteMarkerCreated event.Name = 1000
+
+const deleteMarkerCreatedName = "s3:ObjectRemoved:DeleteMarkerCreated"
+
+// EventNameString - returns the string of the event name, like
+// event.Name.String() but with the names of this package.
+func EventNameString(name event.Name) string {
+	if name == ObjectRemovedDeleteMarkerCreated {
+		return deleteMarkerCreatedName
+	}
+
+	return name.String()
+}
+
+// ParseEventName - parses the event name, like event.ParseName() but with the
+// names of this package.
+func ParseEventName(s string) (event.Name, error) {
+	if s == deleteMarkerCreatedName {
+		return ObjectRemovedDeleteMarkerCreated, nil
+	}
+
+	return event.ParseName(s)
+}
+
+// ExpandEventName - returns the expanded values of the wildcard event name,
+// s3:ObjectRemoved:* also covers ObjectRemovedDeleteMarkerCreated.
+func ExpandEventName(name event.Name) []event.Name {
+	if name == event.ObjectRemovedAll {
+		return append(name.Expand(), ObjectRemovedDeleteMarkerCreated)
+	}
+
+	return name.Expand()
+}
+
+// S3Event is the event in the s3 format, the eventName of the embedded
+// event.Event is replaced by the one encoded by EventNameString.
+type S3Event struct {
+	event.Event
+	EventName string `json:"eventName"`
+}
+
+// NewS3Event - returns s3 payload of given event.
+func NewS3Event(e event.Event) S3Event {
+	return S3Event{Event: e, EventName: EventNameString(e.EventName)}
+}
+
+// UnmarshalEvent - decodes an event encoded in the s3 format.
+func UnmarshalEvent(data []byte) (event.Event, error) {
+	var e S3Event
+	if err := json.Unmarshal(data, &e); err != nil {
+		return event.Event{}, err
+	}
+
+	name, err := ParseEventName(e.EventName)
+	if err != nil {
+		return event.Event{}, err
+	}
+	e.Event.EventName = name
+
+	return e.Event, nil
+}
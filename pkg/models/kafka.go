@@ -0,0 +1,176 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package models
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/minio/minio/pkg/event"
+	sarama "gopkg.in/Shopify/sarama.v1"
+
+	"github.com/inwinstack/kaoliang/pkg/config"
+	"github.com/inwinstack/kaoliang/pkg/utils"
+)
+
+// KafkaTarget produces the events of a resource to a Kafka topic, in the
+// payload format of the resource.
+type KafkaTarget struct {
+	resource Resource
+	topic    string
+	producer sarama.SyncProducer
+}
+
+var _ event.Target = (*KafkaTarget)(nil)
+
+// ID - returns target ID.
+func (target *KafkaTarget) ID() event.TargetID {
+	return event.TargetID{ID: target.resource.ARN(), Name: "kafka"}
+}
+
+// Send - produces the event keyed by its bucket and object.
+func (target *KafkaTarget) Send(e event.Event) error {
+	value, err := MarshalEvent(e, target.resource)
+	if err != nil {
+		return err
+	}
+
+	return target.SendValue(e.S3.Bucket.Name+"/"+e.S3.Object.Key, value)
+}
+
+// SendValue - produces a marshalled message with the key.
+func (target *KafkaTarget) SendValue(key string, value []byte) error {
+	_, _, err := target.producer.SendMessage(&sarama.ProducerMessage{
+		Topic: target.topic,
+		Key:   sarama.StringEncoder(key),
+		Value: sarama.ByteEncoder(value),
+	})
+
+	return err
+}
+
+// Close - closes the producer.
+func (target *KafkaTarget) Close() error {
+	return target.producer.Close()
+}
+
+// NewKafkaTarget - connects a producer of the topic to KAFKA_BROKERS.
+func NewKafkaTarget(resource Resource, topic string) (*KafkaTarget, error) {
+	dialTimeout := utils.GetEnvDuration("KAFKA_DIAL_TIMEOUT", 5*time.Second)
+
+	kafkaConfig := sarama.NewConfig()
+	kafkaConfig.Net.DialTimeout = dialTimeout
+	kafkaConfig.Producer.RequiredAcks = sarama.WaitForAll
+	kafkaConfig.Producer.Return.Successes = true
+
+	producer, err := sarama.NewSyncProducer(config.GetServerConfig().KafkaBrokers, kafkaConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KafkaTarget{resource: resource, topic: topic, producer: producer}, nil
+}
+
+var (
+	kafkaTargets     = make(map[string]*KafkaTarget)
+	kafkaTargetsLock sync.Mutex
+)
+
+// SendKafkaEvent - produces the event to the Kafka topic of the resource in
+// KAFKA_TOPICS, ok is false when the resource has no topic. The producers are
+// kept per resource and dropped on a failure, so the next event reconnects.
+func SendKafkaEvent(resource Resource, e event.Event) (ok bool, err error) {
+	return sendKafka(resource, func(target *KafkaTarget) error {
+		return target.Send(e)
+	})
+}
+
+// SendKafkaValue - produces a marshalled message with the key to the Kafka
+// topic of the resource like SendKafkaEvent does.
+func SendKafkaValue(resource Resource, key string, value []byte) (ok bool, err error) {
+	return sendKafka(resource, func(target *KafkaTarget) error {
+		return target.SendValue(key, value)
+	})
+}
+
+func sendKafka(resource Resource, send func(target *KafkaTarget) error) (ok bool, err error) {
+	topic, ok := config.GetServerConfig().KafkaTopics[resource.ARN()]
+	if !ok {
+		return false, nil
+	}
+
+	target, err := getKafkaTarget(resource, topic)
+	if err != nil {
+		return true, err
+	}
+
+	if err = send(target); err != nil {
+		kafkaTargetsLock.Lock()
+		if kafkaTargets[resource.ARN()] == target {
+			delete(kafkaTargets, resource.ARN())
+		}
+		kafkaTargetsLock.Unlock()
+		target.Close()
+	}
+
+	return true, err
+}
+
+// getKafkaTarget returns the producer of the resource, connecting it when
+// there is none. The lock only guards the map, the producers are safe for
+// concurrent use.
+func getKafkaTarget(resource Resource, topic string) (*KafkaTarget, error) {
+	kafkaTargetsLock.Lock()
+	target, ok := kafkaTargets[resource.ARN()]
+	kafkaTargetsLock.Unlock()
+	if ok {
+		return target, nil
+	}
+
+	target, err := NewKafkaTarget(resource, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	kafkaTargetsLock.Lock()
+	defer kafkaTargetsLock.Unlock()
+	if connected, ok := kafkaTargets[resource.ARN()]; ok {
+		// connected by another event meanwhile
+		target.Close()
+		return connected, nil
+	}
+	kafkaTargets[resource.ARN()] = target
+
+	return target, nil
+}
+
+// KafkaBufferKey - returns the list keeping the events of the resource while
+// Kafka can not be reached, the eventconsumer produces it to Kafka again.
+func (r Resource) KafkaBufferKey() string {
+	return r.QueueKey() + ":kafka-buffer"
+}
+
+// BufferKafkaEvent - pushes the event to the Kafka buffer of the resource. The
+// event is kept as is, not in the payload format of the resource, so it is
+// produced again like SendKafkaEvent does.
+func BufferKafkaEvent(resource Resource, e event.Event) error {
+	value, err := json.Marshal(NewS3Event(e))
+	if err != nil {
+		return err
+	}
+
+	return client.RPush(resource.KafkaBufferKey(), value).Err()
+}
@@ -0,0 +1,134 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package models
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/inwinstack/kaoliang/pkg/utils"
+)
+
+var eventQueueLimitHits = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "kaoliang_event_queue_limit_hits_total",
+		Help: "Number of events pushed to a full event queue, by target and overflow policy.",
+	},
+	[]string{"target", "policy"},
+)
+
+// ProxiedRequests counts the requests proxied to RGW.
+var ProxiedRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "kaoliang_proxied_requests_total",
+		Help: "Number of requests proxied to RGW, by method and status.",
+	},
+	[]string{"method", "status"},
+)
+
+// EventsPublished counts the events delivered to the targets.
+var EventsPublished = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "kaoliang_events_published_total",
+		Help: "Number of events delivered to the targets, by event type.",
+	},
+	[]string{"type"},
+)
+
+// EventsDropped counts the events which could not be pushed to the list of
+// their target.
+var EventsDropped = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "kaoliang_events_dropped_total",
+		Help: "Number of events dropped after failing every push, by target.",
+	},
+	[]string{"target"},
+)
+
+// SearchDuration observes the metadata search requests.
+var SearchDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "kaoliang_search_duration_seconds",
+		Help:    "Duration of the metadata search requests, by status.",
+		Buckets: prometheus.DefBuckets,
+	},
+	[]string{"status"},
+)
+
+// DependencyErrors counts the failed calls to Redis and Elasticsearch.
+var DependencyErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "kaoliang_dependency_errors_total",
+		Help: "Number of failed calls to the dependencies, by dependency.",
+	},
+	[]string{"dependency"},
+)
+
+// Dependencies counted by DependencyErrors.
+const (
+	DependencyRedis         = "redis"
+	DependencyElasticsearch = "elasticsearch"
+)
+
+// BucketUsersCacheRequests counts the lookups of the bucket users cache, the
+// hit ratio is the hits over all the lookups.
+var BucketUsersCacheRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "kaoliang_bucket_users_cache_requests_total",
+		Help: "Number of lookups of the bucket users cache, by result.",
+	},
+	[]string{"result"},
+)
+
+// NotificationConfigCacheRequests counts the lookups of the notification
+// config cache like BucketUsersCacheRequests.
+var NotificationConfigCacheRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "kaoliang_notification_config_cache_requests_total",
+		Help: "Number of lookups of the notification config cache, by result.",
+	},
+	[]string{"result"},
+)
+
+// Results counted by BucketUsersCacheRequests and
+// NotificationConfigCacheRequests.
+const (
+	CacheHit  = "hit"
+	CacheMiss = "miss"
+)
+
+func init() {
+	prometheus.MustRegister(eventQueueLimitHits, ProxiedRequests, EventsPublished, EventsDropped, SearchDuration,
+		DependencyErrors, BucketUsersCacheRequests, NotificationConfigCacheRequests)
+}
+
+// ServeMetrics serves /metrics on METRICS_ADDR in the background, the metrics
+// are not served when it is not set.
+func ServeMetrics() {
+	addr := utils.GetEnv("METRICS_ADDR", "")
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			utils.Error("Can not serve metrics", utils.Fields{"addr": addr, "error": err})
+		}
+	}()
+}
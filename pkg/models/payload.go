@@ -0,0 +1,102 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/minio/minio/pkg/event"
+
+	"github.com/inwinstack/kaoliang/pkg/config"
+)
+
+// TrimmedEvent is the reduced event payload for targets which only need to
+// know what happened to which object. It drops the identity, request,
+// response and schema fields of the AWS compatible event.
+type TrimmedEvent struct {
+	EventName string `json:"eventName"`
+	EventTime string `json:"eventTime"`
+	Bucket    string `json:"bucket"`
+	Key       string `json:"key"`
+}
+
+// NewTrimmedEvent - returns trimmed payload of given event.
+func NewTrimmedEvent(e event.Event) TrimmedEvent {
+	return TrimmedEvent{
+		EventName: EventNameString(e.EventName),
+		EventTime: e.EventTime,
+		Bucket:    e.S3.Bucket.Name,
+		Key:       e.S3.Object.Key,
+	}
+}
+
+// CloudEvent is the event wrapped in a CloudEvents 1.0 envelope, in the
+// structured JSON mode.
+type CloudEvent struct {
+	SpecVersion     string  `json:"specversion"`
+	ID              string  `json:"id"`
+	Source          string  `json:"source"`
+	Type            string  `json:"type"`
+	Time            string  `json:"time"`
+	Subject         string  `json:"subject"`
+	DataContentType string  `json:"datacontenttype"`
+	Data            S3Event `json:"data"`
+}
+
+// NewCloudEvent - returns CloudEvents envelope of given event.
+func NewCloudEvent(e event.Event) CloudEvent {
+	return CloudEvent{
+		SpecVersion:     "1.0",
+		ID:              e.S3.Object.Sequencer,
+		Source:          fmt.Sprintf("%s:%s:%s", e.EventSource, e.AwsRegion, e.S3.Bucket.Name),
+		Type:            EventNameString(e.EventName),
+		Time:            e.EventTime,
+		Subject:         e.S3.Object.Key,
+		DataContentType: "application/json",
+		Data:            NewS3Event(e),
+	}
+}
+
+// EventFormat - returns the payload format configured for the resource in
+// EVENT_TARGET_FORMATS. The resources listed in TRIMMED_EVENT_TARGETS get
+// the trimmed format, the others the s3 format.
+func (r Resource) EventFormat() string {
+	serverConfig := config.GetServerConfig()
+	arn := r.ARN()
+	if format, ok := serverConfig.EventFormats[arn]; ok {
+		return format
+	}
+
+	for _, target := range serverConfig.TrimmedEventTargets {
+		if target == arn {
+			return config.EventFormatTrimmed
+		}
+	}
+
+	return config.EventFormatS3
+}
+
+// MarshalEvent - encodes event as the payload format of given resource.
+func MarshalEvent(e event.Event, resource Resource) ([]byte, error) {
+	switch resource.EventFormat() {
+	case config.EventFormatTrimmed:
+		return json.Marshal(NewTrimmedEvent(e))
+	case config.EventFormatCloudEvents:
+		return json.Marshal(NewCloudEvent(e))
+	default:
+		return json.Marshal(NewS3Event(e))
+	}
+}
@@ -0,0 +1,105 @@
+package models_test
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/minio/minio/pkg/event"
+
+	"github.com/inwinstack/kaoliang/pkg/config"
+	"github.com/inwinstack/kaoliang/pkg/models"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMarshalEventFormats(t *testing.T) {
+	os.Setenv("EVENT_TARGET_FORMATS", "arn:aws:sns:us-east-1:tester:cloud=cloudevents,arn:aws:sqs:us-east-1:tester:lite=trimmed")
+	setup()
+	defer func() {
+		os.Unsetenv("EVENT_TARGET_FORMATS")
+		config.SetServerConfig()
+	}()
+
+	Convey("Given an event fanned out to targets of different formats", t, func() {
+		e := event.Event{
+			EventVersion: "2.0",
+			EventSource:  "aws:s3",
+			AwsRegion:    "us-east-1",
+			EventTime:    "2018-08-01T10:00:00Z",
+			EventName:    event.ObjectCreatedPut,
+			S3: event.Metadata{
+				Bucket: event.Bucket{Name: "photos"},
+				Object: event.Object{Key: "cat.jpg", Sequencer: "1546A2F6D1B4C000"},
+			},
+		}
+		native := models.Resource{Service: models.SQS, AccountID: "tester", Name: "native"}
+		lite := models.Resource{Service: models.SQS, AccountID: "tester", Name: "lite"}
+		cloud := models.Resource{Service: models.SNS, AccountID: "tester", Name: "cloud"}
+
+		Convey("When marshaling the event for every target", func() {
+			payloads := map[string]map[string]interface{}{}
+			for _, resource := range []models.Resource{native, lite, cloud} {
+				data, err := models.MarshalEvent(e, resource)
+				So(err, ShouldBeNil)
+				var payload map[string]interface{}
+				So(json.Unmarshal(data, &payload), ShouldBeNil)
+				payloads[resource.Name] = payload
+			}
+
+			Convey("An unlisted target should get the s3 format", func() {
+				So(native.EventFormat(), ShouldEqual, config.EventFormatS3)
+				So(payloads["native"], ShouldContainKey, "s3")
+			})
+
+			Convey("A trimmed target should get the trimmed format", func() {
+				So(lite.EventFormat(), ShouldEqual, config.EventFormatTrimmed)
+				So(payloads["lite"]["key"], ShouldEqual, "cat.jpg")
+				So(payloads["lite"], ShouldNotContainKey, "s3")
+			})
+
+			Convey("A cloudevents target should get the CloudEvents envelope", func() {
+				So(cloud.EventFormat(), ShouldEqual, config.EventFormatCloudEvents)
+				So(payloads["cloud"]["specversion"], ShouldEqual, "1.0")
+				So(payloads["cloud"]["type"], ShouldEqual, "s3:ObjectCreated:Put")
+				So(payloads["cloud"]["subject"], ShouldEqual, "cat.jpg")
+				So(payloads["cloud"], ShouldContainKey, "data")
+			})
+		})
+	})
+}
+
+func TestDeleteMarkerEventName(t *testing.T) {
+	Convey("Given an event of a delete marker", t, func() {
+		e := event.Event{
+			EventName: models.ObjectRemovedDeleteMarkerCreated,
+			S3:        event.Metadata{Object: event.Object{Key: "cat.jpg"}},
+		}
+
+		Convey("The s3 format should carry the name of the event", func() {
+			data, err := json.Marshal(models.NewS3Event(e))
+			So(err, ShouldBeNil)
+			var payload map[string]interface{}
+			So(json.Unmarshal(data, &payload), ShouldBeNil)
+			So(payload["eventName"], ShouldEqual, "s3:ObjectRemoved:DeleteMarkerCreated")
+			So(payload, ShouldContainKey, "s3")
+		})
+
+		Convey("The event should be decoded with its name", func() {
+			data, err := json.Marshal(models.NewS3Event(e))
+			So(err, ShouldBeNil)
+			decoded, err := models.UnmarshalEvent(data)
+			So(err, ShouldBeNil)
+			So(decoded.EventName, ShouldEqual, models.ObjectRemovedDeleteMarkerCreated)
+			So(decoded.S3.Object.Key, ShouldEqual, "cat.jpg")
+		})
+
+		Convey("The minio names should be kept as is", func() {
+			name, err := models.ParseEventName("s3:ObjectRemoved:Delete")
+			So(err, ShouldBeNil)
+			So(name, ShouldEqual, event.ObjectRemovedDelete)
+			So(models.EventNameString(name), ShouldEqual, "s3:ObjectRemoved:Delete")
+			So(models.ExpandEventName(event.ObjectCreatedAll), ShouldResemble, event.ObjectCreatedAll.Expand())
+		})
+	})
+}
@@ -0,0 +1,67 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package models
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/inwinstack/kaoliang/pkg/utils"
+)
+
+// WebhookProtocol is the subscription protocol of the endpoints which get the
+// events posted by kaoliang itself instead of the celery workers.
+const WebhookProtocol = "webhook"
+
+// SignPayload returns the hex encoded HMAC-SHA256 of the payload.
+func SignPayload(secret string, value []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(value)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// PostWebhook posts the event to the endpoint within WEBHOOK_TIMEOUT. When
+// WEBHOOK_SECRET is set the payload is signed in the X-Kaoliang-Signature
+// header, so the receivers can verify the events come from kaoliang.
+func PostWebhook(uri string, value []byte) error {
+	timeout := utils.GetEnvDuration("WEBHOOK_TIMEOUT", 5*time.Second)
+
+	req, err := http.NewRequest("POST", uri, bytes.NewReader(value))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret := utils.GetEnv("WEBHOOK_SECRET", ""); secret != "" {
+		req.Header.Set("X-Kaoliang-Signature", "sha256="+SignPayload(secret, value))
+	}
+
+	resp, err := (&http.Client{Timeout: timeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("The webhook %s returned %s", uri, resp.Status)
+	}
+
+	return nil
+}
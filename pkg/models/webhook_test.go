@@ -0,0 +1,43 @@
+package models_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/inwinstack/kaoliang/pkg/models"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPostWebhook(t *testing.T) {
+	os.Setenv("WEBHOOK_SECRET", "secret")
+	defer os.Unsetenv("WEBHOOK_SECRET")
+
+	Convey("Given a webhook endpoint", t, func() {
+		var signature string
+		var payload []byte
+		status := http.StatusOK
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			signature = r.Header.Get("X-Kaoliang-Signature")
+			payload, _ = ioutil.ReadAll(r.Body)
+			w.WriteHeader(status)
+		}))
+		defer server.Close()
+
+		value := []byte(`{"Records":[]}`)
+
+		Convey("The event should be posted with the signature of the payload", func() {
+			So(models.PostWebhook(server.URL, value), ShouldBeNil)
+			So(string(payload), ShouldEqual, string(value))
+			So(signature, ShouldEqual, "sha256="+models.SignPayload("secret", value))
+		})
+
+		Convey("A failed delivery should return an error", func() {
+			status = http.StatusInternalServerError
+			So(models.PostWebhook(server.URL, value), ShouldNotBeNil)
+		})
+	})
+}
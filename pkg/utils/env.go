@@ -14,7 +14,11 @@ Licensed under the Apache License, Version 2.0 (the "License");
 
 package utils
 
-import "os"
+import (
+	"os"
+	"strconv"
+	"time"
+)
 
 func GetEnv(key, defaultValue string) string {
 	if value, ok := os.LookupEnv(key); ok {
@@ -23,3 +27,66 @@ func GetEnv(key, defaultValue string) string {
 
 	return defaultValue
 }
+
+// GetEnvInt returns the env value as an int, the default is used with a
+// warning when it is not a number.
+func GetEnvInt(key string, defaultValue int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return defaultValue
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		Warn("The env value is not a number, using the default", Fields{"key": key, "value": value, "default": defaultValue})
+		return defaultValue
+	}
+
+	return i
+}
+
+// GetEnvPositiveInt is GetEnvInt for the counts and sizes, the default is
+// also used when the value is not positive.
+func GetEnvPositiveInt(key string, defaultValue int) int {
+	i := GetEnvInt(key, defaultValue)
+	if i <= 0 {
+		Warn("The env value is not positive, using the default", Fields{"key": key, "value": i, "default": defaultValue})
+		return defaultValue
+	}
+
+	return i
+}
+
+// GetEnvBool returns the env value as a bool, the default is used with a
+// warning when it is not one of the values strconv.ParseBool accepts.
+func GetEnvBool(key string, defaultValue bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		Warn("The env value is not a bool, using the default", Fields{"key": key, "value": value, "default": defaultValue})
+		return defaultValue
+	}
+
+	return b
+}
+
+// GetEnvDuration returns the env value as a duration, e.g. 500ms or 1h, the
+// default is used with a warning when it can not be parsed.
+func GetEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return defaultValue
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		Warn("The env value is not a duration, using the default", Fields{"key": key, "value": value, "default": defaultValue})
+		return defaultValue
+	}
+
+	return d
+}
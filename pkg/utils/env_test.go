@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTypedEnv(t *testing.T) {
+	Convey("Given typed env values", t, func() {
+		defer os.Unsetenv("KAOLIANG_TEST_VALUE")
+
+		Convey("Unset values should use the defaults", func() {
+			os.Unsetenv("KAOLIANG_TEST_VALUE")
+			So(GetEnvInt("KAOLIANG_TEST_VALUE", 3), ShouldEqual, 3)
+			So(GetEnvBool("KAOLIANG_TEST_VALUE", true), ShouldBeTrue)
+			So(GetEnvDuration("KAOLIANG_TEST_VALUE", time.Second), ShouldEqual, time.Second)
+		})
+
+		Convey("Valid values should be parsed", func() {
+			os.Setenv("KAOLIANG_TEST_VALUE", "12")
+			So(GetEnvInt("KAOLIANG_TEST_VALUE", 3), ShouldEqual, 12)
+			os.Setenv("KAOLIANG_TEST_VALUE", "false")
+			So(GetEnvBool("KAOLIANG_TEST_VALUE", true), ShouldBeFalse)
+			os.Setenv("KAOLIANG_TEST_VALUE", "500ms")
+			So(GetEnvDuration("KAOLIANG_TEST_VALUE", time.Second), ShouldEqual, 500*time.Millisecond)
+		})
+
+		Convey("Invalid values should use the defaults", func() {
+			os.Setenv("KAOLIANG_TEST_VALUE", "many")
+			So(GetEnvInt("KAOLIANG_TEST_VALUE", 3), ShouldEqual, 3)
+			So(GetEnvBool("KAOLIANG_TEST_VALUE", true), ShouldBeTrue)
+			So(GetEnvDuration("KAOLIANG_TEST_VALUE", time.Second), ShouldEqual, time.Second)
+			os.Setenv("KAOLIANG_TEST_VALUE", "-1")
+			So(GetEnvPositiveInt("KAOLIANG_TEST_VALUE", 3), ShouldEqual, 3)
+		})
+	})
+}
@@ -0,0 +1,111 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fields are the key values of a log line.
+type Fields map[string]interface{}
+
+// Log levels, the lines below LOG_LEVEL are not written.
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+var (
+	logOutput io.Writer = os.Stderr
+	logLevel            = -1
+	logLock   sync.Mutex
+)
+
+// parseLogLevel returns the level of the name, unknown names are info.
+func parseLogLevel(name string) int {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level
+		}
+	}
+
+	return LevelInfo
+}
+
+// writeLog writes the line in logfmt, e.g.
+// time=2018-05-26T10:00:00Z level=warn msg="Can not push event" target=arn:aws:sqs:...
+func writeLog(level int, msg string, fields Fields) {
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	if logLevel == -1 {
+		logLevel = parseLogLevel(GetEnv("LOG_LEVEL", "info"))
+	}
+	if level < logLevel {
+		return
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	line := fmt.Sprintf("time=%s level=%s msg=%s", time.Now().UTC().Format(time.RFC3339), levelNames[level], logValue(msg))
+	for _, key := range keys {
+		line += fmt.Sprintf(" %s=%s", key, logValue(fields[key]))
+	}
+	fmt.Fprintln(logOutput, line)
+}
+
+// logValue quotes the values with spaces, quotes or equal signs.
+func logValue(value interface{}) string {
+	s := fmt.Sprint(value)
+	if s == "" || strings.ContainsAny(s, " \"=\t\n") {
+		return fmt.Sprintf("%q", s)
+	}
+
+	return s
+}
+
+// Debug writes a debug line.
+func Debug(msg string, fields Fields) {
+	writeLog(LevelDebug, msg, fields)
+}
+
+// Info writes an info line.
+func Info(msg string, fields Fields) {
+	writeLog(LevelInfo, msg, fields)
+}
+
+// Warn writes a warning line.
+func Warn(msg string, fields Fields) {
+	writeLog(LevelWarn, msg, fields)
+}
+
+// Error writes an error line.
+func Error(msg string, fields Fields) {
+	writeLog(LevelError, msg, fields)
+}
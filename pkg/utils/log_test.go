@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWriteLog(t *testing.T) {
+	Convey("Given a logger at the warn level", t, func() {
+		var buf bytes.Buffer
+		logOutput, logLevel = &buf, LevelWarn
+		defer func() {
+			logOutput, logLevel = os.Stderr, -1
+		}()
+
+		Convey("The lines below the level should not be written", func() {
+			Info("Not written", nil)
+			So(buf.String(), ShouldBeEmpty)
+		})
+
+		Convey("The fields should be written sorted and quoted", func() {
+			Error("Can not push event", Fields{"target": "arn:aws:sqs:us-east-1:tester:foo", "error": errors.New("connection refused")})
+			So(buf.String(), ShouldContainSubstring, `level=error msg="Can not push event" error="connection refused" target=arn:aws:sqs:us-east-1:tester:foo`)
+		})
+	})
+
+	Convey("Unknown level names should be info", t, func() {
+		So(parseLogLevel("WARN"), ShouldEqual, LevelWarn)
+		So(parseLogLevel("verbose"), ShouldEqual, LevelInfo)
+	})
+}